@@ -0,0 +1,238 @@
+// dbtool 检查和查看数据库文件
+//
+//	dbtool check [-wal] FILE    检查 B 树和 freelist
+//	dbtool meta FILE            输出 meta
+//	dbtool page FILE PTR        输出一个页面，解码已知表的键
+//	dbtool tree FILE            输出树的高度和每一层的扇出
+//	dbtool tables FILE          输出所有的表定义
+//	dbtool stats FILE           输出树、文件和每个表的统计
+//	dbtool export [-json] [-depth N] FILE
+//	                            以 DOT（默认）或 JSON 格式导出树的结构
+//
+// 都以只读方式打开，不修改数据库文件和日志。日志中还没有 checkpoint 的提交默认不可见，
+// check -wal 将日志中的提交读入内存之后检查。
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"db-practice/core"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  dbtool check [-wal] FILE
+  dbtool meta FILE
+  dbtool page FILE PTR
+  dbtool tree FILE
+  dbtool tables FILE
+  dbtool stats FILE
+  dbtool export [-json] [-depth N] FILE`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "check":
+		err = check(args)
+	case "meta":
+		err = withDB(args, 0, meta)
+	case "page":
+		err = withDB(args, 1, page)
+	case "tree":
+		err = withDB(args, 0, tree)
+	case "tables":
+		err = withDB(args, 0, tables)
+	case "stats":
+		err = withDB(args, 0, stats)
+	case "export":
+		err = export(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbtool:", err)
+		os.Exit(1)
+	}
+}
+
+// open 只读打开已经存在的数据库文件，wal 为 true 时同时读取日志
+func open(path string, wal bool) (*core.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db := &core.DB{Path: path, WAL: wal, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// withDB 只读打开 args[0]，其余的 n 个参数交给 fn
+func withDB(args []string, n int, fn func(db *core.DB, args []string) error) error {
+	if len(args) != n+1 {
+		usage()
+	}
+	db, err := open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return fn(db, args[1:])
+}
+
+// printJSON 缩进输出
+func printJSON(v any) {
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(out))
+}
+
+// check 检查 B 树和 freelist，有问题时逐行输出
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	wal := flags.Bool("wal", false, "read the commits in the write-ahead log FILE-wal without applying them")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	db, err := open(flags.Arg(0), *wal)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.Check()
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d pages: %d tree nodes, %d overflow, %d freelist nodes, %d free\n",
+		report.Pages, report.Nodes, report.Overflow, report.List, report.Free)
+	fmt.Printf("depth %d, %d keys\n", report.Depth, report.Keys)
+	return err
+}
+
+func meta(db *core.DB, _ []string) error {
+	printJSON(db.Meta())
+	return nil
+}
+
+// page 输出页面的 JSON，B 树结点中属于已知表的键通过表定义解码
+func page(db *core.DB, args []string) error {
+	ptr, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	info, err := db.Page(ptr)
+	if err != nil {
+		return err
+	}
+	if !info.Checksum {
+		fmt.Println("bad checksum")
+	}
+	fmt.Println(info.JSON)
+	if len(info.Keys) == 0 {
+		return nil
+	}
+	tdefs, err := db.Tables()
+	if err != nil {
+		return err
+	}
+	for _, tdef := range core.InternalTables {
+		tdefs = append(tdefs, *tdef)
+	}
+	for i, key := range info.Keys {
+		fmt.Printf("key %d: %s\n", i, describeKey(tdefs, key))
+	}
+	return nil
+}
+
+// describeKey 将键解码为 table(col=val, ...)，不属于已知表时输出原始的键
+func describeKey(tdefs []core.TableDef, key []byte) string {
+	for _, tdef := range tdefs {
+		rec, err := tdef.DecodeKey(key)
+		if err != nil {
+			continue
+		}
+		var cols []string
+		for i, col := range rec.Cols {
+			v := rec.Vals[i]
+			if v.Type == core.TypeInt64 {
+				cols = append(cols, fmt.Sprintf("%s=%d", col, v.I64))
+			} else {
+				cols = append(cols, fmt.Sprintf("%s=%q", col, v.Str))
+			}
+		}
+		return fmt.Sprintf("%s(%s)", tdef.Name, strings.Join(cols, ", "))
+	}
+	return strconv.Quote(string(key))
+}
+
+// tree 输出树的高度，每一层的结点数、扇出和填充率
+func tree(db *core.DB, _ []string) error {
+	levels, err := db.TreeLevels()
+	if err != nil {
+		return err
+	}
+	pageSize := db.Meta().PageSize
+	fmt.Printf("height %d\n", len(levels))
+	for i, level := range levels {
+		fill := float64(level.Bytes) / float64(level.Nodes*uint64(pageSize)) * 100
+		avg := float64(level.Keys) / float64(level.Nodes)
+		if i+1 < len(levels) {
+			fmt.Printf("level %d: %d nodes, fan-out %.1f, fill %.1f%%\n", i, level.Nodes, avg, fill)
+		} else {
+			fmt.Printf("level %d: %d leaves, %.1f keys per leaf, fill %.1f%%\n", i, level.Nodes, avg, fill)
+		}
+	}
+	return nil
+}
+
+// tables 输出 @table 中的表定义
+func tables(db *core.DB, _ []string) error {
+	tdefs, err := db.Tables()
+	if err != nil {
+		return err
+	}
+	for _, tdef := range tdefs {
+		printJSON(tdef)
+	}
+	return nil
+}
+
+func stats(db *core.DB, _ []string) error {
+	s, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	printJSON(s)
+	return nil
+}
+
+// export 导出树的结构，DOT 可以用 Graphviz 渲染：dbtool export FILE | dot -Tsvg
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output nested JSON instead of DOT")
+	depth := flags.Int("depth", 0, "export at most N levels (0 for all)")
+	_ = flags.Parse(args)
+	return withDB(flags.Args(), 0, func(db *core.DB, _ []string) error {
+		root, err := db.ExportTree(*depth)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			printJSON(root)
+			return nil
+		}
+		return root.WriteDOT(os.Stdout)
+	})
+}
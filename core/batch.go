@@ -0,0 +1,394 @@
+package core
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+)
+
+// 批量写入中的操作
+const (
+	BatchPut         = 0 // 插入或替换
+	BatchDelete      = 1 // 删除一个键
+	BatchDeleteRange = 2 // 删除 [Key, End) 范围内的键
+)
+
+// BatchOp 批量写入中的一个操作，Write 之后记录结果
+type BatchOp struct {
+	Op  int
+	Key []byte // DeleteRange 时为空表示从第一个键开始
+	Val []byte
+	End []byte // DeleteRange 的结束位置（不包括），为空时到最后一个键
+
+	Added   bool // 添加了新key
+	Updated bool // 添加、更改或删除了key
+	Deleted int  // 删除的key数
+}
+
+// WriteBatch 一组修改，按顺序生效，提交时只切换一次 meta 页面
+// 与事务不同，批量写入中不能读取。
+type WriteBatch struct {
+	Ops []BatchOp
+}
+
+// Put 插入或替换键值对
+func (b *WriteBatch) Put(key []byte, val []byte) *WriteBatch {
+	b.Ops = append(b.Ops, BatchOp{Op: BatchPut, Key: key, Val: val})
+	return b
+}
+
+// Delete 删除键
+func (b *WriteBatch) Delete(key []byte) *WriteBatch {
+	b.Ops = append(b.Ops, BatchOp{Op: BatchDelete, Key: key})
+	return b
+}
+
+// DeleteRange 删除 [start, end) 范围内的键
+func (b *WriteBatch) DeleteRange(start []byte, end []byte) *WriteBatch {
+	b.Ops = append(b.Ops, BatchOp{Op: BatchDeleteRange, Key: start, End: end})
+	return b
+}
+
+// Write 应用批量写入并提交，没有任何修改时不写入文件
+func (db *KV) Write(batch *WriteBatch) error {
+	tx := db.Begin()
+	updated, err := tx.Write(batch)
+	if err != nil || !updated {
+		tx.Abort()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		batch.reset()
+		return err
+	}
+	return nil
+}
+
+// Write 在事务中应用批量写入，返回是否修改了树
+// 先按顺序计算每个操作的结果和每个键最终的状态，
+// 再按键的顺序一次修改整棵树，同一个结点只复制一次。
+func (tx *KVTX) Write(batch *WriteBatch) (updated bool, err error) {
+	if tx.err != nil {
+		return false, tx.err
+	}
+	batch.reset()
+	tree := &tx.db.tree
+	for i := range batch.Ops {
+		if err = batchCheck(tree, &batch.Ops[i]); err != nil {
+			return false, err
+		}
+	}
+	defer tx.fail(&err)
+	defer recoverCorrupt(&err)
+	muts, err := batchResolve(tree, batch)
+	if err != nil {
+		return false, err
+	}
+	return treeApplyRoot(tree, muts), nil
+}
+
+// reset 清除上一次 Write 的结果
+func (b *WriteBatch) reset() {
+	for i := range b.Ops {
+		op := &b.Ops[i]
+		op.Added, op.Updated, op.Deleted = false, false, 0
+	}
+}
+
+// batchCheck 检查操作的参数
+func batchCheck(tree *BTree, op *BatchOp) error {
+	switch op.Op {
+	case BatchPut:
+		if len(op.Val) > MaxValSize {
+			return ErrValueTooLarge
+		}
+		return tree.checkKey(op.Key)
+	case BatchDelete:
+		return tree.checkKey(op.Key)
+	case BatchDeleteRange:
+		return nil
+	default:
+		return ErrBadOp
+	}
+}
+
+// batchMut 一个键最终的修改
+type batchMut struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// batchResolve 按顺序计算每个操作的结果，返回按键排序的最终修改
+// 范围删除展开为其中每个已有的键的删除。
+func batchResolve(tree *BTree, batch *WriteBatch) ([]*batchMut, error) {
+	muts := map[string]*batchMut{}
+	// lookup 返回 key 在之前的操作之后是否存在，以及值是否等于 val
+	lookup := func(key []byte, val []byte) (found bool, equal bool) {
+		if m, ok := muts[string(key)]; ok {
+			return !m.del, !m.del && bytes.Equal(m.val, val)
+		}
+		node, idx, ok := treeLookup(tree, key)
+		return ok, ok && leafValEqual(tree, node, idx, val)
+	}
+	for i := range batch.Ops {
+		op := &batch.Ops[i]
+		switch op.Op {
+		case BatchPut:
+			found, equal := lookup(op.Key, op.Val)
+			op.Added, op.Updated = !found, !equal
+			muts[string(op.Key)] = &batchMut{key: op.Key, val: op.Val}
+		case BatchDelete:
+			if found, _ := lookup(op.Key, nil); found {
+				op.Updated, op.Deleted = true, 1
+			}
+			muts[string(op.Key)] = &batchMut{key: op.Key, del: true}
+		case BatchDeleteRange:
+			inRange := func(key []byte) bool {
+				return bytes.Compare(op.Key, key) <= 0 && (len(op.End) == 0 || bytes.Compare(key, op.End) < 0)
+			}
+			for _, m := range muts {
+				if !m.del && inRange(m.key) {
+					m.val, m.del = nil, true
+					op.Deleted++
+				}
+			}
+			// 之前的操作涉及的键已经在上面处理
+			iter := tree.Seek(op.Key, CmpGe)
+			for ; iter.Valid() && inRange(iter.Key()); iter.Next() {
+				if _, ok := muts[string(iter.Key())]; !ok {
+					key := bytes.Clone(iter.Key())
+					muts[string(key)] = &batchMut{key: key, del: true}
+					op.Deleted++
+				}
+			}
+			if err := iter.Err(); err != nil {
+				return nil, err
+			}
+			op.Updated = op.Deleted > 0
+		}
+	}
+	return slices.SortedFunc(maps.Values(muts), func(a, b *batchMut) int {
+		return bytes.Compare(a.key, b.key)
+	}), nil
+}
+
+// treeApplyRoot 将修改应用到整棵树，返回是否修改了树
+func treeApplyRoot(tree *BTree, muts []*batchMut) bool {
+	var root BNode
+	if tree.root == 0 {
+		// 一个虚拟键，这使得树覆盖整个键空间，见 BTree.Update
+		root = nodeBuild(BNodeLeaf, []nodeEntry{{}})
+	} else {
+		root = tree.get(tree.root)
+	}
+	kids, changed := treeApply(tree, root, muts)
+	if !changed {
+		return false
+	}
+	if tree.root != 0 {
+		tree.del(tree.root)
+	}
+	// 虚拟键不会被删除，最左边的结点总是存在
+	for len(kids) > 1 {
+		// 根被分割时添加新级别
+		kids = nodeBuildAll(tree, BNodeNode, allocNodes(tree, kids))
+	}
+	root = kids[0]
+	// 只有一个孩子的根被删除
+	for root.bType() == BNodeNode && root.nKeys() == 1 {
+		ptr := root.getPtr(0)
+		tree.root, root = ptr, tree.get(ptr)
+		if root.bType() == BNodeLeaf || root.nKeys() > 1 {
+			return true
+		}
+		tree.del(ptr)
+	}
+	tree.root = tree.alloc(root)
+	return true
+}
+
+// treeApply 将有序的修改应用到子树，返回新的结点，每个结点都能放入一个页面
+// 没有修改时 changed 为假，调用者继续使用原来的页面；子树被删空时返回空的列表。
+func treeApply(tree *BTree, node BNode, muts []*batchMut) (kids []BNode, changed bool) {
+	switch node.bType() {
+	case BNodeLeaf:
+		return leafApply(tree, node, muts)
+	case BNodeNode:
+		return nodeApply(tree, node, muts)
+	default:
+		panic("bad node!")
+	}
+}
+
+// leafApply treeApply 的一部分，合并叶子中的键和修改
+func leafApply(tree *BTree, node BNode, muts []*batchMut) ([]BNode, bool) {
+	var entries []nodeEntry
+	changed := false
+	i, n := uint16(0), node.nKeys()
+	for _, m := range muts {
+		for ; i < n && node.compareKey(i, m.key) < 0; i++ {
+			entries = append(entries, leafEntry(node, i))
+		}
+		found := i < n && node.compareKey(i, m.key) == 0
+		if found && !m.del && leafValEqual(tree, node, i, m.val) {
+			continue // 值没有变化，保留原来的键
+		}
+		if found {
+			// 旧值的溢出页不再被引用
+			if node.isOverflow(i) {
+				overflowFree(tree, node.getVal(i))
+			}
+			i++
+			changed = true
+		}
+		if !m.del {
+			val, overflow := leafValue(&UpdateReq{tree: tree, Val: m.val})
+			entries = append(entries, nodeEntry{key: m.key, val: val, overflow: overflow})
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+	for ; i < n; i++ {
+		entries = append(entries, leafEntry(node, i))
+	}
+	if len(entries) == 0 {
+		return nil, true
+	}
+	return nodeBuildAll(tree, BNodeLeaf, entries), true
+}
+
+// leafEntry 返回叶子中的一个键值对
+func leafEntry(node BNode, idx uint16) nodeEntry {
+	return nodeEntry{key: node.getKey(idx), val: node.getVal(idx), overflow: node.isOverflow(idx)}
+}
+
+// batchKid nodeApply 中的一个孩子，node 不为空时是还没有分配页面的新结点
+type batchKid struct {
+	ptr  uint64
+	key  []byte
+	node BNode
+}
+
+// nodeApply treeApply 的一部分，将修改按孩子分组后递归，再合并太小的孩子
+func nodeApply(tree *BTree, node BNode, muts []*batchMut) ([]BNode, bool) {
+	var kids []batchKid
+	changed := false
+	for i := uint16(0); i < node.nKeys(); i++ {
+		ptr := node.getPtr(i)
+		// 这个孩子负责 [key_i, key_{i+1}) 范围内的键
+		n := len(muts)
+		if i+1 < node.nKeys() {
+			n = 0
+			for n < len(muts) && node.compareKey(i+1, muts[n].key) > 0 {
+				n++
+			}
+		}
+		group := muts[:n]
+		muts = muts[n:]
+		if len(group) > 0 {
+			split, ok := treeApply(tree, tree.get(ptr), group)
+			if ok {
+				tree.del(ptr)
+				for _, kid := range split {
+					kids = append(kids, batchKid{key: kid.getKey(0), node: kid})
+				}
+				changed = true
+				continue
+			}
+		}
+		kids = append(kids, batchKid{ptr: ptr, key: node.getKey(i)})
+	}
+	if !changed {
+		return nil, false
+	}
+	kids = mergeKids(tree, kids)
+	if len(kids) == 0 {
+		return nil, true
+	}
+	return nodeBuildAll(tree, BNodeNode, allocKids(tree, kids)), true
+}
+
+// mergeKids 将太小的新结点与相邻的孩子合并，与 shouldMerge 使用相同的条件
+func mergeKids(tree *BTree, kids []batchKid) []batchKid {
+	small := func(kid BNode) bool {
+		_, packed := nodeRangeBytes(kid, 0, kid.nKeys())
+		return packed <= tree.pageSize/4
+	}
+	for i := 0; i < len(kids) && len(kids) > 1; i++ {
+		if kids[i].node == nil || !small(kids[i].node) {
+			continue
+		}
+		l := max(i-1, 0) // 优先与左边合并
+		left, right := kidNode(tree, &kids[l]), kidNode(tree, &kids[l+1])
+		merged := BNode(make([]byte, left.unpackedBytes()+right.unpackedBytes()))
+		nodeMerge(merged, left, right)
+		var split []batchKid
+		for _, kid := range nodeSplit(tree, merged) {
+			split = append(split, batchKid{key: kid.getKey(0), node: kid})
+		}
+		kids = slices.Replace(kids, l, l+2, split...)
+		// 合并之后的结点可能仍然太小，从它开始继续检查
+		i = l - 1
+		if len(split) > 1 {
+			i = l + len(split) - 1
+		}
+	}
+	return kids
+}
+
+// kidNode 返回孩子的结点，已有的页面读取之后释放
+func kidNode(tree *BTree, kid *batchKid) BNode {
+	if kid.node == nil {
+		kid.node = tree.get(kid.ptr)
+		tree.del(kid.ptr)
+	}
+	return kid.node
+}
+
+// allocKids 分配新结点的页面，返回父结点中的键
+func allocKids(tree *BTree, kids []batchKid) []nodeEntry {
+	entries := make([]nodeEntry, len(kids))
+	for i, kid := range kids {
+		ptr := kid.ptr
+		if kid.node != nil {
+			ptr = tree.alloc(kid.node)
+		}
+		entries[i] = nodeEntry{key: kid.key, ptr: ptr}
+	}
+	return entries
+}
+
+// allocNodes 分配结点的页面，返回父结点中的键
+func allocNodes(tree *BTree, nodes []BNode) []nodeEntry {
+	kids := make([]batchKid, len(nodes))
+	for i, node := range nodes {
+		kids[i] = batchKid{key: node.getKey(0), node: node}
+	}
+	return allocKids(tree, kids)
+}
+
+// nodeBuildAll 将有序的键依次装入结点，每个结点都能放入一个页面
+// 最后一个结点太小时与前一个结点平分。
+func nodeBuildAll(tree *BTree, typ uint16, entries []nodeEntry) []BNode {
+	var nodes []BNode
+	start, size := 0, Header
+	for i := range entries {
+		e := &entries[i]
+		if i > start && !tree.sizeFits(tree.pageSize, size+e.size(), i+1-start, entries[start].key, e.key) {
+			nodes = append(nodes, nodeBuild(typ, entries[start:i]))
+			start, size = i, Header
+		}
+		size += e.size()
+	}
+	nodes = append(nodes, nodeBuild(typ, entries[start:]))
+	if n := len(nodes); n > 1 && size <= tree.pageSize/4 {
+		left, right := nodes[n-2], nodes[n-1]
+		merged := BNode(make([]byte, left.unpackedBytes()+right.unpackedBytes()))
+		nodeMerge(merged, left, right)
+		nodes = append(nodes[:n-2], nodeSplit(tree, merged)...)
+	}
+	return nodes
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// batchRef 按顺序将批量写入应用到参考数据，返回每个操作预期的结果
+func batchRef(ref map[string]string, batch *WriteBatch) []BatchOp {
+	var want []BatchOp
+	for _, op := range batch.Ops {
+		res := BatchOp{Op: op.Op, Key: op.Key, Val: op.Val, End: op.End}
+		switch op.Op {
+		case BatchPut:
+			old, ok := ref[string(op.Key)]
+			res.Added, res.Updated = !ok, !ok || old != string(op.Val)
+			ref[string(op.Key)] = string(op.Val)
+		case BatchDelete:
+			if _, ok := ref[string(op.Key)]; ok {
+				res.Updated, res.Deleted = true, 1
+			}
+			delete(ref, string(op.Key))
+		case BatchDeleteRange:
+			for k := range ref {
+				if string(op.Key) <= k && (len(op.End) == 0 || k < string(op.End)) {
+					delete(ref, k)
+					res.Deleted++
+				}
+			}
+			res.Updated = res.Deleted > 0
+		}
+		want = append(want, res)
+	}
+	return want
+}
+
+// write 批量写入并与参考数据比较结果
+func (d *D) write(t *testing.T, batch *WriteBatch) {
+	want := batchRef(d.ref, batch)
+	is.NoError(t, d.db.Write(batch))
+	is.Equal(t, want, batch.Ops)
+}
+
+func funcTestWriteBatch(t *testing.T, prefix bool) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, PrefixCompression: prefix}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	rng := rand.New(rand.NewSource(1))
+	key := func() []byte {
+		return []byte(fmt.Sprintf("key%05d", rng.Intn(5000)))
+	}
+	for round := 0; round < 100; round++ {
+		batch := &WriteBatch{}
+		for i := 0; i < 1+rng.Intn(500); i++ {
+			switch r := rng.Intn(100); {
+			case r < 60:
+				n := rng.Intn(200)
+				if r < 3 {
+					n = 2 * BTreePageSize // 溢出页
+				}
+				batch.Put(key(), []byte(bigVal(fmt.Sprint(round), n)))
+			case r < 95:
+				batch.Delete(key())
+			default:
+				start, end := key(), key()
+				batch.DeleteRange(start, end[:3+rng.Intn(5)])
+			}
+		}
+		c.write(t, batch)
+		c.verify(t)
+	}
+	c.reopen()
+	c.verify(t)
+
+	// 删除所有的键，之后重新插入
+	c.write(t, (&WriteBatch{}).DeleteRange(nil, nil).Put([]byte("a"), []byte("b")))
+	is.Equal(t, map[string]string{"a": "b"}, c.ref)
+	c.verify(t)
+	c.write(t, (&WriteBatch{}).DeleteRange([]byte("a"), []byte("b")))
+	c.verify(t)
+	c.write(t, (&WriteBatch{}).Put([]byte("x"), []byte("y")))
+	c.verify(t)
+}
+
+func TestWriteBatch(t *testing.T) {
+	funcTestWriteBatch(t, false)
+	funcTestWriteBatch(t, true)
+}
+
+func TestWriteBatchOrder(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k1", "v1")
+	c.add("k2", "v2")
+
+	// 同一个键的操作按顺序生效
+	batch := &WriteBatch{}
+	batch.Put([]byte("k3"), []byte("a")).Put([]byte("k3"), []byte("b"))
+	batch.Put([]byte("k1"), []byte("v1")).Delete([]byte("k2")).Put([]byte("k2"), []byte("c"))
+	batch.DeleteRange([]byte("k"), []byte("k3")).Put([]byte("k1"), []byte("d"))
+	batch.Delete([]byte("none"))
+	c.write(t, batch)
+	is.Equal(t, map[string]string{"k1": "d", "k3": "b"}, c.ref)
+	is.True(t, batch.Ops[0].Added)
+	is.False(t, batch.Ops[1].Added)
+	is.False(t, batch.Ops[2].Updated) // 值相同
+	is.Equal(t, 2, batch.Ops[5].Deleted)
+	c.verify(t)
+
+	// 没有修改时不写入文件
+	version := c.db.version
+	c.write(t, (&WriteBatch{}).Put([]byte("k1"), []byte("d")).Delete([]byte("none")))
+	c.write(t, &WriteBatch{})
+	is.Equal(t, version, c.db.version)
+
+	// 错误的参数不修改数据库
+	for _, batch := range []*WriteBatch{
+		(&WriteBatch{}).Put([]byte("a"), nil).Put(nil, nil),
+		(&WriteBatch{}).Delete([]byte(strings.Repeat("x", BTreeMaxKeySize+1))),
+		(&WriteBatch{}).Put([]byte("a"), make([]byte, MaxValSize+1)),
+		{Ops: []BatchOp{{Op: 99}}},
+	} {
+		is.Error(t, c.db.Write(batch))
+	}
+	is.Equal(t, ErrBadOp, c.db.Write(&WriteBatch{Ops: []BatchOp{{Op: 99}}}))
+	c.verify(t)
+}
+
+func TestWriteBatchPages(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("key%08d", fmix32(uint32(i))), "v")
+	}
+
+	// 相邻的键共享复制的路径
+	batch := &WriteBatch{}
+	for i := 0; i < 1000; i++ {
+		batch.Put([]byte(fmt.Sprintf("key%08d", fmix32(uint32(i)))), []byte("new"))
+	}
+	tx := c.db.Begin()
+	_, err := tx.Write(batch)
+	is.NoError(t, err)
+	batchPages := len(c.db.page.updates)
+	tx.Abort()
+
+	tx = c.db.Begin()
+	for _, op := range batch.Ops {
+		_, err = tx.Set(op.Key, op.Val)
+		is.NoError(t, err)
+	}
+	setPages := len(c.db.page.updates)
+	tx.Abort()
+	// 逐个 Set 时本事务复制的页面被释放之后直接复用，也不超过修改过的页面
+	is.True(t, batchPages <= setPages)
+	is.True(t, setPages < int(c.db.page.flushed))
+
+	c.write(t, batch)
+	c.verify(t)
+}
+
+func TestWriteBatchCorrupt(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	for i := 0; i < 2000; i++ {
+		c.add(fmt.Sprintf("key%04d", i), "v")
+	}
+
+	// 损坏最后一个叶子结点，范围删除的迭代器返回错误
+	tree := &c.db.tree
+	ptr := tree.root
+	for node := BNode(tree.get(ptr)); node.bType() == BNodeNode; node = tree.get(ptr) {
+		ptr = node.getPtr(node.nKeys() - 1)
+	}
+	corruptPage(t, c.store, ptr)
+	c.reopen()
+
+	tx := c.db.Begin()
+	_, err := tx.Write((&WriteBatch{}).Put([]byte("a"), []byte("b")).DeleteRange([]byte("key1"), nil))
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, err)
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, tx.Commit())
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, c.db.Write((&WriteBatch{}).DeleteRange(nil, nil)))
+	_, ok, err := c.db.Get([]byte("a"))
+	is.NoError(t, err)
+	is.False(t, ok)
+}
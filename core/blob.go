@@ -0,0 +1,217 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// blobWriter 将值分块写入溢出页，Close 时插入键
+// 溢出页追加到文件末尾，与键在同一个事务中提交，事务放弃时这些页面也随之丢弃。
+// 内存中积累的页面超过 bulkFlushPages 时提前写入文件，见 flushAppended。
+type blobWriter struct {
+	tx     *KVTX
+	commit bool // Close 时提交事务（KV.PutBlob）
+	key    []byte
+	err    error
+	size   uint64
+	head   uint64
+	node   ONode // 最后一个溢出页
+	closed bool
+}
+
+// PutBlob 返回写入 key 的值的 Writer，Close 时提交
+// 在 Close 之前一直占用写事务。
+func (db *KV) PutBlob(key []byte) io.WriteCloser {
+	w := db.Begin().PutBlob(key).(*blobWriter)
+	w.commit = true
+	return w
+}
+
+// PutBlob 返回写入 key 的值的 Writer，Close 时插入到事务中
+func (tx *KVTX) PutBlob(key []byte) io.WriteCloser {
+	w := &blobWriter{tx: tx, key: key, err: tx.err}
+	if w.err == nil {
+		w.err = tx.db.tree.checkKey(key)
+	}
+	return w
+}
+
+// Write 写入数据，页面写满时分配新的溢出页
+func (w *blobWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	defer func() { w.err = err }()
+	defer w.tx.fail(&err)
+	defer recoverCorrupt(&err)
+	for n < len(p) {
+		off := w.size % uint64(overflowCap(w.tx.db.tree.pageSize))
+		if off == 0 {
+			if err = w.grow(); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.node[OverflowHeader+off:], p[n:])
+		n += c
+		w.size += uint64(c)
+	}
+	return n, nil
+}
+
+// grow 追加一个新的溢出页并链接到最后一个页面之后
+// 之前的页面都已经写满，可以提前写入文件；新的页面写入之后重新读入内存继续修改。
+func (w *blobWriter) grow() error {
+	db := w.tx.db
+	node := newONode(db.tree.pageSize)
+	ptr := db.pageAppend(node)
+	if w.node == nil {
+		w.head = ptr
+	} else {
+		w.node.setNext(ptr)
+	}
+	w.node = node
+	if len(db.page.updates) >= bulkFlushPages {
+		if err := flushAppended(db); err != nil {
+			return err
+		}
+		w.node = db.pageWrite(ptr)
+	}
+	return nil
+}
+
+// Close 插入键，KV.PutBlob 返回的 Writer 同时提交事务
+func (w *blobWriter) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+	err := w.err
+	if err == nil {
+		ref := newOverflowRef(w.size, w.head)
+		_, err = w.tx.Update(&UpdateReq{Key: w.key, ref: ref})
+	}
+	if !w.commit {
+		return err
+	}
+	if err != nil {
+		w.tx.Abort()
+		return err
+	}
+	return w.tx.Commit()
+}
+
+// blobReader 按需读取溢出页，Close 之前固定读事务的快照
+type blobReader struct {
+	r        *KVReader
+	overflow bool
+	val      []byte // 不在溢出页中的值
+	size     int64
+	head     uint64
+	pos      int64
+	page     uint64 // 最近读取的页面
+	idx      int64  // 最近读取的页面的序号
+}
+
+// GetBlob 返回读取 key 的值的 Reader，键不存在时返回 ErrNotFound
+func (db *KV) GetBlob(key []byte) (io.ReadSeekCloser, error) {
+	r := db.BeginRead()
+	b, err := r.getBlob(key)
+	if err != nil {
+		r.EndRead()
+		return nil, err
+	}
+	return b, nil
+}
+
+// getBlob 查找 key，不读取溢出页
+func (r *KVReader) getBlob(key []byte) (b *blobReader, err error) {
+	if err = r.tree.checkKey(key); err != nil {
+		return nil, err
+	}
+	defer recoverCorrupt(&err)
+	node, idx, ok := treeLookup(&r.tree, key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	b = &blobReader{r: r, idx: -1}
+	if b.overflow = node.isOverflow(idx); b.overflow {
+		size, head := overflowRef(node.getVal(idx))
+		b.size, b.head = int64(size), head
+	} else {
+		b.val = node.getVal(idx)
+		b.size = int64(len(b.val))
+	}
+	return b, nil
+}
+
+// Read 从当前位置读取
+func (b *blobReader) Read(p []byte) (n int, err error) {
+	if b.r == nil {
+		return 0, fs.ErrClosed
+	}
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if !b.overflow {
+		n = copy(p, b.val[b.pos:])
+		b.pos += int64(n)
+		return n, nil
+	}
+	defer recoverCorrupt(&err)
+	cap := int64(overflowCap(b.r.tree.pageSize))
+	for n < len(p) && b.pos < b.size {
+		idx := b.pos / cap
+		node := b.seekPage(idx)
+		end := min(cap, b.size-idx*cap)
+		c := copy(p[n:], node[OverflowHeader+b.pos%cap:OverflowHeader+end])
+		n += c
+		b.pos += int64(c)
+	}
+	return n, nil
+}
+
+// seekPage 返回第 idx 个溢出页，向前移动时从头开始
+func (b *blobReader) seekPage(idx int64) ONode {
+	if b.idx < 0 || idx < b.idx {
+		b.page, b.idx = b.head, 0
+	}
+	for ; b.idx < idx; b.idx++ {
+		b.page = ONode(b.r.tree.get(b.page)).getNext()
+	}
+	return b.r.tree.get(b.page)
+}
+
+// Seek 设置下一次读取的位置
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	if b.r == nil {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("blob: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("blob: negative position")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+// Close 结束读事务
+func (b *blobReader) Close() error {
+	if b.r == nil {
+		return fs.ErrClosed
+	}
+	b.r.EndRead()
+	b.r = nil
+	return nil
+}
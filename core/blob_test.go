@@ -0,0 +1,164 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// putBlob 分多次写入 blob
+func putBlob(t *testing.T, w io.WriteCloser, data []byte) {
+	for i := 0; len(data) > 0; i++ {
+		n := min(len(data), 1+int(fmix32(uint32(i))%(3*BTreePageSize)))
+		m, err := w.Write(data[:n])
+		is.NoError(t, err)
+		is.Equal(t, n, m)
+		data = data[n:]
+	}
+	is.NoError(t, w.Close())
+}
+
+func TestBlob(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k", "v")
+
+	data := []byte(bigVal("blob data ", 3<<20))
+	putBlob(t, c.db.PutBlob([]byte("blob")), data)
+	c.ref["blob"] = string(data)
+	c.verify(t)
+
+	b, err := c.db.GetBlob([]byte("blob"))
+	is.NoError(t, err)
+	got, err := io.ReadAll(b)
+	is.NoError(t, err)
+	is.True(t, bytes.Equal(data, got))
+
+	// 随机访问
+	buf := make([]byte, 100)
+	for _, off := range []int64{0, OverflowCap - 50, 5 * OverflowCap, 10, int64(len(data)) - 100} {
+		pos, err := b.Seek(off, io.SeekStart)
+		is.NoError(t, err)
+		is.Equal(t, off, pos)
+		_, err = io.ReadFull(b, buf)
+		is.NoError(t, err)
+		is.Equal(t, data[off:off+100], buf)
+	}
+	pos, err := b.Seek(-10, io.SeekEnd)
+	is.NoError(t, err)
+	is.Equal(t, int64(len(data)-10), pos)
+	got, err = io.ReadAll(b)
+	is.NoError(t, err)
+	is.Equal(t, data[len(data)-10:], got)
+	_, err = b.Read(buf)
+	is.Equal(t, io.EOF, err)
+	_, err = b.Seek(-1, io.SeekStart)
+	is.Error(t, err)
+
+	// 覆盖和删除时释放旧的页面，读者仍然看到旧的值
+	putBlob(t, c.db.PutBlob([]byte("blob")), []byte("small"))
+	c.ref["blob"] = "small"
+	c.verify(t)
+	_, err = b.Seek(0, io.SeekStart)
+	is.NoError(t, err)
+	got, err = io.ReadAll(b)
+	is.NoError(t, err)
+	is.True(t, bytes.Equal(data, got))
+	is.NoError(t, b.Close())
+	_, err = b.Read(buf)
+	is.Equal(t, fs.ErrClosed, err)
+
+	// 普通的值也可以作为 blob 读取
+	b, err = c.db.GetBlob([]byte("k"))
+	is.NoError(t, err)
+	got, err = io.ReadAll(b)
+	is.NoError(t, err)
+	is.Equal(t, "v", string(got))
+	is.NoError(t, b.Close())
+	val, ok, err := c.db.Get([]byte("blob"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, "small", string(val))
+
+	c.del("blob")
+	c.verify(t)
+	_, err = c.db.GetBlob([]byte("blob"))
+	is.Equal(t, ErrNotFound, err)
+
+	// 空的 blob
+	putBlob(t, c.db.PutBlob([]byte("empty")), nil)
+	c.ref["empty"] = ""
+	c.reopen()
+	c.verify(t)
+}
+
+func TestBlobTX(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k", "v")
+
+	// 放弃事务时 blob 的页面也被丢弃
+	tx := c.db.Begin()
+	w := tx.PutBlob([]byte("blob"))
+	putBlob(t, w, []byte(bigVal("x", 5*BTreePageSize)))
+	_, err := w.Write([]byte("x"))
+	is.Equal(t, fs.ErrClosed, err)
+	_, ok, err := tx.Get([]byte("blob"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	tx.Abort()
+	c.verify(t)
+
+	// 与其他修改一起提交
+	tx = c.db.Begin()
+	data := bigVal("y", 5*BTreePageSize)
+	putBlob(t, tx.PutBlob([]byte("blob")), []byte(data))
+	_, err = tx.Del([]byte("k"))
+	is.NoError(t, err)
+	is.NoError(t, tx.Commit())
+	delete(c.ref, "k")
+	c.ref["blob"] = data
+	c.verify(t)
+
+	// 错误的键在 Close 时放弃事务
+	w = c.db.PutBlob(nil)
+	_, err = w.Write([]byte("x"))
+	is.Equal(t, ErrEmptyKey, err)
+	is.Equal(t, ErrEmptyKey, w.Close())
+	c.add("k2", "v2")
+	c.verify(t)
+}
+
+func TestBlobLarge(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k", "v")
+
+	// 内存中的页面数不超过 bulkFlushPages，写满的溢出页提前写入文件
+	data := []byte(bigVal("large blob ", 4*bulkFlushPages*OverflowCap+100))
+	tx := c.db.Begin()
+	w := tx.PutBlob([]byte("blob"))
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 64<<10)
+		_, err := w.Write(rest[:n])
+		is.NoError(t, err)
+		is.True(t, len(c.db.page.updates) <= bulkFlushPages, len(c.db.page.updates))
+		rest = rest[n:]
+	}
+	is.NoError(t, w.Close())
+	is.True(t, c.db.page.nAppend > 4*bulkFlushPages)
+	is.NoError(t, tx.Commit())
+	c.ref["blob"] = string(data)
+	c.reopen()
+	c.verify(t)
+
+	b, err := c.db.GetBlob([]byte("blob"))
+	is.NoError(t, err)
+	got, err := io.ReadAll(b)
+	is.NoError(t, err)
+	is.True(t, bytes.Equal(data, got))
+	is.NoError(t, b.Close())
+}
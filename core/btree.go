@@ -1,14 +1,16 @@
 package core
 
 import (
-	"bytes"
-
 	"db-practice/util"
 )
 
 type BTree struct {
 	// pointer（非零页码）
 	root uint64
+	// 页面大小
+	pageSize int
+	// 新的结点只存储一次键的公共前缀
+	prefix bool
 	// 用于管理磁盘上页面的回调
 	get func(uint64) []byte // 解引用指针
 	new func([]byte) uint64 // 分配新页面
@@ -31,113 +33,159 @@ type UpdateReq struct {
 	Key  []byte
 	Val  []byte
 	Mode int
+
+	ref []byte // 值已经写入溢出页，只插入引用（见 PutBlob）
 }
 
 // treeInsert 将一个KV插入节中，结果可能会分裂成两个节点。
 // 调用者负责释放输入节点的内存并拆分和分配结果节点。
 func treeInsert(req *UpdateReq, node BNode) BNode {
-
-	// 允许超过1页 如果超过将会被分开
-	newNode := BNode(make([]byte, 2*BTreePageSize))
+	tree := req.tree
 	idx := nodeLookupLE(node, req.Key)
 
 	switch node.bType() {
 	case BNodeLeaf:
-		if bytes.Equal(req.Key, node.getKey(idx)) {
+		// 允许超过1页 如果超过将会被分开
+		newNode := BNode(make([]byte, node.unpackedBytes()+tree.pageSize))
+		if node.compareKey(idx, req.Key) == 0 {
 			if req.Mode == ModeInsertOnly {
 				return BNode{}
 			}
-			if bytes.Equal(req.Val, node.getVal(idx)) {
+			if req.ref == nil && leafValEqual(req.tree, node, idx, req.Val) {
 				return BNode{}
 			}
-			leafUpdate(newNode, node, idx, req.Key, req.Val)
+			// 旧值的溢出页不再被引用
+			if node.isOverflow(idx) {
+				overflowFree(req.tree, node.getVal(idx))
+			}
+			val, overflow := leafValue(req)
+			leafUpdate(newNode, node, idx, req.Key, val)
+			if overflow {
+				newNode.setOverflow(idx)
+			}
 			req.Updated = true
 		} else {
 			if req.Mode == ModeUpdateOnly {
 				return BNode{}
 			}
-			leafInsert(newNode, node, idx+1, req.Key, req.Val)
+			val, overflow := leafValue(req)
+			leafInsert(newNode, node, idx+1, req.Key, val)
+			if overflow {
+				newNode.setOverflow(idx + 1)
+			}
 			req.Updated = true
 			req.Added = true
 		}
+		return newNode
 	case BNodeNode:
 		// 内部节点，将其插入到子节点。
 		// 获取并释放子节点
 		kPtr := node.getPtr(idx)
-		kNode := req.tree.get(kPtr)
+		kNode := tree.get(kPtr)
 		// 递归插入到子节点
 		kNode = treeInsert(req, kNode)
 		if len(kNode) == 0 {
 			return BNode{}
 		}
-		req.tree.del(kPtr)
+		tree.del(kPtr)
 		// 拆分结果
-		nSplit, split := nodeSplit3(kNode)
+		split := nodeSplit(tree, kNode)
 		// 更新子结点链接
-		nodeReplaceKidN(req.tree, newNode, node, idx, split[:nSplit]...)
+		newNode := BNode(make([]byte, node.unpackedBytes()+len(split)*tree.pageSize))
+		nodeReplaceKidN(tree, newNode, node, idx, split...)
+		return newNode
 	default:
 		panic("bad node!")
 	}
-	return newNode
+}
+
+// rangeFits 判断 old 中 [start, start+n) 范围内的键能否放入一个页面
+// 压缩的结点还原之后不超过 2 个页面，修改时的临时结点不会超出 uint16 的偏移量。
+func (tree *BTree) rangeFits(old BNode, start, n uint16) bool {
+	raw, packed := nodeRangeBytes(old, start, n)
+	if raw <= tree.pageSize {
+		return true
+	}
+	return tree.prefix && packed <= tree.pageSize && raw <= 2*tree.pageSize
+}
+
+// sizeFits 判断 n 个键、不压缩时大小为 raw 的结点能否不超过 limit
+// first 和 last 是第一个和最后一个键，它们的公共前缀就是所有键的公共前缀。
+func (tree *BTree) sizeFits(limit, raw, n int, first, last []byte) bool {
+	if raw <= limit {
+		return true
+	}
+	if !tree.prefix || raw > 2*tree.pageSize {
+		return false
+	}
+	pLen := 0
+	for pLen < len(first) && pLen < len(last) && first[pLen] == last[pLen] {
+		pLen++
+	}
+	return raw-n*pLen+prefixLenSize+pLen <= limit
 }
 
 // nodeSplit2 将大于允许的节点拆分为2个节点，第2个节点始终适合页面。
-func nodeSplit2(left, right, old BNode) {
+func nodeSplit2(tree *BTree, old BNode) (BNode, BNode) {
 	util.Assert(old.nKeys() >= 2)
 
 	// 最初的猜测
 	nLeft := old.nKeys() / 2
 
 	// 尝试适配左半部分
-	leftBytes := func() uint16 {
-		return Header + PointerSize*nLeft + offsetSize*nLeft + old.getOffset(nLeft)
-	}
-	for leftBytes() > BTreePageSize {
+	for !tree.rangeFits(old, 0, nLeft) {
 		nLeft--
 	}
 	util.Assert(nLeft >= 1)
 
 	// 尝试适配右半部分
-	rightBytes := func() uint16 {
-		return old.nBytes() - leftBytes() + Header
-	}
-	for rightBytes() > BTreePageSize {
+	for !tree.rangeFits(old, nLeft, old.nKeys()-nLeft) {
 		nLeft++
 	}
 	util.Assert(nLeft < old.nKeys())
 	nRight := old.nKeys() - nLeft
 
+	leftBytes, _ := nodeRangeBytes(old, 0, nLeft)
+	rightBytes, _ := nodeRangeBytes(old, nLeft, nRight)
+	left := BNode(make([]byte, max(leftBytes, tree.pageSize)))
+	right := BNode(make([]byte, max(rightBytes, tree.pageSize)))
 	left.setHeader(old.bType(), nLeft)
 	right.setHeader(old.bType(), nRight)
 	nodeAppendRange(left, old, 0, 0, nLeft)
 	nodeAppendRange(right, old, 0, nLeft, nRight)
-
-	util.Assert(right.nBytes() <= BTreePageSize)
+	return left, right
 }
 
-// nodeSplit3 如果节点太大，则拆分节点。结果可能是 1~3 个节点。
-// 最坏情况下 有个一个大KV在中间
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	util.Assert(old.nBytes() <= 3*BTreePageSize+2*Header)
-	if old.nBytes() <= BTreePageSize {
-		old = old[:BTreePageSize]
-		return 1, [3]BNode{old}
-	}
-	// 以后可能会拆分
-	left := BNode(make([]byte, 2*BTreePageSize))
-	right := BNode(make([]byte, BTreePageSize))
-	nodeSplit2(left, right, old)
-	if left.nBytes() <= BTreePageSize {
-		left = left[:BTreePageSize]
-		return 2, [3]BNode{left, right}
+// nodeSplit 如果节点太大，则拆分节点。
+// 不压缩时结果是 1~3 个节点（最坏情况下有一个大KV在中间），
+// 压缩时公共前缀变短的结点可能需要更多的页面。
+func nodeSplit(tree *BTree, old BNode) []BNode {
+	if old.nKeys() == 0 || tree.rangeFits(old, 0, old.nKeys()) {
+		return []BNode{old}
 	}
-	// 左侧节点仍然太大
-	leftOfLeft := BNode(make([]byte, BTreePageSize))
-	middle := BNode(make([]byte, BTreePageSize))
-	nodeSplit2(leftOfLeft, middle, left)
-	util.Assert(leftOfLeft.nBytes() <= BTreePageSize)
+	// 左侧节点可能仍然太大
+	left, right := nodeSplit2(tree, old)
+	return append(nodeSplit(tree, left), right)
+}
+
+// alloc 分配结点的页面，开启前缀压缩时压缩之后再写入
+func (tree *BTree) alloc(node BNode) uint64 {
+	return tree.new(nodePack(node, tree.pageSize, tree.prefix))
+}
 
-	return 3, [3]BNode{leftOfLeft, middle, right}
+// allocRoot 分配新的根，根太大时分裂并添加新级别
+func (tree *BTree) allocRoot(node BNode) {
+	split := nodeSplit(tree, node)
+	for len(split) > 1 {
+		root := BNode(make([]byte, len(split)*tree.pageSize))
+		root.setHeader(BNodeNode, uint16(len(split)))
+		for i, kNode := range split {
+			ptr, key := tree.alloc(kNode), kNode.getKey(0)
+			nodeAppendKV(root, uint16(i), ptr, key, nil)
+		}
+		split = nodeSplit(tree, root)
+	}
+	tree.root = tree.alloc(split[0])
 }
 
 // nodeReplaceKidN 将节点中idx节点替换为多个子节点。
@@ -145,7 +193,7 @@ func nodeReplaceKidN(tree *BTree, dstNode, srcNode BNode, idx uint16, kids ...BN
 	dstNode.setHeader(BNodeNode, srcNode.nKeys()+uint16(len(kids))-1)
 	nodeAppendRange(dstNode, srcNode, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(dstNode, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		nodeAppendKV(dstNode, idx+uint16(i), tree.alloc(node), node.getKey(0), nil)
 	}
 	nodeAppendRange(dstNode, srcNode, idx+uint16(len(kids)), idx+1, srcNode.nKeys()-(idx+1))
 }
@@ -156,11 +204,14 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	// 根据节点类型执行操作
 	switch node.bType() {
 	case BNodeLeaf:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if node.compareKey(idx, key) != 0 {
 			return BNode{}
 		}
+		if node.isOverflow(idx) {
+			overflowFree(tree, node.getVal(idx))
+		}
 		// 删除叶子结点中的键
-		newNode := BNode(make([]byte, BTreePageSize))
+		newNode := BNode(make([]byte, node.unpackedBytes()))
 		leafDelete(newNode, node, idx)
 		return newNode
 	case BNodeNode:
@@ -171,6 +222,7 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 }
 
 // nodeDelete treeDelete()的一部分
+// 替换的键可能更长（或者公共前缀变短），结果可能超过 1 页，由调用者拆分。
 func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	// 递归到那个孩子
 	kPtr := node.getPtr(idx)
@@ -179,33 +231,34 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		return BNode{}
 	}
 	tree.del(kPtr)
-	newNode := BNode(make([]byte, BTreePageSize))
 	// 检查合并
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	mergeDir, merged := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode(make([]byte, BTreePageSize))
-		nodeMerge(merged, sibling, updated)
+		newNode := BNode(make([]byte, node.unpackedBytes()+tree.pageSize))
 		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(newNode, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(newNode, node, idx-1, tree.alloc(merged), merged.getKey(0))
+		return newNode
 	case mergeDir > 0: // right
-		merged := BNode(make([]byte, BTreePageSize))
-		nodeMerge(merged, updated, sibling)
+		newNode := BNode(make([]byte, node.unpackedBytes()+tree.pageSize))
 		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(newNode, node, idx, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(newNode, node, idx, tree.alloc(merged), merged.getKey(0))
+		return newNode
+	case updated.nKeys() == 0:
+		// kid 在删除后为空，并且没有要合并的兄弟姐妹。
+		// 当它的父母只有一个孩子时，就会发生这种情况。
+		// 丢弃空 kid 并将 parent 作为空节点返回。
+		util.Assert(node.nKeys() == 1 && idx == 0)
+		newNode := BNode(make([]byte, Header))
+		newNode.setHeader(BNodeNode, 0)
+		// 空节点将在到达 root 之前被消除。
+		return newNode
 	default:
-		if updated.nKeys() == 0 {
-			// kid 在删除后为空，并且没有要合并的兄弟姐妹。
-			// 当它的父母只有一个孩子时，就会发生这种情况。
-			// 丢弃空 kid 并将 parent 作为空节点返回。
-			util.Assert(node.nKeys() == 1 && idx == 0)
-			newNode.setHeader(BNodeNode, 0)
-			// 空节点将在到达 root 之前被消除。
-		} else {
-			nodeReplaceKidN(tree, newNode, node, idx, updated)
-		}
+		split := nodeSplit(tree, updated)
+		newNode := BNode(make([]byte, node.unpackedBytes()+len(split)*tree.pageSize))
+		nodeReplaceKidN(tree, newNode, node, idx, split...)
+		return newNode
 	}
-	return newNode
 }
 
 // nodeReplace2Kid 将2个相邻key替换为1个
@@ -216,118 +269,132 @@ func nodeReplace2Kid(dstNode BNode, srcNode BNode, idx uint16, ptr uint64, key [
 	nodeAppendRange(dstNode, srcNode, idx+1, idx+2, srcNode.nKeys()-(idx+2))
 }
 
-// shouldMerge 判断更新后的孩子是否应该与兄弟姐妹合并
+// shouldMerge 判断更新后的孩子是否应该与兄弟姐妹合并，返回合并后的结点
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nBytes() > BTreePageSize/4 {
-		return 0, BNode{}
+	if updated.nKeys() > 0 {
+		if _, packed := nodeRangeBytes(updated, 0, updated.nKeys()); packed > tree.pageSize/4 {
+			return 0, BNode{}
+		}
 	}
-	merge := func(idx uint16) (BNode, bool) {
-		sibling := BNode(tree.get(node.getPtr(idx)))
-		ok := sibling.nBytes()+updated.nBytes()-Header <= BTreePageSize
-		return sibling, ok
+	merge := func(left, right BNode) (BNode, bool) {
+		merged := BNode(make([]byte, left.unpackedBytes()+right.unpackedBytes()))
+		nodeMerge(merged, left, right)
+		return merged, tree.rangeFits(merged, 0, merged.nKeys())
 	}
 	if idx > 0 {
-		if sibling, ok := merge(idx - 1); ok {
-			return -1, sibling
+		sibling := BNode(tree.get(node.getPtr(idx - 1)))
+		if merged, ok := merge(sibling, updated); ok {
+			return -1, merged
 		}
 	}
 	if idx+1 < node.nKeys() {
-		if sibling, ok := merge(idx + 1); ok {
-			return 1, sibling
+		sibling := BNode(tree.get(node.getPtr(idx + 1)))
+		if merged, ok := merge(updated, sibling); ok {
+			return 1, merged
 		}
 	}
 	return 0, BNode{}
 }
 
-// nodeGetKey tree.Get()的一部分
-func nodeGetKey(tree *BTree, node BNode, key []byte) ([]byte, bool) {
-	idx := nodeLookupLE(node, key)
-	switch node.bType() {
-	case BNodeLeaf:
-		if bytes.Equal(key, node.getKey(idx)) {
-			return node.getVal(idx), true
-		} else {
-			return nil, false
-		}
-	case BNodeNode:
-		return nodeGetKey(tree, tree.get(node.getPtr(idx)), key)
-	default:
+// treeLookup 返回可能包含 key 的叶子结点和位置
+func treeLookup(tree *BTree, key []byte) (BNode, uint16, bool) {
+	if tree.root == 0 {
+		return nil, 0, false
+	}
+	node := BNode(tree.get(tree.root))
+	for node.bType() == BNodeNode {
+		node = tree.get(node.getPtr(nodeLookupLE(node, key)))
+	}
+	if node.bType() != BNodeLeaf {
 		panic("bad node!")
 	}
+	idx := nodeLookupLE(node, key)
+	return node, idx, node.compareKey(idx, key) == 0
 }
 
 // Get 从树中获取值
 func (tree *BTree) Get(key []byte) ([]byte, bool) {
-	if tree.root == 0 {
+	node, idx, ok := treeLookup(tree, key)
+	if !ok {
 		return nil, false
 	}
-	return nodeGetKey(tree, tree.get(tree.root), key)
+	return leafGetVal(tree, node, idx), true
+}
+
+// checkKey 检查键的长度
+func (tree *BTree) checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > maxKeySize(tree.pageSize) {
+		return ErrKeyTooLarge
+	}
+	return nil
 }
 
 // Delete 从树中删除键
-func (tree *BTree) Delete(key []byte) bool {
-	util.Assert(len(key) != 0)
-	util.Assert(len(key) <= BTreeMaxKeySize)
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := tree.checkKey(key); err != nil {
+		return false, err
+	}
 	if tree.root == 0 {
-		return false
+		return false, nil
 	}
 	updated := treeDelete(tree, tree.get(tree.root), key)
 	if len(updated) == 0 {
-		return false // not found
+		return false, nil // not found
 	}
 	tree.del(tree.root)
 	if updated.bType() == BNodeNode && updated.nKeys() == 1 {
 		// remove a level
 		tree.root = updated.getPtr(0)
 	} else {
-		tree.root = tree.new(updated)
+		tree.allocRoot(updated)
 	}
-	return true
+	return true, nil
 }
 
 // Update 更新树中的键值对
-func (tree *BTree) Update(req *UpdateReq) bool {
-	util.Assert(len(req.Key) != 0)
-	util.Assert(len(req.Key) <= BTreeMaxKeySize)
-	util.Assert(len(req.Val) <= BTreeMaxValSize)
+func (tree *BTree) Update(req *UpdateReq) (bool, error) {
+	if err := tree.checkKey(req.Key); err != nil {
+		return false, err
+	}
+	if req.ref == nil && len(req.Val) > MaxValSize {
+		return false, ErrValueTooLarge
+	}
+	// 已经写入的溢出页必须被引用
+	util.Assert(req.ref == nil || req.Mode == ModeUpsert)
 
+	req.tree = tree
 	if tree.root == 0 {
 		// 创建第一个节点
-		root := BNode(make([]byte, BTreePageSize))
+		root := BNode(make([]byte, tree.pageSize))
 		root.setHeader(BNodeLeaf, 2)
 		// 一个虚拟键，这使得树覆盖整个键空间。
 		// 因此，查找总是可以找到包含的节点。
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, req.Key, req.Val)
-		tree.root = tree.new(root)
+		val, overflow := leafValue(req)
+		nodeAppendKV(root, 1, 0, req.Key, val)
+		if overflow {
+			root.setOverflow(1)
+		}
+		tree.root = tree.alloc(root)
 		req.Added = true
 		req.Updated = true
-		return true
+		return true, nil
 	}
 
-	req.tree = tree
 	updated := treeInsert(req, tree.get(tree.root))
 	if len(updated) == 0 {
-		return false
+		return false, nil
 	}
-	nSplit, split := nodeSplit3(updated)
 	tree.del(tree.root)
-	if nSplit > 1 {
-		// 根被分割，添加新级别。
-		root := BNode(make([]byte, BTreePageSize))
-		root.setHeader(BNodeNode, nSplit)
-		for i, kNode := range split[:nSplit] {
-			ptr, key := tree.new(kNode), kNode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
-		}
-		tree.root = tree.new(root)
-	} else {
-		tree.root = tree.new(split[0])
-	}
-	return true
+	// 根被分割时添加新级别
+	tree.allocRoot(updated)
+	return true, nil
 }
 
 // Upsert 更新或插入键值对
-func (tree *BTree) Upsert(key []byte, val []byte) bool {
+func (tree *BTree) Upsert(key []byte, val []byte) (bool, error) {
 	return tree.Update(&UpdateReq{Key: key, Val: val})
 }
@@ -11,6 +11,24 @@ type BIter struct {
 	tree *BTree
 	path []BNode  // 从根到叶
 	pos  []uint16 // 结点的位置
+	err  error    // 参数错误或读取到损坏的页面
+}
+
+// Err 返回迭代中遇到的错误，出错后迭代器不再有效
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// fail 将读取损坏页面时的 panic 转换为迭代器的错误
+func (iter *BIter) fail() {
+	if r := recover(); r != nil {
+		e, ok := r.(ErrCorruptPage)
+		if !ok {
+			panic(r)
+		}
+		iter.err = e
+		iter.path, iter.pos = nil, nil
+	}
 }
 
 // iterIsFirst 判断迭代器是否指向第一个键
@@ -36,12 +54,21 @@ func (iter *BIter) Valid() bool {
 }
 
 // Deref 当前 KV 对的值
-func (iter *BIter) Deref() ([]byte, []byte) {
+// 读取溢出页时遇到损坏的页面返回 nil，错误见 Err
+func (iter *BIter) Deref() (key []byte, val []byte) {
 	util.Assert(iter.Valid())
+	defer iter.fail()
 	last := len(iter.path) - 1
 	node := iter.path[last]
 	pos := iter.pos[last]
-	return node.getKey(pos), node.getVal(pos)
+	return node.getKey(pos), leafGetVal(iter.tree, node, pos)
+}
+
+// Key 当前 KV 对的键，不读取溢出页
+func (iter *BIter) Key() []byte {
+	util.Assert(iter.Valid())
+	last := len(iter.path) - 1
+	return iter.path[last].getKey(iter.pos[last])
 }
 
 // iterNext 移动到下一个键
@@ -50,6 +77,9 @@ func iterNext(iter *BIter, level int) {
 		iter.pos[level]++ // 在此节点内移动
 	} else if level > 0 {
 		iterNext(iter, level-1) // 移动到同级节点
+		if iterIsEnd(iter) {
+			return // 已经越过最后一个键，不再更新子节点
+		}
 	} else {
 		leaf := len(iter.pos) - 1
 		iter.pos[leaf]++
@@ -83,6 +113,7 @@ func iterPrev(iter *BIter, level int) {
 
 // Prev 移动到上一个键
 func (iter *BIter) Prev() {
+	defer iter.fail()
 	if !iterIsFirst(iter) {
 		iterPrev(iter, len(iter.path)-1)
 	}
@@ -90,14 +121,16 @@ func (iter *BIter) Prev() {
 
 // Next 移动到下一个键
 func (iter *BIter) Next() {
+	defer iter.fail()
 	if !iterIsEnd(iter) {
 		iterNext(iter, len(iter.path)-1)
 	}
 }
 
 // SeekLE 找到小于或等于 input 键的最近位置
-func (tree *BTree) SeekLE(key []byte) *BIter {
-	iter := &BIter{tree: tree}
+func (tree *BTree) SeekLE(key []byte) (iter *BIter) {
+	iter = &BIter{tree: tree}
+	defer iter.fail()
 	for ptr := tree.root; ptr != 0; {
 		node := BNode(tree.get(ptr))
 		idx := nodeLookupLE(node, key)
@@ -134,12 +167,18 @@ func cmpOK(key []byte, cmp int, ref []byte) bool {
 
 // Seek 找到关于 'cmp' 关系的离键最近的位置
 func (tree *BTree) Seek(key []byte, cmp int) *BIter {
+	if !(cmp == CmpGe || cmp == CmpGt || cmp == CmpLt || cmp == CmpLe) {
+		return &BIter{tree: tree, err: ErrBadCmp}
+	}
 	iter := tree.SeekLE(key)
+	if iter.err != nil {
+		return iter
+	}
 	util.Assert(iterIsFirst(iter) || !iterIsEnd(iter))
 	if cmp != CmpLe {
 		cur := []byte(nil) // 哨兵 key
 		if !iterIsFirst(iter) {
-			cur, _ = iter.Deref()
+			cur = iter.Key()
 		}
 		if len(key) == 0 || !cmpOK(cur, cmp, key) {
 			// off by one
@@ -151,7 +190,7 @@ func (tree *BTree) Seek(key []byte, cmp int) *BIter {
 		}
 	}
 	if iter.Valid() {
-		cur, _ := iter.Deref()
+		cur := iter.Key()
 		util.Assert(cmpOK(cur, cmp, key))
 	}
 	return iter
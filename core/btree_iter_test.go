@@ -14,7 +14,7 @@ func TestBTreeIter(t *testing.T) {
 		is.False(t, iter.Valid())
 	}
 
-	sizes := []int{5, 2500}
+	sizes := []int{5, 2500, heavy(60000, 5000)} // 60000 个键时树有 3 层
 	for _, sz := range sizes {
 		c := newC()
 
@@ -2,8 +2,10 @@ package core
 
 import (
 	"fmt"
+	"maps"
 	"math/rand"
 	"sort"
+	"strings"
 	"testing"
 	"unsafe"
 
@@ -24,6 +26,7 @@ func newC() *C {
 	pages := map[uint64]BNode{}
 	return &C{
 		tree: BTree{
+			pageSize: BTreePageSize,
 			get: func(ptr uint64) []byte {
 				node, ok := pages[ptr]
 				util.Assert(ok)
@@ -48,14 +51,17 @@ func newC() *C {
 
 // add 添加键值对
 func (c *C) add(key string, val string) {
-	c.tree.Upsert([]byte(key), []byte(val))
+	_, err := c.tree.Upsert([]byte(key), []byte(val))
+	util.Assert(err == nil)
 	c.ref[key] = val
 }
 
 // del 删除键值对
 func (c *C) del(key string) bool {
 	delete(c.ref, key)
-	return c.tree.Delete([]byte(key))
+	deleted, err := c.tree.Delete([]byte(key))
+	util.Assert(err == nil)
+	return deleted
 }
 
 // dump 遍历树，返回所有键值对
@@ -70,7 +76,7 @@ func dump(tree *BTree) ([]string, []string) {
 		if node.bType() == BNodeLeaf {
 			for i := uint16(0); i < nKeys; i++ {
 				keys = append(keys, string(node.getKey(i)))
-				vals = append(vals, string(node.getVal(i)))
+				vals = append(vals, string(leafGetVal(tree, node, i)))
 			}
 		} else {
 			for i := uint16(0); i < nKeys; i++ {
@@ -161,31 +167,42 @@ func fmix32(h uint32) uint32 {
 	return h
 }
 
-func commonTestBasic(t *testing.T, hasher func(uint32) uint32) {
+// heavy 返回测试的规模，使用 -short 或者 -race 时返回较小的 small
+// race detector 使测试慢 10 倍左右，完整的规模会超过 go test 默认的 10 分钟。
+func heavy(n, small int) int {
+	if testing.Short() || raceEnabled {
+		return small
+	}
+	return n
+}
+
+func commonTestBasic(t *testing.T, hasher func(uint32) uint32, prefix bool) {
+	total, checked := heavy(250000, 10000), heavy(2000, 500)
 	c := newC()
+	c.tree.prefix = prefix
 	c.add("k", "v")
 	c.verify(t)
 
 	// insert
-	for i := 0; i < 250000; i++ {
+	for i := 0; i < total; i++ {
 		key := fmt.Sprintf("key%d", hasher(uint32(i)))
 		val := fmt.Sprintf("vvv%d", hasher(uint32(-i)))
 		c.add(key, val)
-		if i < 2000 {
+		if i < checked {
 			c.verify(t)
 		}
 	}
 	c.verify(t)
 
 	// del
-	for i := 2000; i < 250000; i++ {
+	for i := checked; i < total; i++ {
 		key := fmt.Sprintf("key%d", hasher(uint32(i)))
 		is.True(t, c.del(key))
 	}
 	c.verify(t)
 
 	// overwrite
-	for i := 0; i < 2000; i++ {
+	for i := 0; i < checked; i++ {
 		key := fmt.Sprintf("key%d", hasher(uint32(i)))
 		val := fmt.Sprintf("vvv%d", hasher(uint32(+i)))
 		c.add(key, val)
@@ -194,7 +211,7 @@ func commonTestBasic(t *testing.T, hasher func(uint32) uint32) {
 
 	is.False(t, c.del("kk"))
 
-	for i := 0; i < 2000; i++ {
+	for i := 0; i < checked; i++ {
 		key := fmt.Sprintf("key%d", hasher(uint32(i)))
 		is.True(t, c.del(key))
 		c.verify(t)
@@ -211,20 +228,24 @@ func commonTestBasic(t *testing.T, hasher func(uint32) uint32) {
 }
 
 func TestBTreeBasicAscending(t *testing.T) {
-	commonTestBasic(t, func(h uint32) uint32 { return +h })
+	commonTestBasic(t, func(h uint32) uint32 { return +h }, false)
 }
 
 func TestBTreeBasicDescending(t *testing.T) {
-	commonTestBasic(t, func(h uint32) uint32 { return -h })
+	commonTestBasic(t, func(h uint32) uint32 { return -h }, false)
 }
 
 func TestBTreeBasicRand(t *testing.T) {
-	commonTestBasic(t, fmix32)
+	commonTestBasic(t, fmix32, false)
+}
+
+func TestBTreeBasicPrefix(t *testing.T) {
+	commonTestBasic(t, fmix32, true)
 }
 
 func TestBTreeRandLength(t *testing.T) {
 	c := newC()
-	for i := 0; i < 2000; i++ {
+	for i := 0; i < heavy(2000, 500); i++ {
 		kLen := fmix32(uint32(2*i+0)) % BTreeMaxKeySize
 		vLen := fmix32(uint32(2*i+1)) % BTreeMaxValSize
 		if kLen == 0 {
@@ -243,7 +264,7 @@ func TestBTreeRandLength(t *testing.T) {
 }
 
 func TestBTreeIncLength(t *testing.T) {
-	for l := 1; l < BTreeMaxKeySize+BTreeMaxValSize; l++ {
+	for l := 1; l < BTreeMaxKeySize+BTreeMaxValSize; l += heavy(1, 16) {
 		c := newC()
 
 		kLen := l
@@ -272,6 +293,81 @@ func TestBTreeIncLength(t *testing.T) {
 	}
 }
 
+func TestBTreePrefix(t *testing.T) {
+	// 表的键都以相同的前缀开始
+	key := func(i int) string {
+		return fmt.Sprintf("\x00\x00\x00\x65table row %010d", fmix32(uint32(i)))
+	}
+	n := heavy(20000, 5000)
+	plain := newC()
+	c := newC()
+	c.tree.prefix = true
+	for i := 0; i < n; i++ {
+		plain.add(key(i), "v")
+		c.add(key(i), "v")
+	}
+	c.verify(t)
+	is.True(t, len(c.pages) < len(plain.pages)*3/4)
+	nPacked := 0
+	for _, node := range c.pages {
+		if node.isPrefixed() {
+			nPacked++
+		}
+	}
+	is.True(t, nPacked > len(c.pages)/2)
+	for i := 0; i < n; i += 3 {
+		is.True(t, c.del(key(i)))
+	}
+	c.verify(t)
+
+	// 新的键打破了长的公共前缀，结点还原之后可能超过 2 页
+	long := strings.Repeat("p", 300)
+	for i := 0; i < 3000; i++ {
+		c.add(fmt.Sprintf("%s%05d", long, i), "v")
+	}
+	c.verify(t)
+	for i := 0; i < 3000; i += 10 {
+		c.add(fmt.Sprintf("%sq%05d", long[:i%300], i), bigVal("w", 2000))
+	}
+	c.verify(t)
+
+	// 关闭压缩之后，修改过的结点还原为原来的格式
+	c.tree.prefix = false
+	for k := range maps.Clone(c.ref) {
+		if fmix32(uint32(len(k)+int(k[len(k)-1])))%2 == 0 {
+			is.True(t, c.del(k))
+		} else {
+			c.add(k, "x")
+		}
+	}
+	c.verify(t)
+	for k := range maps.Clone(c.ref) {
+		is.True(t, c.del(k))
+	}
+	c.verify(t)
+	is.Equal(t, 1, len(c.pages))
+}
+
+func BenchmarkBTreeGet(b *testing.B) {
+	// 小的键使每个结点有很多孩子
+	for _, prefix := range []bool{false, true} {
+		c := newC()
+		c.tree.prefix = prefix
+		var keys [][]byte
+		for i := 0; i < 200000; i++ {
+			key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+			c.add(key, "v")
+			keys = append(keys, []byte(key))
+		}
+		b.Run(fmt.Sprintf("prefix=%v", prefix), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, ok := c.tree.Get(keys[i%len(keys)])
+				util.Assert(ok)
+			}
+		})
+	}
+}
+
 func printSliceInfo(s []string) {
 	fmt.Printf("s: %v, is nil: %t, len: %d, cap: %d\n", s, s == nil, len(s), cap(s))
 }
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+const (
+	BulkFill       = 0.9  // 批量加载时结点的默认填充率
+	bulkFlushPages = 1024 // 内存中积累的新页面超过这个数量时提前写入文件
+)
+
+var ErrUnsorted = errors.New("bulk load: keys not in increasing order")
+
+// bulkLevel 正在构建的一层结点
+type bulkLevel struct {
+	entries []nodeEntry
+	size    int // 不压缩时的大小
+}
+
+// bulkLoader 自底向上构建 B 树
+// 每一层只保存最右边的一个结点，结点满了就写入新的页面，
+// 并把它的第一个键加入上一层。
+type bulkLoader struct {
+	db     *KV
+	tree   *BTree
+	limit  int          // 结点大小的上限，由填充率决定
+	levels []*bulkLevel // levels[0] 是叶子
+	// 输入
+	next func() ([]byte, []byte, bool)
+	key  []byte
+	val  []byte
+	more bool
+	err  error
+}
+
+// BulkLoad 将按键严格递增的输入合并到数据库中，只提交一次
+// 见 KVTX.BulkLoad。
+func (db *KV) BulkLoad(items iter.Seq2[[]byte, []byte], fill float64) error {
+	tx := db.Begin()
+	if err := tx.BulkLoad(items, fill); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// BulkLoad 将按键严格递增的输入合并到树中，已有的键被覆盖
+// 输入和范围内已有的键一起自底向上构建新的结点，结点按 fill（0 时为 BulkFill）填充，
+// 新的页面顺序追加到文件末尾。没有输入落入的旧子树整个接入新的树，不会被重写，
+// 只有包含输入的旧结点被释放，所以向大数据库中加载少量的键只重写对应的路径。
+// 键的顺序不正确时返回 ErrUnsorted，出错之后事务只能放弃。
+func (tx *KVTX) BulkLoad(items iter.Seq2[[]byte, []byte], fill float64) (err error) {
+	if tx.err != nil {
+		return tx.err
+	}
+	if fill == 0 {
+		fill = BulkFill
+	}
+	if !(0 < fill && fill <= 1) {
+		return fmt.Errorf("bulk load: bad fill factor %v", fill)
+	}
+	// 树可能只构建了一半
+	defer func() {
+		if err != nil {
+			tx.err = err
+		}
+	}()
+	defer recoverCorrupt(&err)
+
+	db := tx.db
+	b := &bulkLoader{db: db, tree: &db.tree, limit: int(fill * float64(db.PageSize))}
+	next, stop := iter.Pull2(items)
+	defer stop()
+	b.next = next
+	b.pull()
+	if !b.more {
+		return b.err
+	}
+	if b.tree.root == 0 {
+		// 覆盖整个键空间的虚拟键，见 BTree.Update
+		b.add(0, nodeEntry{})
+	} else {
+		b.merge(b.tree.root, treeHeight(b.tree)-1, nil)
+	}
+	for b.err == nil && b.more {
+		b.addNext()
+	}
+	if b.err != nil {
+		return b.err
+	}
+	b.tree.root = b.finish()
+	return b.err
+}
+
+// pull 读取下一个输入
+func (b *bulkLoader) pull() {
+	key, val, ok := b.next()
+	if !ok {
+		b.more = false
+		return
+	}
+	err := b.tree.checkKey(key)
+	if err == nil && len(val) > MaxValSize {
+		err = ErrValueTooLarge
+	}
+	if err == nil && b.key != nil && bytes.Compare(b.key, key) >= 0 {
+		err = ErrUnsorted
+	}
+	if err != nil {
+		b.err, b.more = err, false
+		return
+	}
+	// 迭代器可能复用缓冲区
+	b.key, b.val, b.more = bytes.Clone(key), bytes.Clone(val), true
+}
+
+// addNext 将当前的输入加入叶子，大的值写入溢出页
+func (b *bulkLoader) addNext() {
+	val, overflow := b.val, false
+	if len(val) > maxValSize(b.tree.pageSize) {
+		val, overflow = overflowWrite(b.tree, val), true
+	}
+	b.add(0, nodeEntry{key: b.key, val: val, overflow: overflow})
+	b.pull()
+}
+
+// treeHeight 返回非空的树的高度，叶子为 1
+func treeHeight(tree *BTree) int {
+	height := 1
+	for node := BNode(tree.get(tree.root)); node.bType() == BNodeNode; height++ {
+		node = BNode(tree.get(node.getPtr(0)))
+	}
+	return height
+}
+
+// merge 按顺序合并旧的树中 [level 层的结点 ptr, end) 范围内的键和输入，end 为 nil 时没有上界
+// 下一个输入不在子结点的范围内时整个子树保持不变，直接接入新的树；
+// 其余的旧结点读完之后释放，相同的键使用输入的值，旧的溢出页也一并释放。
+func (b *bulkLoader) merge(ptr uint64, level int, end []byte) {
+	node := BNode(b.tree.get(ptr))
+	for i := uint16(0); i < node.nKeys() && b.err == nil; i++ {
+		if node.bType() == BNodeNode {
+			kidEnd := end
+			if i+1 < node.nKeys() {
+				kidEnd = node.getKey(i + 1)
+			}
+			if b.more && (kidEnd == nil || bytes.Compare(b.key, kidEnd) < 0) {
+				b.merge(node.getPtr(i), level-1, kidEnd)
+			} else {
+				b.attach(level-1, node.getKey(i), node.getPtr(i))
+			}
+			continue
+		}
+		key := node.getKey(i)
+		for b.err == nil && b.more && bytes.Compare(b.key, key) < 0 {
+			b.addNext()
+		}
+		if b.err != nil {
+			return
+		}
+		if b.more && bytes.Equal(b.key, key) {
+			if node.isOverflow(i) {
+				overflowFree(b.tree, node.getVal(i))
+			}
+			b.addNext()
+			continue
+		}
+		b.add(0, nodeEntry{key: key, val: node.getVal(i), overflow: node.isOverflow(i)})
+	}
+	b.tree.del(ptr)
+}
+
+// attach 将旧的子树（根在 level 层）整个加入新的树，先结束它下面每一层正在构建的结点
+// 这些结点可能不满，但所有叶子的深度仍然相同。
+func (b *bulkLoader) attach(level int, key []byte, ptr uint64) {
+	for l := 0; l <= level && l < len(b.levels); l++ {
+		if len(b.levels[l].entries) > 0 {
+			b.flush(l)
+		}
+	}
+	b.add(level+1, nodeEntry{key: key, ptr: ptr})
+}
+
+// add 将一个键加入 level 层最右边的结点，放不下时先结束这个结点
+func (b *bulkLoader) add(level int, e nodeEntry) {
+	for level >= len(b.levels) {
+		b.levels = append(b.levels, &bulkLevel{size: Header})
+	}
+	l := b.levels[level]
+	size := e.size()
+	if len(l.entries) > 0 && !b.tree.sizeFits(b.limit, l.size+size, len(l.entries)+1, l.entries[0].key, e.key) {
+		b.flush(level)
+	}
+	l.entries = append(l.entries, e)
+	l.size += size
+}
+
+// flush 结束 level 层最右边的结点，写入新的页面并加入上一层
+func (b *bulkLoader) flush(level int) {
+	l := b.levels[level]
+	typ := uint16(BNodeLeaf)
+	if level > 0 {
+		typ = BNodeNode
+	}
+	node := nodeBuild(typ, l.entries)
+	// 总是追加到文件末尾，新的树在文件中是连续的
+	ptr := b.db.pageAppend(nodePack(node, b.tree.pageSize, b.tree.prefix))
+	first := l.entries[0].key
+	l.entries, l.size = l.entries[:0], Header
+	b.add(level+1, nodeEntry{key: first, ptr: ptr})
+
+	if b.err == nil && len(b.db.page.updates) >= bulkFlushPages {
+		b.err = flushAppended(b.db)
+	}
+}
+
+// finish 结束每一层剩下的结点，返回新的根
+func (b *bulkLoader) finish() uint64 {
+	for level := 0; ; level++ {
+		l := b.levels[level]
+		if level > 0 && level == len(b.levels)-1 && len(l.entries) == 1 {
+			return l.entries[0].ptr
+		}
+		if len(l.entries) > 0 { // 接入旧的子树时下面的层可能是空的
+			b.flush(level)
+		}
+	}
+}
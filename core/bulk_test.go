@@ -0,0 +1,244 @@
+package core
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// bulkItems 按键的顺序返回 kvs 中的键值对
+func bulkItems(kvs map[string]string) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for _, k := range slices.Sorted(maps.Keys(kvs)) {
+			if !yield([]byte(k), []byte(kvs[k])) {
+				return
+			}
+		}
+	}
+}
+
+// bulkLoad 批量加载并更新参考数据
+func (d *D) bulkLoad(t *testing.T, kvs map[string]string, fill float64) {
+	is.NoError(t, d.db.BulkLoad(bulkItems(kvs), fill))
+	maps.Copy(d.ref, kvs)
+}
+
+// treeNodes 返回树的高度和所有的结点
+func treeNodes(tree *BTree) (height int, nodes []BNode) {
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := BNode(tree.get(ptr))
+		nodes = append(nodes, node)
+		if node.bType() == BNodeLeaf {
+			height = max(height, depth)
+			return
+		}
+		for i := uint16(0); i < node.nKeys(); i++ {
+			walk(node.getPtr(i), depth+1)
+		}
+	}
+	walk(tree.root, 1)
+	return height, nodes
+}
+
+func TestBulkLoad(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	// 空的输入不修改数据库
+	is.NoError(t, c.db.BulkLoad(bulkItems(nil), 0))
+	is.Zero(t, c.db.tree.root)
+
+	// 超过 bulkFlushPages 的数据，部分页面提前写入
+	kvs := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%08d", fmix32(uint32(i)))
+		kvs[key] = bigVal(key, 300)
+	}
+	c.bulkLoad(t, kvs, 1)
+	c.verify(t)
+	height, nodes := treeNodes(&c.db.tree)
+	is.Equal(t, 3, height)
+	is.True(t, len(nodes) < 2100)
+	c.reopen()
+	c.verify(t)
+
+	// 与已有的键合并，覆盖的溢出页被释放
+	kvs = map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%08d", fmix32(uint32(i*7)))
+		vLen := int(fmix32(uint32(i))) % (3 * BTreePageSize)
+		kvs[key] = bigVal(key, vLen)
+		if i%3 == 0 {
+			c.add(key, bigVal("old", 2*BTreePageSize))
+		}
+	}
+	c.bulkLoad(t, kvs, 0)
+	c.verify(t)
+	c.reopen()
+	c.verify(t)
+
+	// 之后的修改正常进行
+	for i := 0; i < 20000; i += 2 {
+		is.True(t, c.del(fmt.Sprintf("key%08d", fmix32(uint32(i)))))
+	}
+	c.add("a", "b")
+	c.verify(t)
+}
+
+func TestBulkLoadRange(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	kvs := map[string]string{}
+	for i := 0; i < 50000; i++ {
+		kvs[fmt.Sprintf("key%08d", i)] = "v"
+	}
+	c.bulkLoad(t, kvs, 0)
+	c.verify(t)
+	_, nodes := treeNodes(&c.db.tree)
+
+	// 只重写输入所在的路径，其余的子树直接接入
+	for _, keys := range [][]string{
+		{"key00000000"},
+		{"a", "b"},
+		{"z"},
+		{"key00012345", "key00012345x", "key00030000", "key00049999", "zz"},
+		{"key00020000", "key00020001", "key00020002", "key00020003", "key00020004"},
+	} {
+		kvs = map[string]string{}
+		for _, key := range keys {
+			kvs[key] = "new"
+		}
+		written := c.db.stats.pages.Load()
+		c.bulkLoad(t, kvs, 0)
+		written = c.db.stats.pages.Load() - written
+		is.True(t, written < 30, keys)
+		c.verify(t)
+	}
+	_, after := treeNodes(&c.db.tree)
+	is.True(t, len(after) < len(nodes)+30)
+	c.reopen()
+	c.verify(t)
+}
+
+func TestBulkLoadFill(t *testing.T) {
+	kvs := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		kvs[fmt.Sprintf("%08d", i)] = bigVal("v", int(fmix32(uint32(i)))%200)
+	}
+	counts := map[float64]int{}
+	for _, fill := range []float64{1, 0.5, 0.25} {
+		c := newD()
+		c.bulkLoad(t, kvs, fill)
+		c.verify(t)
+		_, nodes := treeNodes(&c.db.tree)
+		for _, node := range nodes {
+			is.True(t, node.unpackedBytes() <= int(fill*BTreePageSize))
+		}
+		counts[fill] = len(nodes)
+		c.dispose()
+	}
+	is.True(t, counts[0.5] > counts[1]*3/2)
+	is.True(t, counts[0.25] > counts[0.5]*3/2)
+
+	// 逐个插入的树更大
+	c := newD()
+	defer c.dispose()
+	for k, v := range kvs {
+		c.add(k, v)
+	}
+	_, nodes := treeNodes(&c.db.tree)
+	is.True(t, len(nodes) > counts[1]*5/4)
+
+	for _, fill := range []float64{-1, 1.5} {
+		is.Error(t, c.db.BulkLoad(bulkItems(kvs), fill))
+	}
+	c.ref = kvs
+	c.verify(t)
+}
+
+func TestBulkLoadPrefix(t *testing.T) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, PageSize: 2048, PrefixCompression: true}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+
+	kvs := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("\x00\x00\x00\x65%050d", i)
+		kvs[key] = bigVal("v", int(fmix32(uint32(i))%100))
+	}
+	c.bulkLoad(t, kvs, 1)
+	c.verify(t)
+	// 压缩之后每个结点能放下更多的键，包含虚拟键的结点不能压缩
+	_, nodes := treeNodes(&c.db.tree)
+	large := 0
+	for _, node := range nodes {
+		if node.compareKey(0, nil) != 0 {
+			is.True(t, node.isPrefixed())
+		}
+		if node.unpackedBytes() > c.db.PageSize {
+			large++
+		}
+	}
+	is.True(t, large > len(nodes)/2)
+	c.reopen()
+	c.verify(t)
+	for i := 0; i < 5000; i += 3 {
+		is.True(t, c.del(fmt.Sprintf("\x00\x00\x00\x65%050d", i)))
+	}
+	c.verify(t)
+}
+
+func TestBulkLoadErr(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("k%04d", i), "old")
+	}
+
+	items := func(keys ...string) iter.Seq2[[]byte, []byte] {
+		return func(yield func([]byte, []byte) bool) {
+			for _, k := range keys {
+				if !yield([]byte(k), []byte("new")) {
+					return
+				}
+			}
+		}
+	}
+	for _, keys := range [][]string{
+		{"k0001", "k0500", "k0300"},
+		{"a", "k0100", "k0100"},
+		{"a", "k0500", "z", "y"},
+	} {
+		is.Equal(t, ErrUnsorted, c.db.BulkLoad(items(keys...), 0))
+		c.verify(t)
+	}
+	is.Equal(t, ErrEmptyKey, c.db.BulkLoad(items("a", ""), 0))
+	big := func(yield func([]byte, []byte) bool) {
+		yield([]byte("b"), make([]byte, MaxValSize+1))
+	}
+	is.Equal(t, ErrValueTooLarge, c.db.BulkLoad(big, 0))
+	c.verify(t)
+
+	// 出错之后事务只能放弃
+	tx := c.db.Begin()
+	is.Equal(t, ErrUnsorted, tx.BulkLoad(items("b", "a"), 0))
+	_, err := tx.Set([]byte("c"), nil)
+	is.Equal(t, ErrUnsorted, err)
+	is.Equal(t, ErrUnsorted, tx.Commit())
+	c.verify(t)
+
+	// 与其他修改在同一个事务中提交
+	tx = c.db.Begin()
+	_, err = tx.Del([]byte("k0000"))
+	is.NoError(t, err)
+	is.NoError(t, tx.BulkLoad(items("k0000", "k0001"), 0))
+	is.NoError(t, tx.Commit())
+	c.ref["k0000"], c.ref["k0001"] = "new", "new"
+	c.verify(t)
+}
@@ -0,0 +1,279 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// CheckReport 一致性检查的结果
+type CheckReport struct {
+	Pages    uint64 // 文件中使用的页面数（page.flushed）
+	Depth    int    // 树的高度，空树为 0
+	Keys     uint64 // 叶子结点中的键数，包括哨兵
+	Nodes    uint64 // B 树结点的页面数
+	Overflow uint64 // 溢出页的页面数
+	List     uint64 // freelist 结点的页面数
+	Free     uint64 // freelist 中的页面数
+	Problems []string
+}
+
+// 页面的引用者
+const (
+	checkMeta = iota + 1
+	checkNode
+	checkOverflow
+	checkList
+	checkFree
+)
+
+var checkOwners = []string{"", "meta", "tree node", "overflow page", "freelist node", "free page"}
+
+// checker 遍历 B 树和 freelist，记录每个页面的引用者
+type checker struct {
+	db     *KV
+	report *CheckReport
+	owner  []uint8
+}
+
+// problem 记录一个问题
+func (c *checker) problem(format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, fmt.Sprintf(format, args...))
+}
+
+// ref 记录页面的引用，页面越界或者已经被引用时返回 false，不再继续检查这个页面
+func (c *checker) ref(ptr uint64, owner uint8, from string) bool {
+	if ptr == 0 || ptr >= c.report.Pages {
+		c.problem("%s: page %d out of range [1, %d)", from, ptr, c.report.Pages)
+		return false
+	}
+	if prev := c.owner[ptr]; prev != 0 {
+		c.problem("%s: page %d already referenced as %s", from, ptr, checkOwners[prev])
+		return false
+	}
+	c.owner[ptr] = owner
+	switch owner {
+	case checkNode:
+		c.report.Nodes++
+	case checkOverflow:
+		c.report.Overflow++
+	case checkList:
+		c.report.List++
+	case checkFree:
+		c.report.Free++
+	}
+	return true
+}
+
+// read 读取已提交的页面并验证校验和，typ 不为 0 时检查页面的类型
+// 不经过 pageRead，损坏的页面不会 panic。
+func (c *checker) read(ptr uint64, typ uint16) []byte {
+	page := pageReadRaw(c.db, ptr)
+	if binary.LittleEndian.Uint32(page[4:]) != pageChecksum(page) {
+		c.problem("page %d: bad checksum", ptr)
+		return nil
+	}
+	if got := BNode(page).bType(); typ != 0 && got != typ {
+		c.problem("page %d: type %d, expected %d", ptr, got, typ)
+		return nil
+	}
+	return page
+}
+
+// checkLayout 检查结点的格式，之后才能使用 BNode 的方法访问键值对
+func checkLayout(node BNode) error {
+	typ := binary.LittleEndian.Uint16(node) &^ (nodePrefix | nodeHints)
+	if typ != BNodeNode && typ != BNodeLeaf {
+		return fmt.Errorf("bad node type %d", typ)
+	}
+	n := int(node.nKeys())
+	if n == 0 {
+		return fmt.Errorf("no keys")
+	}
+	pos := Header
+	if node.isPrefixed() {
+		if pos+prefixLenSize > len(node) {
+			return fmt.Errorf("bad prefix")
+		}
+		pos += prefixLenSize + int(binary.LittleEndian.Uint16(node[Header:]))
+	}
+	if node.hasHints() {
+		pos += hintSize * n
+	}
+	pos += (PointerSize + offsetSize) * n
+	if pos > len(node) {
+		return fmt.Errorf("%d keys do not fit in page", n)
+	}
+	// 偏移量单调递增，每个键值对的大小与偏移量一致
+	for i := uint16(0); i < uint16(n); i++ {
+		start, end := int(node.getOffset(i)), int(node.getOffset(i+1))
+		if end < start+KeyLenSize+ValLenSize || pos+end > len(node) {
+			return fmt.Errorf("bad offset %d at key %d", end, i+1)
+		}
+		kLen := int(binary.LittleEndian.Uint16(node[pos+start:]))
+		vLen := int(binary.LittleEndian.Uint16(node[pos+start+KeyLenSize:]) &^ valOverflow)
+		if start+KeyLenSize+ValLenSize+kLen+vLen != end {
+			return fmt.Errorf("key %d size does not match offsets", i)
+		}
+	}
+	return nil
+}
+
+// node 检查以 ptr 为根的子树，第一个键必须等于 first，所有的键必须小于 end（为 nil 时不限制）
+func (c *checker) node(ptr uint64, depth int, first, end []byte) {
+	page := c.read(ptr, 0)
+	if page == nil {
+		return
+	}
+	node := BNode(page)
+	if err := checkLayout(node); err != nil {
+		c.problem("page %d: %v", ptr, err)
+		return
+	}
+
+	// 键有序且在父结点给出的范围内
+	n := node.nKeys()
+	keys := make([][]byte, n)
+	for i := uint16(0); i < n; i++ {
+		keys[i] = node.getKey(i)
+		if len(keys[i]) > maxKeySize(c.db.PageSize) {
+			c.problem("page %d: key %d too large", ptr, i)
+		}
+		if i > 0 && bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			c.problem("page %d: key %d not sorted", ptr, i)
+		}
+		if node.hasHints() && node.getHint(i) != keyHint(node.getSuffix(i)) {
+			c.problem("page %d: bad hint at key %d", ptr, i)
+		}
+	}
+	if !bytes.Equal(keys[0], first) {
+		c.problem("page %d: first key %q, parent has %q", ptr, keys[0], first)
+	}
+	if end != nil && bytes.Compare(keys[n-1], end) >= 0 {
+		c.problem("page %d: key %q not below parent bound %q", ptr, keys[n-1], end)
+	}
+
+	if node.bType() == BNodeLeaf {
+		if c.report.Depth == 0 {
+			c.report.Depth = depth
+		} else if depth != c.report.Depth {
+			c.problem("page %d: leaf at depth %d, expected %d", ptr, depth, c.report.Depth)
+		}
+		c.report.Keys += uint64(n)
+		for i := uint16(0); i < n; i++ {
+			switch {
+			case node.isOverflow(i):
+				c.overflow(ptr, i, node.getVal(i))
+			case len(node.getVal(i)) > maxValSize(c.db.PageSize):
+				c.problem("page %d: value %d too large", ptr, i)
+			}
+		}
+		return
+	}
+	for i := uint16(0); i < n; i++ {
+		if node.getValLen(i) != 0 || node.isOverflow(i) {
+			c.problem("page %d: internal node with value at key %d", ptr, i)
+		}
+		kEnd := end
+		if i+1 < n {
+			kEnd = keys[i+1]
+		}
+		kid := node.getPtr(i)
+		if c.ref(kid, checkNode, fmt.Sprintf("page %d key %d", ptr, i)) {
+			c.node(kid, depth+1, keys[i], kEnd)
+		}
+	}
+}
+
+// overflow 检查叶子结点 ptr 中第 idx 个值的溢出链
+func (c *checker) overflow(ptr uint64, idx uint16, ref []byte) {
+	from := fmt.Sprintf("page %d value %d", ptr, idx)
+	if len(ref) != overflowRefLen {
+		c.problem("%s: bad overflow reference", from)
+		return
+	}
+	size, next := overflowRef(ref)
+	pageCap := uint64(overflowCap(c.db.PageSize))
+	for n := (size + pageCap - 1) / pageCap; n > 0; n-- {
+		if !c.ref(next, checkOverflow, from) {
+			return
+		}
+		page := c.read(next, BNodeOverflow)
+		if page == nil {
+			return
+		}
+		next = ONode(page).getNext()
+	}
+	if next != 0 {
+		c.problem("%s: overflow chain longer than %d bytes", from, size)
+	}
+}
+
+// freeList 从 headPage 开始遍历 freelist 直到 tailSeq，最后一个结点必须是 tailPage
+func (c *checker) freeList() {
+	fl := &c.db.free
+	if fl.headSeq > fl.tailSeq {
+		c.problem("freelist: head seq %d after tail seq %d", fl.headSeq, fl.tailSeq)
+		return
+	}
+	ptr := fl.headPage
+	if !c.ref(ptr, checkList, "freelist head") {
+		return
+	}
+	node := LNode(c.read(ptr, BNodeFree))
+	for seq := fl.headSeq; seq != fl.tailSeq; seq++ {
+		if node == nil {
+			return
+		}
+		c.ref(node.getPtr(fl.seq2idx(seq)), checkFree, fmt.Sprintf("freelist seq %d", seq))
+		if fl.seq2idx(seq+1) == 0 {
+			ptr = node.getNext()
+			if !c.ref(ptr, checkList, fmt.Sprintf("freelist node after seq %d", seq)) {
+				return
+			}
+			node = LNode(c.read(ptr, BNodeFree))
+		}
+	}
+	if ptr != fl.tailPage {
+		c.problem("freelist: ends at page %d, tail is %d", ptr, fl.tailPage)
+	}
+}
+
+// leaked 报告没有被引用的页面，连续的页面合并为一个区间
+func (c *checker) leaked() {
+	for ptr := uint64(1); ptr < c.report.Pages; ptr++ {
+		if c.owner[ptr] != 0 {
+			continue
+		}
+		end := ptr + 1
+		for end < c.report.Pages && c.owner[end] == 0 {
+			end++
+		}
+		if end == ptr+1 {
+			c.problem("page %d: leaked", ptr)
+		} else {
+			c.problem("pages [%d, %d): leaked", ptr, end)
+		}
+		ptr = end
+	}
+}
+
+// Check 检查最新提交的 B 树和 freelist：结点的格式、键的顺序和范围、叶子的深度、溢出链，
+// 以及 page.flushed 之前的每个页面恰好被引用一次。
+// 检查期间占用写事务，读事务不受影响。有问题时返回 ErrCorrupt。
+func (db *KV) Check() (CheckReport, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	c := checker{db: db, report: &CheckReport{Pages: db.page.flushed}}
+	c.owner = make([]uint8, c.report.Pages)
+	c.owner[0] = checkMeta
+	if root := db.tree.root; root != 0 && c.ref(root, checkNode, "root") {
+		c.node(root, 1, nil, nil)
+	}
+	c.freeList()
+	c.leaked()
+	if n := len(c.report.Problems); n > 0 {
+		return *c.report, fmt.Errorf("%w: %d problems found", ErrCorrupt, n)
+	}
+	return *c.report, nil
+}
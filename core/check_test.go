@@ -0,0 +1,180 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// checkOK 检查 DB 没有问题，每个页面都被统计了一次
+func checkOK(t *testing.T, c *D) CheckReport {
+	report, err := c.db.Check()
+	is.NoError(t, err, "%v", report.Problems)
+	is.Equal(t, report.Pages, 1+report.Nodes+report.Overflow+report.List+report.Free)
+	if len(c.ref) > 0 {
+		is.Equal(t, uint64(len(c.ref)+1), report.Keys)
+	}
+	return report
+}
+
+func funcTestCheck(t *testing.T, prefix bool, pageSize int) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, PrefixCompression: prefix, PageSize: pageSize}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	report := checkOK(t, c)
+	is.Zero(t, report.Depth)
+
+	for i := 0; i < 3000; i++ {
+		n := int(fmix32(uint32(i)) % 200)
+		if i%30 == 0 {
+			n = 3 * pageSize
+		}
+		c.add(fmt.Sprintf("key%d", fmix32(uint32(i))%1000), bigVal(fmt.Sprint(i), n))
+	}
+	report = checkOK(t, c)
+	is.True(t, report.Depth >= 2)
+	is.NotZero(t, report.Overflow)
+
+	for i := 0; i < 1000; i += 2 {
+		c.del(fmt.Sprintf("key%d", i))
+	}
+	report = checkOK(t, c)
+	is.NotZero(t, report.Free)
+	is.NoError(t, c.db.Compact())
+	checkOK(t, c)
+	c.reopen()
+	checkOK(t, c)
+}
+
+func TestCheck(t *testing.T) {
+	funcTestCheck(t, false, BTreePageSize)
+	funcTestCheck(t, true, BTreePageSize)
+	funcTestCheck(t, true, MinPageSize)
+
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:  "t",
+		Types: []uint32{TypeInt64, TypeBytes},
+		Cols:  []string{"id", "name"},
+		PKeys: 1,
+	})
+	for i := 0; i < 100; i++ {
+		rec := Record{}
+		r.add("t", *rec.AddInt64("id", int64(i)).AddStr("name", []byte(fmt.Sprint(i))))
+	}
+	_, err := r.db.Check()
+	is.NoError(t, err)
+}
+
+// rewritePage 修改存储中的页面并更新校验和，模拟逻辑错误而不是磁盘损坏
+func rewritePage(t *testing.T, store Storage, ptr uint64, fn func(page []byte)) {
+	page := bytes.Clone(store.Read(int64(ptr)*BTreePageSize, BTreePageSize))
+	fn(page)
+	binary.LittleEndian.PutUint32(page[4:], pageChecksum(page))
+	is.NoError(t, store.Write(int64(ptr)*BTreePageSize, page))
+}
+
+// checkProblem 检查报告的问题中有包含 want 的
+func checkProblem(t *testing.T, c *D, want string) {
+	report, err := c.db.Check()
+	is.True(t, errors.Is(err, ErrCorrupt))
+	for _, p := range report.Problems {
+		if strings.Contains(p, want) {
+			return
+		}
+	}
+	t.Fatalf("no problem contains %q: %v", want, report.Problems)
+}
+
+func TestCheckCorrupt(t *testing.T) {
+	newCorrupt := func() *D {
+		c := newD()
+		for i := 0; i < 2000; i++ {
+			c.add(fmt.Sprintf("key%d", i), "val")
+		}
+		for i := 0; i < 2000; i += 3 {
+			c.del(fmt.Sprintf("key%d", i))
+		}
+		checkOK(t, c)
+		return c
+	}
+	firstLeaf := func(c *D) uint64 {
+		ptr := c.db.tree.root
+		for BNode(c.db.tree.get(ptr)).bType() == BNodeNode {
+			ptr = BNode(c.db.tree.get(ptr)).getPtr(0)
+		}
+		return ptr
+	}
+	// 修改 freelist 中的第一个页面
+	setFree := func(c *D, ptr uint64) {
+		fl := &c.db.free
+		is.NotEqual(t, fl.headSeq, fl.tailSeq)
+		rewritePage(t, c.store, fl.headPage, func(page []byte) {
+			LNode(page).setPtr(fl.seq2idx(fl.headSeq), ptr)
+		})
+	}
+
+	cases := []struct {
+		want    string
+		corrupt func(c *D)
+	}{
+		{"bad checksum", func(c *D) {
+			corruptPage(t, c.store, firstLeaf(c))
+		}},
+		{"not sorted", func(c *D) {
+			rewritePage(t, c.store, firstLeaf(c), func(page []byte) {
+				node := BNode(page)
+				node.getSuffix(2)[0] = 0
+			})
+		}},
+		{"bad offset", func(c *D) {
+			rewritePage(t, c.store, firstLeaf(c), func(page []byte) {
+				node := BNode(page)
+				node.setOffset(2, node.getOffset(1)-1)
+			})
+		}},
+		{"first key", func(c *D) {
+			rewritePage(t, c.store, c.db.tree.root, func(page []byte) {
+				node := BNode(page)
+				suffix := node.getSuffix(1)
+				suffix[len(suffix)-1]++
+			})
+		}},
+		{"already referenced as tree node", func(c *D) {
+			setFree(c, c.db.tree.root)
+		}},
+		{"out of range", func(c *D) {
+			setFree(c, c.db.page.flushed+5)
+		}},
+		{"leaked", func(c *D) {
+			setFree(c, c.db.page.flushed+5)
+		}},
+		{"overflow chain longer", func(c *D) {
+			c.add("big", bigVal("v", 2*BTreePageSize))
+			ptr := c.db.tree.root
+			for BNode(c.db.tree.get(ptr)).bType() == BNodeNode {
+				node := BNode(c.db.tree.get(ptr))
+				ptr = node.getPtr(nodeLookupLE(node, []byte("big")))
+			}
+			rewritePage(t, c.store, ptr, func(page []byte) {
+				node := BNode(page)
+				idx := nodeLookupLE(node, []byte("big"))
+				is.True(t, node.isOverflow(idx))
+				binary.LittleEndian.PutUint64(node.getVal(idx), 1)
+			})
+		}},
+	}
+	for _, tc := range cases {
+		c := newCorrupt()
+		tc.corrupt(c)
+		checkProblem(t, c, tc.want)
+		c.dispose()
+	}
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"cmp"
+	"slices"
+
+	"db-practice/util"
+)
+
+// compactCost 截断位置不大于 max 时需要重写 cost 个页面（一个结点或一条溢出链）
+type compactCost struct {
+	max  uint64 // 结点的子树或溢出链中最大的页面号
+	cost int
+}
+
+// compactScan 遍历子树，记录每个结点的子树中最大的页面号和重写的代价
+func compactScan(tree *BTree, ptr uint64, maxPtr map[uint64]uint64, costs *[]compactCost) uint64 {
+	node := BNode(tree.get(ptr))
+	m := ptr
+	for i := uint16(0); i < node.nKeys(); i++ {
+		switch {
+		case node.bType() == BNodeNode:
+			m = max(m, compactScan(tree, node.getPtr(i), maxPtr, costs))
+		case node.isOverflow(i):
+			chain := overflowPages(tree, node.getVal(i))
+			c := compactCost{max: slices.Max(chain), cost: len(chain)}
+			*costs = append(*costs, c)
+			m = max(m, c.max)
+		}
+	}
+	maxPtr[ptr] = m
+	*costs = append(*costs, compactCost{max: m, cost: 1})
+	return m
+}
+
+// compactCut 选择截断位置 cut 和移动位置 move（move <= cut）：
+// cut 之后都是可以复用的空闲页面，磁盘上的树和读者都不再引用，直接从文件中去掉；
+// move 之后仍在使用的页面和新链表的结点都能从 move 之前可以复用的页面中分配，
+// 它们原来的页面在之后的压缩中截断。reuse 和 free（所有空闲页面）都是升序的。
+func compactCut(n uint64, costs []compactCost, reuse, free []uint64, limit, listCap int) (cut, move uint64) {
+	below := func(ptrs []uint64, t uint64) int {
+		i, _ := slices.BinarySearch(ptrs, t)
+		return i
+	}
+	// 新链表的结点数的上界
+	listNodes := func(need int) int {
+		return (below(free, cut)+need)/listCap + 2
+	}
+	cut = n
+	for i := len(reuse) - 1; i >= 0 && reuse[i] == cut-1; i-- {
+		cut--
+	}
+	for cut < n && listNodes(0) > below(reuse, cut) {
+		cut++
+	}
+
+	// 从截断位置向前逐页尝试，需要重写的页面只增不减，可以分配的页面只减不增
+	slices.SortFunc(costs, func(a, b compactCost) int { return cmp.Compare(b.max, a.max) })
+	move, need, c := cut, 0, 0
+	for t := cut - 1; t > 0; t-- {
+		for ; c < len(costs) && costs[c].max >= t; c++ {
+			need += costs[c].cost
+		}
+		if (limit > 0 && need > limit) || need+listNodes(need) > below(reuse, t) {
+			break
+		}
+		move = t
+	}
+	return cut, move
+}
+
+// compactNode 重写子树中截断位置之后的页面以及它们的祖先，返回新的指针
+func compactNode(tree *BTree, ptr, cut uint64, maxPtr map[uint64]uint64) uint64 {
+	if maxPtr[ptr] < cut {
+		return ptr
+	}
+	node := BNode(make([]byte, tree.pageSize))
+	copy(node, tree.get(ptr))
+	for i := uint16(0); i < node.nKeys(); i++ {
+		switch {
+		case node.bType() == BNodeNode:
+			node.setPtr(i, compactNode(tree, node.getPtr(i), cut, maxPtr))
+		case node.isOverflow(i):
+			ref := node.getVal(i)
+			if slices.Max(overflowPages(tree, ref)) >= cut {
+				val := overflowRead(tree, ref)
+				overflowFree(tree, ref)
+				copy(ref, overflowWrite(tree, val))
+			}
+		}
+	}
+	tree.del(ptr)
+	return tree.new(node)
+}
+
+// compact 将移动位置之后仍在使用的页面移动到之前的空闲页面，重建 freelist 并缩小 page.flushed
+// 新的页面只从这个事务可以复用的页面中分配，磁盘上的树和读者仍然可以访问旧的页面；
+// 截断位置之后的空闲页面不再放入链表。返回是否有进展。
+func (tx *KVTX) compact(limit int) (progress bool, err error) {
+	if tx.err != nil {
+		return false, tx.err
+	}
+	defer tx.fail(&err)
+	defer recoverCorrupt(&err)
+	db := tx.db
+	releaseReuse(db) // 之后重建 freelist
+	tree, fl := &db.tree, &db.free
+	listCap := (fl.pageSize - FreeListHeader) / 8
+
+	var costs []compactCost
+	maxPtr := map[uint64]uint64{}
+	if tree.root != 0 {
+		compactScan(tree, tree.root, maxPtr, &costs)
+	}
+	reuse, keep, nodes := flScan(fl)
+	slices.Sort(reuse)
+	free := slices.Sorted(slices.Values(slices.Concat(reuse, keep, nodes)))
+	cut, move := compactCut(db.page.flushed, costs, reuse, free, limit, listCap)
+	if cut == db.page.flushed && move == cut {
+		return false, nil
+	}
+
+	// 按页面号从小到大分配，释放的页面之后放入新的链表
+	next := 0
+	alloc := func(node []byte) uint64 {
+		ptr := reuse[next]
+		util.Assert(ptr < move)
+		next++
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	var freed []uint64
+	saved := *tree
+	defer func() { tree.new, tree.del = saved.new, saved.del }()
+	tree.new = alloc
+	tree.del = func(ptr uint64) { freed = append(freed, ptr) }
+	if tree.root != 0 {
+		tree.root = compactNode(tree, tree.root, move, maxPtr)
+	}
+
+	// 截断位置之前的空闲页面作为新链表的结点或内容
+	head := alloc(make([]byte, db.PageSize))
+	end, _ := slices.BinarySearch(reuse, cut)
+	pages := slices.Clone(reuse[next:end])
+	for _, ptr := range slices.Concat(keep, nodes, freed) {
+		util.Assert(ptr < cut)
+		pages = append(pages, ptr)
+	}
+	// 尾结点写满时 PushTail 分配新的结点：从 seq 开始放入 len(pages)-k 个页面需要 k 个新结点，
+	// 某些起始位置没有解，这时跳过一个序列号
+	seq, k := fl.tailSeq, 0
+	for ; ; seq++ {
+		f := func(k int) int { return (fl.seq2idx(seq) + len(pages) - k) / listCap }
+		k = 0
+		for k < f(k) {
+			k++
+		}
+		if k == f(k) {
+			break
+		}
+	}
+	flReset(fl, head, seq)
+	listNodes, pages := pages[:k], pages[k:]
+	saveNew := fl.new
+	defer func() { fl.new = saveNew }()
+	fl.new = func(node []byte) uint64 {
+		ptr := listNodes[0]
+		listNodes = listNodes[1:]
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	for _, ptr := range pages {
+		fl.PushTail(ptr)
+	}
+	util.Assert(len(listNodes) == 0)
+	db.page.flushed = cut
+	return true, nil
+}
+
+// CompactStep 执行一步压缩：去掉文件末尾的空闲页面并截断文件，
+// 在同一个事务中将之前仍在使用的 B 树和 freelist 页面移动到前面的空闲页面，最多重写 limit 个页面（为 0 时不限制）。
+// 移动之后空出的页面在读者结束之后的下一步中截断。
+// 返回是否有进展；每一步都是一次完整的提交，可以在任意时刻中断。
+func (db *KV) CompactStep(limit int) (bool, error) {
+	if db.ReadOnly {
+		return false, ErrReadOnly
+	}
+	// 延迟持久化的模式中，之前的提交释放的页面在持久化之后才能复用
+	if err := db.Sync(); err != nil {
+		return false, err
+	}
+	tx := db.Begin()
+	progress, err := tx.compact(limit)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return progress, db.truncate()
+}
+
+// Compact 重复 CompactStep 直到没有进展，活跃的读者引用的页面不能被截断
+func (db *KV) Compact() error {
+	for {
+		progress, err := db.CompactStep(0)
+		if err != nil || !progress {
+			return err
+		}
+	}
+}
+
+// truncate 截断文件中 page.flushed 之后的部分
+// 新的 meta 持久化之后才能截断，否则崩溃之后旧的 meta 引用的页面不存在。
+func (db *KV) truncate() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if err := syncAll(db); err != nil {
+		return err
+	}
+	if db.WAL {
+		// 持有写锁，checkpoint 之后日志中没有更新的页面
+		if err := walCheckpoint(db); err != nil {
+			return err
+		}
+	}
+	db.wal.ckpt.Lock()
+	defer db.wal.ckpt.Unlock()
+	size := int64(db.page.flushed) * int64(db.PageSize)
+	fileSize, err := db.Store.Size()
+	if err != nil || fileSize <= size {
+		return err
+	}
+	return db.Store.Truncate(size)
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// compactFill 插入 n 个键（其中一些使用溢出页），然后删除除了每 keepEvery 个之外的所有键
+func compactFill(c *D, n, keepEvery int) {
+	for i := 0; i < n; i++ {
+		val := fmt.Sprint(i)
+		if i%50 == 0 {
+			val = bigVal(val, 2*BTreePageSize)
+		}
+		c.add(fmt.Sprintf("key%08d", fmix32(uint32(i))), val)
+	}
+	for i := 0; i < n; i++ {
+		if i%keepEvery != 0 {
+			c.del(fmt.Sprintf("key%08d", fmix32(uint32(i))))
+		}
+	}
+}
+
+// fileSize 返回存储的大小
+func (d *D) fileSize(t *testing.T) int64 {
+	size, err := d.store.Size()
+	is.NoError(t, err)
+	return size
+}
+
+// compacted 检查压缩之后文件中只剩下很少的空闲页面
+func (d *D) compacted(t *testing.T) {
+	list, _ := flDump(&d.db.free)
+	is.True(t, len(list) < 16, "%d free pages", len(list))
+	is.Equal(t, int64(d.db.page.flushed)*int64(d.db.PageSize), d.fileSize(t))
+}
+
+func funcTestCompact(t *testing.T, prefix bool) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, PrefixCompression: prefix}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	compactFill(c, heavy(20000, 4000), 20)
+	peak := c.fileSize(t)
+
+	is.NoError(t, c.db.Compact())
+	c.verify(t)
+	c.compacted(t)
+	is.True(t, c.fileSize(t)*2 < peak)
+
+	// 已经压缩过的数据库没有进展
+	progress, err := c.db.CompactStep(0)
+	is.NoError(t, err)
+	is.False(t, progress)
+
+	c.reopen()
+	c.verify(t)
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("new%d", i), bigVal(fmt.Sprint(i), i))
+	}
+	c.verify(t)
+	c.reopen()
+	c.verify(t)
+}
+
+func TestCompact(t *testing.T) {
+	funcTestCompact(t, false)
+	funcTestCompact(t, true)
+}
+
+func TestCompactStep(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	compactFill(c, 10000, 10)
+
+	// 每一步最多重写 50 个页面
+	steps := 0
+	for {
+		size := c.fileSize(t)
+		progress, err := c.db.CompactStep(50)
+		is.NoError(t, err)
+		c.verify(t)
+		if !progress {
+			break
+		}
+		is.True(t, c.fileSize(t) <= size)
+		steps++
+	}
+	is.True(t, steps > 2)
+	size := c.fileSize(t)
+
+	is.NoError(t, c.db.Compact())
+	c.verify(t)
+	c.compacted(t)
+	is.True(t, c.fileSize(t) <= size)
+	c.reopen()
+	c.verify(t)
+}
+
+func TestCompactReader(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	compactFill(c, 5000, 10)
+	size := c.fileSize(t)
+
+	// 读者的快照保持不变，读者引用的页面在读者结束之后才截断
+	r := c.db.BeginRead()
+	keys, vals := dump(&r.tree)
+	is.NoError(t, c.db.Compact())
+	c.verify(t)
+	readerSize := c.fileSize(t)
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprint(i), bigVal("v", i*50))
+	}
+	keys2, vals2 := dump(&r.tree)
+	is.Equal(t, keys, keys2)
+	is.Equal(t, vals, vals2)
+	r.EndRead()
+
+	is.NoError(t, c.db.Compact())
+	c.verify(t)
+	c.compacted(t)
+	is.True(t, readerSize < size)
+	c.reopen()
+	c.verify(t)
+}
+
+func TestCompactFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes more than 64MB")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	fs := &FileStorage{Path: path, Fsync: func(int) error { return nil }}
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: fs}}
+	c.db = KV{Store: c.store}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+
+	// 超过第一个 64MB 的映射
+	for i := 0; i < 80; i++ {
+		c.add(fmt.Sprint(i), bigVal(fmt.Sprint(i), MaxValSize))
+	}
+	n, total := fs.Mapped()
+	is.Equal(t, 2, n)
+	is.True(t, c.fileSize(t) > 64<<20)
+
+	// 读者的快照在压缩期间保持不变
+	for i := 1; i < 80; i++ {
+		c.del(fmt.Sprint(i))
+	}
+	r := c.db.BeginRead()
+	keys, vals := dump(&r.tree)
+	is.NoError(t, c.db.Compact())
+	keys2, vals2 := dump(&r.tree)
+	is.Equal(t, keys, keys2)
+	is.Equal(t, vals, vals2)
+	r.EndRead()
+
+	// 截断之后解除文件末尾的映射
+	is.NoError(t, c.db.Compact())
+	c.verify(t)
+	c.compacted(t)
+	n, small := fs.Mapped()
+	is.Equal(t, 1, n)
+	is.True(t, small < total)
+	is.Equal(t, small, fs.mmap.total)
+
+	// 文件重新增长之后重新映射
+	for i := 0; i < 80; i++ {
+		c.add(fmt.Sprintf("new%d", i), bigVal(fmt.Sprint(i), MaxValSize))
+	}
+	c.verify(t)
+	n, _ = fs.Mapped()
+	is.Equal(t, 2, n)
+	c.reopen()
+	c.verify(t)
+}
+
+func TestCompactDurability(t *testing.T) {
+	for _, mode := range []int{DurabilitySingle, DurabilityPeriodic} {
+		c := newDurableD(t, mode, 0)
+		compactFill(c, 5000, 10)
+		size := c.fileSize(t)
+		is.NoError(t, c.db.Compact())
+		c.verify(t)
+		c.compacted(t)
+		is.Zero(t, c.db.SyncStats().Pending)
+		is.True(t, c.fileSize(t) < size)
+		c.reopen()
+		c.verify(t)
+		c.dispose()
+	}
+
+	c, log := newWALD(t, 0)
+	defer c.dispose()
+	compactFill(c, 5000, 10)
+	is.NoError(t, c.db.Compact())
+	c.verify(t)
+	c.compacted(t)
+	c.add("k", "v")
+	walCrash(t, c, log)
+	c.verify(t)
+}
+
+// TestCompactCrash 在压缩的每个写入和 sync 处模拟断电，内容总是不变
+func TestCompactCrash(t *testing.T) {
+	store := &crashStorage{}
+	c := &D{ref: map[string]string{}}
+	c.db.Store = store
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	for i := 0; i < 2000; i++ {
+		n := i % 300
+		if i%40 == 0 {
+			n = 2 * BTreePageSize
+		}
+		c.add(fmt.Sprintf("key%d", fmix32(uint32(i))), bigVal(fmt.Sprint(i), n))
+	}
+	for i := 0; i < 2000; i++ {
+		if i%8 != 0 {
+			c.del(fmt.Sprintf("key%d", fmix32(uint32(i))))
+		}
+	}
+
+	nImages := 0
+	for steps := 0; ; steps++ {
+		base := storageImage(store)
+		store.events = nil
+		progress, err := c.db.CompactStep(10)
+		is.NoError(t, err)
+		c.verify(t)
+		crashImages(base, store.events, false, func(img []byte, desc string) {
+			crashCheck(t, img, fmt.Sprintf("step %d, %s", steps, desc), c.ref)
+			nImages++
+		})
+		if !progress {
+			is.True(t, steps > 1)
+			t.Logf("%d steps, %d crash images checked", steps, nImages)
+			break
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+
+	"db-practice/util"
+)
+
+// crashEvent 一次写入或 sync
+type crashEvent struct {
+	offset int64
+	data   []byte // nil 表示一次 sync
+}
+
+// crashStorage 记录所有写入和 sync 的存储后端，用于模拟断电
+type crashStorage struct {
+	MemStorage
+	events []crashEvent
+}
+
+func (s *crashStorage) Write(offset int64, data []byte) error {
+	s.events = append(s.events, crashEvent{offset: offset, data: bytes.Clone(data)})
+	return s.MemStorage.Write(offset, data)
+}
+
+func (s *crashStorage) Sync() error {
+	s.events = append(s.events, crashEvent{})
+	return nil
+}
+
+// storageImage 返回存储内容的副本
+func storageImage(s Storage) []byte {
+	size, err := s.Size()
+	util.Assert(err == nil)
+	img := make([]byte, 0, size)
+	for off := int64(0); off < size; off += BTreePageSize {
+		img = append(img, s.Read(off, int(min(BTreePageSize, size-off)))...)
+	}
+	return img
+}
+
+// applyWrites 在 img 的副本上执行写入
+func applyWrites(img []byte, writes ...crashEvent) []byte {
+	img = bytes.Clone(img)
+	for _, w := range writes {
+		if end := int(w.offset) + len(w.data); end > len(img) {
+			img = append(img, make([]byte, end-len(img))...)
+		}
+		copy(img[w.offset:], w.data)
+	}
+	return img
+}
+
+// sectorSize 小于一个扇区的写入可能只写入了一部分
+const sectorSize = 512
+
+// crashImages 枚举从 base 开始执行 events 的过程中，每个时刻断电后磁盘上可能的内容：
+// 已经 sync 的写入全部生效，之后的写入生效任意前缀。
+// tear 为真时，前缀之后的那次小写入还可能只写入了一部分。
+func crashImages(base []byte, events []crashEvent, tear bool, fn func(img []byte, desc string)) {
+	durable := base
+	var pending []crashEvent
+	crash := func(epoch int) {
+		for i := 0; i <= len(pending); i++ {
+			img := applyWrites(durable, pending[:i]...)
+			fn(img, fmt.Sprintf("epoch %d, %d writes", epoch, i))
+			if !tear || i == len(pending) || len(pending[i].data) >= sectorSize {
+				continue
+			}
+			w := pending[i]
+			for n := 1; n < len(w.data); n++ {
+				torn := crashEvent{offset: w.offset, data: w.data[:n]}
+				fn(applyWrites(img, torn), fmt.Sprintf("epoch %d, %d writes, torn at %d", epoch, i, n))
+			}
+		}
+	}
+	epoch := 0
+	for _, ev := range events {
+		if ev.data != nil {
+			pending = append(pending, ev)
+			continue
+		}
+		crash(epoch)
+		durable = applyWrites(durable, pending...)
+		pending = nil
+		epoch++
+	}
+	crash(epoch)
+}
+
+// crashCheck 打开断电后的镜像，树必须等于提交前或提交后的内容
+func crashCheck(t *testing.T, img []byte, desc string, refs ...map[string]string) {
+	store := &FaultStorage{Storage: &MemStorage{}}
+	is.NoError(t, store.Open())
+	is.NoError(t, store.Write(0, img))
+	d := &D{store: store}
+	d.db.Store = store
+	err := d.db.Open()
+	is.NoError(t, err, desc)
+	defer d.dispose()
+	crashMatch(t, d, desc, refs...)
+}
+
+// crashMatch 断电后打开的树必须等于 refs 中的一个
+func crashMatch(t *testing.T, d *D, desc string, refs ...map[string]string) {
+	keys, vals := d.dump()
+	got := map[string]string{}
+	for i := range keys {
+		got[keys[i]] = vals[i]
+	}
+	for _, ref := range refs {
+		if maps.Equal(ref, got) {
+			d.ref = ref
+			d.verify(t) // 每个页面恰好被引用一次
+			return
+		}
+	}
+	t.Fatalf("%s: unexpected content after crash", desc)
+}
+
+// funcTestKVCrash 在每次提交的每个写入和 sync 处模拟断电
+func funcTestKVCrash(t *testing.T, tear bool) {
+	store := &crashStorage{}
+	c := &D{ref: map[string]string{}}
+	c.db.Store = store
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	c.add("k", "v")
+
+	nImages := 0
+	for round := 0; round < heavy(40, 10); round++ {
+		pre := maps.Clone(c.ref)
+		base := storageImage(store)
+		store.events = nil
+
+		tx := c.db.Begin()
+		nOps := 1 + int(fmix32(uint32(round))%20)
+		for i := 0; i < nOps; i++ {
+			r := fmix32(uint32(round*100 + i))
+			key := fmt.Sprintf("key%d", r%300)
+			if r%4 == 0 {
+				tx.Del([]byte(key))
+				delete(c.ref, key)
+			} else {
+				n := 1 + int(r%500)
+				if r%7 == 0 {
+					n = BTreeMaxValSize + int(r%(2*BTreePageSize)) // 溢出页
+				}
+				val := fmt.Sprintf("%0*d", n, round)
+				tx.Set([]byte(key), []byte(val))
+				c.ref[key] = val
+			}
+		}
+		is.NoError(t, tx.Commit())
+		c.verify(t)
+
+		crashImages(base, store.events, tear, func(img []byte, desc string) {
+			crashCheck(t, img, fmt.Sprintf("round %d, %s", round, desc), pre, c.ref)
+			nImages++
+		})
+	}
+	t.Logf("%d crash images checked", nImages)
+}
+
+func TestKVCrash(t *testing.T) {
+	funcTestKVCrash(t, false)
+}
+
+func TestKVCrashTornMeta(t *testing.T) {
+	funcTestKVCrash(t, true)
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// 持久化模式，见 KV.Durability
+// 除 DurabilityNone 外，崩溃之后数据库总是一致的，恢复到某一次提交之后的状态；
+// 模式决定的是可能丢失多少次已经返回的提交。
+const (
+	// 写入页面之后 sync，写入 meta 之后再 sync 一次。
+	// Commit 返回时提交已经持久化。
+	DurabilityFull = 0
+	// 只在写入 meta 之前 sync 一次，meta 在下一次提交或 Sync 时才持久化。
+	// 崩溃时可能丢失最后一次提交。
+	DurabilitySingle = 1
+	// 提交时只写入页面，每 SyncInterval 或每 SyncCommits 次提交一起写入 meta 并 sync 两次。
+	// 崩溃时（包括进程崩溃）可能丢失最后一次 sync 之后的所有提交。
+	DurabilityPeriodic = 2
+	// 只在 Sync 和 Close 时 sync。进程崩溃不丢失提交（写入已经在操作系统的页缓存中），
+	// 系统崩溃或断电之后文件可能损坏。
+	DurabilityNone = 3
+)
+
+// SyncStats 持久化的统计信息
+type SyncStats struct {
+	Commits  uint64 // 成功的提交次数
+	Pending  uint64 // 已经提交但还没有持久化的次数
+	Fsyncs   uint64 // fsync 的次数，包括日志和失败的
+	Failures uint64 // 失败的 fsync 次数
+}
+
+// SyncStats 返回持久化的统计信息
+func (db *KV) SyncStats() SyncStats {
+	s := &db.durable.stats
+	commits := s.commits.Load()
+	return SyncStats{
+		Commits:  commits,
+		Pending:  commits - s.durable.Load(),
+		Fsyncs:   s.fsyncs.Load(),
+		Failures: s.failures.Load(),
+	}
+}
+
+// fsync 持久化之前的所有写入并计数
+func fsync(db *KV) error {
+	return syncStorage(db, db.Store)
+}
+
+// fsyncPhase 持久化并记录提交阶段的耗时
+func fsyncPhase(db *KV, phase int) error {
+	defer observe(db, phase, time.Now())
+	return fsync(db)
+}
+
+// syncStorage 持久化主文件或日志并计数
+func syncStorage(db *KV, s Storage) error {
+	db.durable.stats.fsyncs.Add(1)
+	err := s.Sync()
+	if err != nil {
+		db.durable.stats.failures.Add(1)
+	}
+	return err
+}
+
+// markDurable 记录最后一次持久化的 meta，之前的提交释放的页面才可以复用
+func markDurable(db *KV, meta []byte, commits uint64) {
+	db.durable.meta = meta
+	db.durable.stats.durable.Store(commits)
+}
+
+// durableSeq 返回最后一次持久化时 freelist 的 tailSeq
+// 之后释放的页面仍然被磁盘上的树引用，不能被覆盖。
+func durableSeq(db *KV) uint64 {
+	return binary.LittleEndian.Uint64(db.durable.meta[40:])
+}
+
+// commitFile 按持久化模式写入一次提交
+func commitFile(db *KV) error {
+	n := db.durable.stats.commits.Load() + 1
+	if db.WAL {
+		return walCommit(db, n)
+	}
+	if db.Durability == DurabilityFull {
+		if err := updateFile(db); err != nil {
+			return err
+		}
+		markDurable(db, saveMeta(db), n)
+		db.durable.stats.commits.Store(n)
+		return nil
+	}
+
+	if err := writePages(db); err != nil {
+		return err
+	}
+	switch db.Durability {
+	case DurabilitySingle:
+		// 上一次提交的 meta 也随之持久化
+		if err := fsyncPhase(db, phaseSyncPages); err != nil {
+			return syncFailed(db, err)
+		}
+		if w := &db.durable.written; w.meta != nil {
+			markDurable(db, w.meta, w.commits)
+		}
+		if err := updateRoot(db); err != nil {
+			return err
+		}
+		db.durable.written.meta, db.durable.written.commits = saveMeta(db), n
+	case DurabilityPeriodic:
+		if db.SyncCommits > 0 && n-db.durable.stats.durable.Load() >= uint64(db.SyncCommits) {
+			if err := syncPeriodic(db, n); err != nil {
+				return err
+			}
+		}
+	case DurabilityNone:
+		if err := updateRoot(db); err != nil {
+			return err
+		}
+		// 没有 sync，页面的复用不受限制
+		markDurable(db, saveMeta(db), n)
+	}
+	db.durable.stats.commits.Store(n)
+	publish(db)
+	return nil
+}
+
+// syncPeriodic 持久化前 n 次提交：页面 sync 之后才写入 meta
+func syncPeriodic(db *KV, n uint64) error {
+	if err := fsyncPhase(db, phaseSyncPages); err != nil {
+		return syncFailed(db, err)
+	}
+	if err := updateRoot(db); err != nil {
+		return err
+	}
+	if err := fsyncPhase(db, phaseSyncMeta); err != nil {
+		return syncFailed(db, err)
+	}
+	markDurable(db, saveMeta(db), n)
+	return nil
+}
+
+// syncFailed 延迟持久化的模式中 sync 失败
+// 失败的 fsync 可能丢弃了之前的提交写入的页面，内存中的状态不再可信，
+// 之后的写事务都返回这个错误，重新打开数据库恢复到最后一次持久化的状态。
+func syncFailed(db *KV, err error) error {
+	db.durable.err = fmt.Errorf("sync failed, reopen the database: %w", err)
+	return db.durable.err
+}
+
+// Sync 持久化之前的所有提交
+func (db *KV) Sync() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	return syncAll(db)
+}
+
+// syncAll 持久化之前的所有提交，调用者持有写锁
+func syncAll(db *KV) error {
+	if db.durable.err != nil {
+		return db.durable.err
+	}
+	switch db.Durability {
+	case DurabilitySingle:
+		w := &db.durable.written
+		if w.meta == nil {
+			return nil
+		}
+		if err := fsync(db); err != nil {
+			return syncFailed(db, err)
+		}
+		markDurable(db, w.meta, w.commits)
+		w.meta = nil
+	case DurabilityPeriodic:
+		if n := db.durable.stats.commits.Load(); n != db.durable.stats.durable.Load() {
+			return syncPeriodic(db, n)
+		}
+	case DurabilityNone:
+		return fsync(db)
+	}
+	return nil
+}
+
+// syncLoop DurabilityPeriodic 的后台 sync，每 SyncInterval 运行一次
+func syncLoop(db *KV, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(db.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_ = db.Sync() // 错误见 SyncStats 和之后的写事务
+		}
+	}
+}
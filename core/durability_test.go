@@ -0,0 +1,194 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"testing"
+	"time"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// newDurableD 创建使用指定持久化模式的测试 DB
+func newDurableD(t *testing.T, mode int, syncCommits int) *D {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, Durability: mode, SyncCommits: syncCommits}
+	is.NoError(t, c.db.Open())
+	return c
+}
+
+func TestDurabilityStats(t *testing.T) {
+	stats := func(c *D) (uint64, uint64, uint64) {
+		s := c.db.SyncStats()
+		return s.Commits, s.Pending, s.Fsyncs
+	}
+
+	c := newDurableD(t, DurabilityFull, 0)
+	_, _, base := stats(c)
+	c.add("a", "1")
+	c.add("b", "2")
+	commits, pending, fsyncs := stats(c)
+	is.Equal(t, []uint64{2, 0, 4}, []uint64{commits, pending, fsyncs - base})
+	is.NoError(t, c.db.Sync())
+	_, _, fsyncs = stats(c)
+	is.Equal(t, uint64(4), fsyncs-base)
+	c.dispose()
+
+	// 每次提交一次 fsync，最后一次提交的 meta 在 Sync 时持久化
+	c = newDurableD(t, DurabilitySingle, 0)
+	_, _, base = stats(c)
+	c.add("a", "1")
+	c.add("b", "2")
+	commits, pending, fsyncs = stats(c)
+	is.Equal(t, []uint64{2, 1, 2}, []uint64{commits, pending, fsyncs - base})
+	is.NoError(t, c.db.Sync())
+	is.NoError(t, c.db.Sync())
+	commits, pending, fsyncs = stats(c)
+	is.Equal(t, []uint64{2, 0, 3}, []uint64{commits, pending, fsyncs - base})
+	c.verify(t)
+	c.dispose()
+
+	// 每 5 次提交 sync 两次
+	c = newDurableD(t, DurabilityPeriodic, 5)
+	_, _, base = stats(c)
+	for i := 0; i < 4; i++ {
+		c.add(fmt.Sprint(i), "v")
+	}
+	commits, pending, fsyncs = stats(c)
+	is.Equal(t, []uint64{4, 4, 0}, []uint64{commits, pending, fsyncs - base})
+	c.add("4", "v")
+	commits, pending, fsyncs = stats(c)
+	is.Equal(t, []uint64{5, 0, 2}, []uint64{commits, pending, fsyncs - base})
+	c.add("5", "v")
+	is.NoError(t, c.db.Sync())
+	commits, pending, fsyncs = stats(c)
+	is.Equal(t, []uint64{6, 0, 4}, []uint64{commits, pending, fsyncs - base})
+	c.verify(t)
+	c.reopen()
+	c.verify(t)
+	c.dispose()
+
+	// 只在 Sync 时 sync
+	c = newDurableD(t, DurabilityNone, 0)
+	_, _, base = stats(c)
+	for i := 0; i < 10; i++ {
+		c.add(fmt.Sprint(i), "v")
+	}
+	_, _, fsyncs = stats(c)
+	is.Equal(t, base, fsyncs)
+	is.NoError(t, c.db.Sync())
+	_, _, fsyncs = stats(c)
+	is.Equal(t, base+1, fsyncs)
+	c.reopen()
+	c.verify(t)
+	c.dispose()
+
+	db := KV{Store: &MemStorage{}, Durability: 99}
+	is.Error(t, db.Open())
+}
+
+func TestDurabilityInterval(t *testing.T) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, Durability: DurabilityPeriodic, SyncInterval: 5 * time.Millisecond}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+
+	c.add("k", "v")
+	deadline := time.Now().Add(5 * time.Second)
+	for c.db.SyncStats().Pending > 0 {
+		is.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+	c.add("k2", "v")
+	c.reopen()
+	c.verify(t)
+}
+
+func TestDurabilitySyncErr(t *testing.T) {
+	c := newDurableD(t, DurabilitySingle, 0)
+	defer c.dispose()
+	c.add("a", "1")
+	c.add("b", "2")
+
+	syncErr := errors.New("fsync error")
+	c.store.SyncErr = func() error { return syncErr }
+	_, err := c.db.Set([]byte("c"), []byte("3"))
+	is.True(t, errors.Is(err, syncErr))
+	is.Equal(t, uint64(1), c.db.SyncStats().Failures)
+	c.store.SyncErr = nil
+
+	// 之后的写入都失败，读取不受影响
+	_, err = c.db.Set([]byte("d"), []byte("4"))
+	is.True(t, errors.Is(err, syncErr))
+	is.True(t, errors.Is(c.db.Sync(), syncErr))
+	c.verify(t)
+
+	// 重新打开之后恢复
+	c.reopen()
+	c.verify(t)
+	c.add("c", "3")
+	c.verify(t)
+}
+
+// funcTestDurabilityCrash 在一系列提交的每个写入和 sync 处模拟断电，
+// 磁盘上的内容必须等于某一次提交之后的内容，只包含已经 sync 的写入时等于最后一次持久化的提交
+func funcTestDurabilityCrash(t *testing.T, mode int) {
+	store := &crashStorage{}
+	c := &D{ref: map[string]string{}}
+	c.db = KV{Store: store, Durability: mode, SyncCommits: 4}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	c.add("k", "v")
+	is.NoError(t, c.db.Sync())
+	base := storageImage(store)
+	store.events = nil
+
+	history := []map[string]string{maps.Clone(c.ref)}
+	for round := 0; round < 15; round++ {
+		tx := c.db.Begin()
+		for i := 0; i < 1+int(fmix32(uint32(round))%10); i++ {
+			r := fmix32(uint32(round*100 + i))
+			key := fmt.Sprintf("key%d", r%50)
+			if r%4 == 0 {
+				tx.Del([]byte(key))
+				delete(c.ref, key)
+			} else {
+				n := 1 + int(r%500)
+				if r%7 == 0 {
+					n = BTreeMaxValSize + int(r%(2*BTreePageSize)) // 溢出页
+				}
+				val := fmt.Sprintf("%0*d", n, round)
+				tx.Set([]byte(key), []byte(val))
+				c.ref[key] = val
+			}
+		}
+		is.NoError(t, tx.Commit())
+		c.verify(t)
+		history = append(history, maps.Clone(c.ref))
+	}
+
+	crashImages(base, store.events, false, func(img []byte, desc string) {
+		crashCheck(t, img, desc, history...)
+	})
+
+	// 已经 sync 的写入恢复最后一次持久化的提交
+	synced := base
+	var pending []crashEvent
+	for _, ev := range store.events {
+		if ev.data == nil {
+			synced = applyWrites(synced, pending...)
+			pending = nil
+		} else {
+			pending = append(pending, ev)
+		}
+	}
+	n := len(history) - 1 - int(c.db.SyncStats().Pending)
+	crashCheck(t, synced, "synced", history[n])
+}
+
+func TestDurabilityCrash(t *testing.T) {
+	funcTestDurabilityCrash(t, DurabilityFull)
+	funcTestDurabilityCrash(t, DurabilitySingle)
+	funcTestDurabilityCrash(t, DurabilityPeriodic)
+}
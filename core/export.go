@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExportNode 导出的一个 B 树结点，Kids 按键的顺序排列
+type ExportNode struct {
+	Ptr     uint64        `json:"ptr"`
+	Type    string        `json:"type"` // "node" 或 "leaf"
+	NKeys   uint16        `json:"nkeys"`
+	Fill    float64       `json:"fill"`              // 结点大小占页面的比例
+	First   string        `json:"first"`             // 第一个键，按 Go 的字符串转义
+	Last    string        `json:"last"`              // 最后一个键
+	Pending bool          `json:"pending,omitempty"` // 页面在 page.updates 中，还没有写入
+	Omitted uint16        `json:"omitted,omitempty"` // 超过深度限制没有导出的子结点数
+	Kids    []*ExportNode `json:"kids,omitempty"`
+}
+
+// exportKey 转义键中不可打印的字节
+func exportKey(key []byte) string {
+	s := strconv.Quote(string(key))
+	return s[1 : len(s)-1]
+}
+
+// exportNode 从 ptr 开始导出子树，根的深度为 1，maxDepth 为 0 时不限制深度
+func exportNode(tree *BTree, ptr uint64, depth, maxDepth int, pending map[uint64][]byte) *ExportNode {
+	node := BNode(tree.get(ptr))
+	n := node.nKeys()
+	e := &ExportNode{
+		Ptr:   ptr,
+		Type:  "leaf",
+		NKeys: n,
+		Fill:  float64(node.nBytes()) / float64(tree.pageSize),
+	}
+	_, e.Pending = pending[ptr]
+	if n > 0 {
+		e.First, e.Last = exportKey(node.getKey(0)), exportKey(node.getKey(n-1))
+	}
+	if node.bType() != BNodeNode {
+		return e
+	}
+	e.Type = "node"
+	if maxDepth > 0 && depth >= maxDepth {
+		e.Omitted = n
+		return e
+	}
+	for i := uint16(0); i < n; i++ {
+		e.Kids = append(e.Kids, exportNode(tree, node.getPtr(i), depth+1, maxDepth, pending))
+	}
+	return e
+}
+
+// ExportTree 导出最新提交的树，最多 maxDepth 层（为 0 时不限制），空树返回 nil
+func (db *KV) ExportTree(maxDepth int) (e *ExportNode, err error) {
+	r := db.BeginRead()
+	defer r.EndRead()
+	defer recoverCorrupt(&err)
+	if r.tree.root == 0 {
+		return nil, nil
+	}
+	return exportNode(&r.tree, r.tree.root, 1, maxDepth, nil), nil
+}
+
+// ExportTree 导出事务中的树，本事务修改之后还没有写入的页面标记为 Pending
+func (tx *KVTX) ExportTree(maxDepth int) (e *ExportNode, err error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	defer recoverCorrupt(&err)
+	tree := &tx.db.tree
+	if tree.root == 0 {
+		return nil, nil
+	}
+	return exportNode(tree, tree.root, 1, maxDepth, tx.db.page.updates), nil
+}
+
+// WriteDOT 以 Graphviz 的 DOT 格式输出树，Pending 的页面高亮显示，e 为 nil 时输出空图
+func (e *ExportNode) WriteDOT(w io.Writer) error {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	var b strings.Builder
+	b.WriteString("digraph btree {\n\tnode [shape=box, fontname=monospace];\n")
+	var walk func(e *ExportNode)
+	walk = func(e *ExportNode) {
+		label := []string{
+			fmt.Sprintf("page %d %s", e.Ptr, e.Type),
+			fmt.Sprintf("%d keys, %.0f%% full", e.NKeys, e.Fill*100),
+			escape.Replace(fmt.Sprintf("[%s, %s]", e.First, e.Last)),
+		}
+		fmt.Fprintf(&b, "\tp%d [label=\"%s\"", e.Ptr, strings.Join(label, `\n`))
+		if e.Pending {
+			b.WriteString(`, style=filled, fillcolor="#ffd966"`)
+		}
+		b.WriteString("];\n")
+		for _, kid := range e.Kids {
+			fmt.Fprintf(&b, "\tp%d -> p%d;\n", e.Ptr, kid.Ptr)
+			walk(kid)
+		}
+		if e.Omitted > 0 {
+			fmt.Fprintf(&b, "\tp%d_more [shape=plaintext, label=\"%d more\"];\n", e.Ptr, e.Omitted)
+			fmt.Fprintf(&b, "\tp%d -> p%d_more [style=dashed];\n", e.Ptr, e.Ptr)
+		}
+	}
+	if e != nil {
+		walk(e)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
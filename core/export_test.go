@@ -0,0 +1,95 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// exportCount 返回导出的结点数和其中 Pending 的结点数
+func exportCount(e *ExportNode) (nodes, pending int) {
+	nodes = 1
+	if e.Pending {
+		pending = 1
+	}
+	for _, kid := range e.Kids {
+		n, p := exportCount(kid)
+		nodes, pending = nodes+n, pending+p
+	}
+	return
+}
+
+func TestExport(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	root, err := c.db.ExportTree(0)
+	is.NoError(t, err)
+	is.Nil(t, root)
+	var buf bytes.Buffer
+	is.NoError(t, root.WriteDOT(&buf))
+	is.Equal(t, "digraph btree {\n\tnode [shape=box, fontname=monospace];\n}\n", buf.String())
+
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("key%05d", i), bigVal("v", i%200))
+	}
+	c.add(`quote"back\slash`, "v")
+	levels, err := c.db.TreeLevels()
+	is.NoError(t, err)
+	is.True(t, len(levels) >= 2)
+
+	root, err = c.db.ExportTree(0)
+	is.NoError(t, err)
+	nodes, pending := exportCount(root)
+	total := 0
+	for _, level := range levels {
+		total += int(level.Nodes)
+	}
+	is.Equal(t, total, nodes)
+	is.Zero(t, pending)
+	is.Equal(t, "node", root.Type)
+	is.Equal(t, "", root.First)
+	last := root
+	for len(last.Kids) > 0 {
+		last = last.Kids[len(last.Kids)-1]
+	}
+	is.Equal(t, `quote\"back\\slash`, last.Last)
+	for i, kid := range root.Kids {
+		is.True(t, kid.Fill > 0 && kid.Fill <= 1)
+		if i > 0 {
+			is.True(t, root.Kids[i-1].Last < kid.First)
+		}
+	}
+
+	// 深度限制
+	top, err := c.db.ExportTree(1)
+	is.NoError(t, err)
+	is.Empty(t, top.Kids)
+	is.Equal(t, root.NKeys, top.Omitted)
+	out, err := json.Marshal(top)
+	is.NoError(t, err)
+	is.Contains(t, string(out), fmt.Sprintf(`"omitted":%d`, top.Omitted))
+	buf.Reset()
+	is.NoError(t, top.WriteDOT(&buf))
+	is.Contains(t, buf.String(), fmt.Sprintf(`label="%d more"`, top.Omitted))
+
+	// 事务中修改过的页面还没有写入
+	tx := c.db.Begin()
+	_, err = tx.Set([]byte("key00100"), []byte("new"))
+	is.NoError(t, err)
+	root, err = tx.ExportTree(0)
+	is.NoError(t, err)
+	_, pending = exportCount(root)
+	is.Equal(t, len(levels), pending) // 从根到叶子的路径
+	is.True(t, root.Pending)
+	buf.Reset()
+	is.NoError(t, root.WriteDOT(&buf))
+	dot := buf.String()
+	is.Equal(t, pending, strings.Count(dot, "fillcolor"))
+	is.Equal(t, nodes-1, strings.Count(dot, " -> "))
+	is.Contains(t, dot, `quote\\\"back\\\\slash`)
+	tx.Abort()
+}
@@ -2,48 +2,71 @@ package core
 
 import (
 	"encoding/binary"
+	"encoding/json"
 
 	"db-practice/util"
 )
 
 // LNode
-// | next | pointers | unused |
-// |  8B  |   n*8B   |  ...   |
+// | type | unused | checksum | next | pointers | unused |
+// |  2B  |   2B   |    4B    |  8B  |   n*8B   |  ...   |
+// type 和 checksum 与 BNode 的位置相同
 type LNode []byte
 
-const FreeListHeader = 8
-const FreeListCap = (BTreePageSize - FreeListHeader) / 8
+const FreeListHeader = 16
+const FreeListCap = (BTreePageSize - FreeListHeader) / 8 // 默认页面大小下每个结点的指针数量
+
+// setHeader 设置结点类型
+func (node LNode) setHeader() {
+	binary.LittleEndian.PutUint16(node, BNodeFree)
+}
 
 // getNext 获取下一个页面的指针
 func (node LNode) getNext() uint64 {
-	return binary.LittleEndian.Uint64(node)
+	return binary.LittleEndian.Uint64(node[8:])
 }
 
 // setNext 设置下一个页面的指针
 func (node LNode) setNext(next uint64) {
-	binary.LittleEndian.PutUint64(node, next)
+	binary.LittleEndian.PutUint64(node[8:], next)
 }
 
 // getPtr 获取第 idx 个指针
 func (node LNode) getPtr(idx int) uint64 {
-	util.Assert(idx >= 0 && idx < FreeListCap)
+	util.Assert(idx >= 0 && FreeListHeader+(idx+1)*8 <= len(node))
 	offset := FreeListHeader + idx*8
 	return binary.LittleEndian.Uint64(node[offset:])
 }
 
 // setPtr 设置第 idx 个指针
 func (node LNode) setPtr(idx int, ptr uint64) {
-	util.Assert(idx >= 0 && idx < FreeListCap)
+	util.Assert(idx >= 0 && FreeListHeader+(idx+1)*8 <= len(node))
 	offset := FreeListHeader + idx*8
 	binary.LittleEndian.PutUint64(node[offset:], ptr)
 }
 
+// String 返回结点信息，pointers 包括已经弹出的和还没有使用的位置
+func (node LNode) String() string {
+	nodeS := struct {
+		Type     string   `json:"type"`
+		Next     uint64   `json:"next"`
+		Pointers []uint64 `json:"pointers"`
+	}{Type: "free", Next: node.getNext()}
+	for i := 0; FreeListHeader+(i+1)*8 <= len(node); i++ {
+		nodeS.Pointers = append(nodeS.Pointers, node.getPtr(i))
+	}
+	marshal, _ := json.Marshal(nodeS)
+	return string(marshal)
+}
+
 // FreeList 空闲页面链表
 type FreeList struct {
 	get func(uint64) []byte
 	new func([]byte) uint64
 	set func(uint64) []byte
 
+	pageSize int // 页面大小，决定每个结点的指针数量
+
 	headPage uint64 // 指向 FreeList 链表头节点的页面 ID
 	headSeq  uint64 // 一个单调递增的序列号，用于索引链表头节点中的空闲页面
 	tailPage uint64
@@ -70,10 +93,10 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	}
 
 	node := LNode(fl.get(fl.headPage))
-	ptr = node.getPtr(seq2idx(fl.headSeq))
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq))
 	fl.headSeq++
 
-	if seq2idx(fl.headSeq) == 0 {
+	if fl.seq2idx(fl.headSeq) == 0 {
 		head, fl.headPage = fl.headPage, node.getNext()
 		util.Assert(fl.headPage != 0)
 	}
@@ -84,15 +107,16 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 // PushTail 添加一个新指针到尾部
 func (fl *FreeList) PushTail(ptr uint64) {
 	// 将其添加到 tail 节点
-	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl.tailSeq), ptr)
+	LNode(fl.set(fl.tailPage)).setPtr(fl.seq2idx(fl.tailSeq), ptr)
 	fl.tailSeq++
 	// 如果 tail 节点已满，则添加新的 tail 节点（列表永远不会为空）
-	if seq2idx(fl.tailSeq) == 0 {
+	if fl.seq2idx(fl.tailSeq) == 0 {
 		// 尝试从列表头重用
 		next, head := flPop(fl)
 		if next == 0 {
-			next = fl.new(make([]byte, BTreePageSize))
+			next = fl.new(make([]byte, fl.pageSize))
 		}
+		LNode(fl.set(next)).setHeader()
 		LNode(fl.set(fl.tailPage)).setNext(next)
 		fl.tailPage = next
 		if head != 0 {
@@ -102,11 +126,46 @@ func (fl *FreeList) PushTail(ptr uint64) {
 	}
 }
 
+// flScan 返回链表中的页面：可以复用的、还不能复用的和链表自身的结点
+func flScan(fl *FreeList) (reuse, keep, nodes []uint64) {
+	ptr := fl.headPage
+	nodes = append(nodes, ptr)
+	for seq := fl.headSeq; seq != fl.tailSeq; {
+		node := LNode(fl.get(ptr))
+		if seq < fl.maxSeq {
+			reuse = append(reuse, node.getPtr(fl.seq2idx(seq)))
+		} else {
+			keep = append(keep, node.getPtr(fl.seq2idx(seq)))
+		}
+		seq++
+		if fl.seq2idx(seq) == 0 {
+			ptr = node.getNext()
+			nodes = append(nodes, ptr)
+		}
+	}
+	return
+}
+
+// flReset 以 head 为唯一的结点重建空链表，序列号从 seq 开始（不小于 tailSeq）
+// 之后放入的页面在这个事务中都不能复用。
+func flReset(fl *FreeList, head uint64, seq uint64) {
+	util.Assert(seq >= fl.tailSeq)
+	LNode(fl.set(head)).setHeader()
+	fl.headPage, fl.tailPage = head, head
+	fl.headSeq, fl.tailSeq, fl.maxSeq = seq, seq, seq
+}
+
 // SetMaxSeq 设置最大序列号
 func (fl *FreeList) SetMaxSeq() {
 	fl.maxSeq = fl.tailSeq
 }
 
+// LimitMaxSeq 限制最大序列号，seq 之后放入的页面可能仍被读者访问，不能被复用
+// Compact 重建链表之后 headSeq 可能大于 seq，这时所有页面都不能复用。
+func (fl *FreeList) LimitMaxSeq(seq uint64) {
+	fl.maxSeq = max(fl.headSeq, min(fl.maxSeq, seq))
+}
+
 // check 检查 FreeList 的完整性
 func (fl *FreeList) check() {
 	util.Assert(fl.headPage != 0 && fl.tailPage != 0)
@@ -114,6 +173,6 @@ func (fl *FreeList) check() {
 }
 
 // seq2idx 返回第 n 个指针的索引
-func seq2idx(seq uint64) int {
-	return int(seq % FreeListCap)
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64((fl.pageSize-FreeListHeader)/8))
 }
@@ -23,6 +23,7 @@ func newL() *L {
 	appendNum := uint64(1000)              // [1000, 10000)
 	return &L{
 		free: FreeList{
+			pageSize: BTreePageSize,
 			get: func(ptr uint64) []byte {
 				util.Assert(pages[ptr] != nil)
 				return pages[ptr]
@@ -51,9 +52,9 @@ func flDump(free *FreeList) (list []uint64, nodes []uint64) {
 	for seq := free.headSeq; seq != free.tailSeq; {
 		util.Assert(ptr != 0)
 		node := LNode(free.get(ptr))
-		list = append(list, node.getPtr(seq2idx(seq)))
+		list = append(list, node.getPtr(free.seq2idx(seq)))
 		seq++
-		if seq2idx(seq) == 0 {
+		if free.seq2idx(seq) == 0 {
 			ptr = node.getNext()
 			nodes = append(nodes, ptr)
 		}
@@ -111,7 +112,7 @@ func (l *L) verify() {
 }
 
 func TestFreeListEmptyFullEmpty(t *testing.T) {
-	for N := 0; N < 2000; N++ {
+	for N := 0; N < 2000; N += heavy(1, 7) {
 		l := newL()
 		for i := 0; i < N; i++ {
 			l.push(10000 + uint64(i))
@@ -135,7 +136,7 @@ func TestFreeListEmptyFullEmpty(t *testing.T) {
 }
 
 func TestFreeListEmptyFullEmpty2(t *testing.T) {
-	for N := 0; N < 2000; N++ {
+	for N := 0; N < 2000; N += heavy(1, 7) {
 		l := newL()
 		for i := 0; i < N; i++ {
 			l.push(10000 + uint64(i))
@@ -158,7 +159,7 @@ func TestFreeListEmptyFullEmpty2(t *testing.T) {
 }
 
 func TestFreeListRandom(t *testing.T) {
-	for N := 0; N < 1000; N++ {
+	for N := 0; N < heavy(1000, 50); N++ {
 		l := newL()
 		for i := 0; i < 2000; i++ {
 			ptr := uint64(10000 + fmix32(uint32(i)))
@@ -0,0 +1,78 @@
+package core
+
+// groupReq 组提交中的一个请求
+type groupReq struct {
+	update  *UpdateReq // 为空时删除 del
+	del     []byte
+	updated bool
+	err     error
+	// 完成时收到 false；收到 true 时由这个请求的调用者提交队列中的请求
+	done chan bool
+}
+
+// groupSubmit 将请求加入队列，等待完成
+// 第一个请求的调用者成为 leader，在一个事务中依次应用队列中的所有请求并只提交一次，
+// 提交期间到达的请求在下一组中提交，由其中第一个请求的调用者继续担任 leader。
+func (db *KV) groupSubmit(req *groupReq) (bool, error) {
+	req.done = make(chan bool, 1)
+	g := &db.group
+	g.mu.Lock()
+	g.queue = append(g.queue, req)
+	lead := !g.leading
+	g.leading = true
+	g.mu.Unlock()
+	if !lead && !<-req.done {
+		return req.updated, req.err
+	}
+
+	g.mu.Lock()
+	reqs := g.queue
+	g.queue = nil
+	g.mu.Unlock()
+	groupCommit(db, reqs)
+	for _, r := range reqs {
+		if r != req {
+			r.done <- false
+		}
+	}
+
+	g.mu.Lock()
+	if len(g.queue) > 0 {
+		g.queue[0].done <- true
+	} else {
+		g.leading = false
+	}
+	g.mu.Unlock()
+	return req.updated, req.err
+}
+
+// groupCommit 按顺序应用一组请求并提交
+// 每个请求有自己的结果，提交失败时没有出错的请求都返回这个错误，
+// updateOrRevert 回滚到这一组开始之前的状态。
+func groupCommit(db *KV, reqs []*groupReq) {
+	tx := db.Begin()
+	changed := false
+	for _, r := range reqs {
+		if r.update == nil {
+			r.updated, r.err = tx.Del(r.del)
+		} else {
+			r.updated, r.err = tx.Update(r.update)
+		}
+		changed = changed || r.updated
+	}
+	if !changed {
+		tx.Abort()
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		for _, r := range reqs {
+			if r.err != nil {
+				continue
+			}
+			r.updated, r.err = false, err
+			if r.update != nil {
+				r.update.Added, r.update.Updated = false, false
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// groupRun 第一个请求在 fsync 中等待，其他的请求都进入队列之后再继续，
+// 返回 fsync 的次数。syncErr 决定第 n 次 fsync 是否失败。
+func groupRun(c *D, syncErr func(n int64) error, first func(), reqs ...func()) int64 {
+	var syncs atomic.Int64
+	started, release := make(chan struct{}), make(chan struct{})
+	c.store.SyncErr = func() error {
+		n := syncs.Add(1)
+		if n == 1 {
+			close(started)
+			<-release
+		}
+		return syncErr(n)
+	}
+	defer func() { c.store.SyncErr = nil }()
+
+	var wg sync.WaitGroup
+	wg.Add(1 + len(reqs))
+	go func() {
+		defer wg.Done()
+		first()
+	}()
+	<-started
+	for _, req := range reqs {
+		go func() {
+			defer wg.Done()
+			req()
+		}()
+	}
+	for {
+		c.db.group.mu.Lock()
+		n := len(c.db.group.queue)
+		c.db.group.mu.Unlock()
+		if n == len(reqs) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	return syncs.Load()
+}
+
+func TestGroupCommit(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.db.GroupCommit = true
+	c.add("old", "v")
+
+	noErr := func(int64) error { return nil }
+	first := func() {
+		updated, err := c.db.Set([]byte("first"), []byte("v"))
+		is.True(t, updated && err == nil)
+	}
+	var reqs []func()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		reqs = append(reqs, func() {
+			updated, err := c.db.Set([]byte(key), []byte(key))
+			is.True(t, updated && err == nil)
+		})
+	}
+	// 每个请求有自己的结果
+	var added atomic.Int64
+	for i := 0; i < 5; i++ {
+		reqs = append(reqs, func() {
+			req := UpdateReq{Key: []byte("dup"), Val: []byte("v"), Mode: ModeInsertOnly}
+			_, err := c.db.Update(&req)
+			is.NoError(t, err)
+			if req.Added {
+				added.Add(1)
+			}
+		})
+	}
+	reqs = append(reqs, func() {
+		_, err := c.db.Set(nil, []byte("v"))
+		is.Equal(t, ErrEmptyKey, err)
+	}, func() {
+		deleted, err := c.db.Del([]byte("old"))
+		is.True(t, deleted && err == nil)
+	}, func() {
+		deleted, err := c.db.Del([]byte("none"))
+		is.True(t, !deleted && err == nil)
+	})
+
+	// 第一个请求单独提交，其他的请求一起提交
+	is.Equal(t, int64(4), groupRun(c, noErr, first, reqs...))
+	is.Equal(t, int64(1), added.Load())
+	delete(c.ref, "old")
+	c.ref["first"], c.ref["dup"] = "v", "v"
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		c.ref[key] = key
+	}
+	c.verify(t)
+	c.reopen()
+	c.verify(t)
+}
+
+func TestGroupCommitErr(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.db.GroupCommit = true
+	c.add("old", "v")
+
+	// 第二组的第一次 fsync 失败
+	syncErr := func(n int64) error {
+		if n == 3 {
+			return errors.New("fsync error")
+		}
+		return nil
+	}
+	first := func() {
+		updated, err := c.db.Set([]byte("first"), []byte("v"))
+		is.True(t, updated && err == nil)
+	}
+	var reqs []func()
+	var failed atomic.Int64
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		reqs = append(reqs, func() {
+			req := UpdateReq{Key: []byte(key), Val: []byte(key)}
+			updated, err := c.db.Update(&req)
+			is.False(t, updated || req.Added || req.Updated)
+			if err != nil && err.Error() == "fsync error" {
+				failed.Add(1)
+			}
+		})
+	}
+	reqs = append(reqs, func() {
+		deleted, err := c.db.Del([]byte("old"))
+		is.False(t, deleted)
+		is.Error(t, err)
+	}, func() {
+		// 自己的错误不被覆盖
+		_, err := c.db.Del(nil)
+		is.Equal(t, ErrEmptyKey, err)
+	})
+	groupRun(c, syncErr, first, reqs...)
+	is.Equal(t, int64(10), failed.Load())
+	c.ref["first"] = "v"
+	c.verify(t)
+
+	// 之后的提交覆盖失败的 meta
+	c.add("k", "v")
+	c.verify(t)
+	c.reopen()
+	c.verify(t)
+}
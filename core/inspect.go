@@ -0,0 +1,146 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// MetaInfo 解码之后的 meta 页面
+type MetaInfo struct {
+	Version  uint64 `json:"version"`
+	PageSize int    `json:"page_size"`
+	Root     uint64 `json:"root_ptr"`
+	Pages    uint64 `json:"page_used"`
+	HeadPage uint64 `json:"head_page"`
+	HeadSeq  uint64 `json:"head_seq"`
+	TailPage uint64 `json:"tail_page"`
+	TailSeq  uint64 `json:"tail_seq"`
+}
+
+// Meta 返回最新提交的 meta
+func (db *KV) Meta() MetaInfo {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.wal.ckpt.Lock() // 后台 checkpoint 修改 version
+	defer db.wal.ckpt.Unlock()
+	return MetaInfo{
+		Version:  db.version,
+		PageSize: db.PageSize,
+		Root:     db.tree.root,
+		Pages:    db.page.flushed,
+		HeadPage: db.free.headPage,
+		HeadSeq:  db.free.headSeq,
+		TailPage: db.free.tailPage,
+		TailSeq:  db.free.tailSeq,
+	}
+}
+
+// PageInfo 解码之后的一个页面
+type PageInfo struct {
+	Ptr      uint64
+	Type     uint16   // BNodeNode 等，meta 页面为 0
+	Checksum bool     // 校验和是否正确
+	JSON     string   // 页面的内容，见 BNode.String、LNode.String 和 ONode.String
+	Keys     [][]byte // B 树结点中完整的键
+}
+
+// Page 解码文件中的一个页面，校验和不正确时仍然解码
+// 页面可能是空闲的，这时内容是它之前的用途。
+func (db *KV) Page(ptr uint64) (PageInfo, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.wal.ckpt.Lock()
+	defer db.wal.ckpt.Unlock()
+	if ptr >= db.page.flushed {
+		return PageInfo{}, fmt.Errorf("page %d out of range [0, %d)", ptr, db.page.flushed)
+	}
+	info := PageInfo{Ptr: ptr}
+	if ptr == 0 {
+		// 最新的 meta 所在的 slot
+		data := db.Store.Read(int64(db.version%2)*metaSlotSize, metaSize)
+		version, pageSize, m, ok := readMeta(data)
+		info.Checksum = ok
+		meta := MetaInfo{Version: version, PageSize: pageSize}
+		if ok {
+			meta.Root = binary.LittleEndian.Uint64(m[0:])
+			meta.Pages = binary.LittleEndian.Uint64(m[8:])
+			meta.HeadPage = binary.LittleEndian.Uint64(m[16:])
+			meta.HeadSeq = binary.LittleEndian.Uint64(m[24:])
+			meta.TailPage = binary.LittleEndian.Uint64(m[32:])
+			meta.TailSeq = binary.LittleEndian.Uint64(m[40:])
+		}
+		marshal, _ := json.Marshal(meta)
+		info.JSON = string(marshal)
+		return info, nil
+	}
+
+	page := pageReadRaw(db, ptr)
+	info.Type = BNode(page).bType()
+	info.Checksum = binary.LittleEndian.Uint32(page[4:]) == pageChecksum(page)
+	switch info.Type {
+	case BNodeNode, BNodeLeaf:
+		node := BNode(page)
+		if err := checkLayout(node); err != nil {
+			return info, fmt.Errorf("%w: page %d: %v", ErrCorrupt, ptr, err)
+		}
+		info.JSON = node.String()
+		for i := uint16(0); i < node.nKeys(); i++ {
+			info.Keys = append(info.Keys, node.getKey(i))
+		}
+	case BNodeFree:
+		info.JSON = LNode(page).String()
+	case BNodeOverflow:
+		info.JSON = ONode(page).String()
+	default:
+		return info, fmt.Errorf("%w: page %d: bad type %d", ErrCorrupt, ptr, info.Type)
+	}
+	return info, nil
+}
+
+// TreeLevel B 树一层的统计
+type TreeLevel struct {
+	Nodes uint64 // 结点数
+	Keys  uint64 // 键数，中间结点的键数就是子结点数
+	Bytes uint64 // 结点使用的字节数，不超过 Nodes 个页面
+}
+
+// TreeLevels 返回最新提交的树从根开始每一层的统计，空树返回 nil
+func (db *KV) TreeLevels() ([]TreeLevel, error) {
+	r := db.BeginRead()
+	defer r.EndRead()
+	return treeWalk(&r.tree, nil)
+}
+
+// treeWalk 遍历整棵树统计每一层，leaf 不为 nil 时对叶子结点中的每个键调用，
+// size 是值的长度（溢出页中的值不读取）
+func treeWalk(tree *BTree, leaf func(key []byte, size uint64)) (levels []TreeLevel, err error) {
+	defer recoverCorrupt(&err)
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := BNode(tree.get(ptr))
+		if depth == len(levels) {
+			levels = append(levels, TreeLevel{})
+		}
+		level := &levels[depth]
+		level.Nodes++
+		level.Keys += uint64(node.nKeys())
+		level.Bytes += uint64(node.nBytes())
+		for i := uint16(0); i < node.nKeys(); i++ {
+			switch {
+			case node.bType() == BNodeNode:
+				walk(node.getPtr(i), depth+1)
+			case leaf == nil:
+			case node.isOverflow(i):
+				size, _ := overflowRef(node.getVal(i))
+				leaf(node.getKey(i), size)
+			default:
+				leaf(node.getKey(i), uint64(node.getValLen(i)))
+			}
+		}
+	}
+	if tree.root != 0 {
+		walk(tree.root, 0)
+	}
+	return levels, nil
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:  "t",
+		Types: []uint32{TypeInt64, TypeBytes},
+		Cols:  []string{"id", "name"},
+		PKeys: 1,
+	}
+	r.create(tdef)
+	for i := 0; i < 2000; i++ {
+		rec := Record{}
+		r.add("t", *rec.AddInt64("id", int64(i)).AddStr("name", []byte(bigVal("n", i%100*i%7000))))
+	}
+
+	meta := r.db.Meta()
+	is.Equal(t, r.db.kv.tree.root, meta.Root)
+	is.Equal(t, r.db.kv.page.flushed, meta.Pages)
+	is.Equal(t, r.db.kv.free.tailSeq, meta.TailSeq)
+	info, err := r.db.Page(0)
+	is.NoError(t, err)
+	is.True(t, info.Checksum)
+	is.Contains(t, info.JSON, fmt.Sprintf(`"root_ptr":%d`, meta.Root))
+
+	// 每个页面都可以解码，树的结点和 Check 的统计一致
+	report, err := r.db.Check()
+	is.NoError(t, err)
+	types := map[uint16]int{}
+	for ptr := uint64(1); ptr < meta.Pages; ptr++ {
+		info, err = r.db.Page(ptr)
+		is.NoError(t, err)
+		is.True(t, info.Checksum)
+		types[info.Type]++
+	}
+	is.NotZero(t, types[BNodeNode])
+	is.NotZero(t, types[BNodeLeaf])
+	is.NotZero(t, types[BNodeOverflow])
+	is.NotZero(t, types[BNodeFree])
+	_, err = r.db.Page(meta.Pages)
+	is.Error(t, err)
+
+	levels, err := r.db.TreeLevels()
+	is.NoError(t, err)
+	is.Equal(t, report.Depth, len(levels))
+	nodes := uint64(0)
+	for i, level := range levels {
+		nodes += level.Nodes
+		is.True(t, level.Bytes <= level.Nodes*BTreePageSize)
+		if i > 0 {
+			is.Equal(t, levels[i-1].Keys, level.Nodes) // 扇出
+		}
+	}
+	is.Equal(t, report.Nodes, nodes)
+	is.Equal(t, report.Keys, levels[len(levels)-1].Keys)
+
+	// 表定义和键的解码
+	tdefs, err := r.db.Tables()
+	is.NoError(t, err)
+	is.Equal(t, []TableDef{*tdef}, tdefs)
+	info, err = r.db.Page(meta.Root)
+	is.NoError(t, err)
+	is.Equal(t, BNodeNode, int(info.Type))
+	is.Empty(t, info.Keys[0]) // 哨兵
+	decoded := 0
+	for _, key := range info.Keys[1:] {
+		if rec, err := tdef.DecodeKey(key); err == nil {
+			is.Equal(t, []string{"id"}, rec.Cols)
+			is.True(t, bytes.Equal(key, encodeKey(nil, tdef.Prefix, rec.Vals)))
+			decoded++
+		}
+	}
+	is.NotZero(t, decoded)
+	_, err = tdef.DecodeKey(encodeKey(nil, TdefTable.Prefix, []Value{{Type: TypeBytes, Str: []byte("t")}}))
+	is.Error(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := DB{Path: path}
+	is.NoError(t, db.Open())
+	is.NoError(t, db.TableNew(&TableDef{
+		Name:  "t",
+		Types: []uint32{TypeInt64},
+		Cols:  []string{"id"},
+		PKeys: 1,
+	}))
+	for i := 0; i < 100; i++ {
+		_, err := db.Insert("t", *(&Record{}).AddInt64("id", int64(i)))
+		is.NoError(t, err)
+	}
+	db.Close()
+	before, err := os.ReadFile(path)
+	is.NoError(t, err)
+
+	// 可以读取，提交修改失败，文件不变
+	db = DB{Path: path, ReadOnly: true}
+	is.NoError(t, db.Open())
+	ok, err := db.Get("t", (&Record{}).AddInt64("id", 5))
+	is.NoError(t, err)
+	is.True(t, ok)
+	_, err = db.Insert("t", *(&Record{}).AddInt64("id", 1000))
+	is.True(t, errors.Is(err, ErrReadOnly))
+	ok, err = db.Get("t", (&Record{}).AddInt64("id", 1000))
+	is.NoError(t, err)
+	is.False(t, ok)
+	is.True(t, errors.Is(db.Compact(), ErrReadOnly))
+	_, err = db.Check()
+	is.NoError(t, err)
+	db.Close()
+	after, err := os.ReadFile(path)
+	is.NoError(t, err)
+	is.True(t, bytes.Equal(before, after))
+
+	// 不存在或者为空的文件不会被创建或初始化
+	kv := KV{Path: filepath.Join(dir, "none.db"), ReadOnly: true}
+	is.Error(t, kv.Open())
+	_, err = os.Stat(kv.Path)
+	is.True(t, os.IsNotExist(err))
+	is.NoError(t, os.WriteFile(filepath.Join(dir, "empty.db"), nil, 0o644))
+	kv = KV{Path: filepath.Join(dir, "empty.db"), ReadOnly: true}
+	is.True(t, errors.Is(kv.Open(), ErrReadOnly))
+	kv = KV{Path: path, ReadOnly: true, WAL: true}
+	is.Error(t, kv.Open())
+	_, err = os.Stat(path + "-wal")
+	is.True(t, os.IsNotExist(err))
+}
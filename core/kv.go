@@ -5,44 +5,137 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
-	"path"
-	"syscall"
+	"hash/crc32"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"db-practice/util"
 )
 
 type KV struct {
 	Path  string
-	Fsync func(int) error
+	Store Storage // 存储后端，为空时使用 Path 对应的文件
+	// 页面大小，只在创建文件时选择，之后记录在 meta 页面中。
+	// 为 0 时新文件使用 BTreePageSize，已有的文件使用记录的值；Open 之后为实际的值。
+	PageSize int
+	// 新写入的结点只存储一次键的公共前缀，已有的结点在修改时才会转换。
+	// 两种格式的结点可以共存，读取时不需要这个选项。
+	PrefixCompression bool
+	// 并发的 Update 和 Del 排队，一组请求只提交一次（两次 fsync），见 groupSubmit。
+	GroupCommit bool
+	// 持久化模式，见 DurabilityFull 等，默认为 DurabilityFull。
+	Durability int
+	// DurabilityPeriodic 时后台 sync 的间隔和每多少次提交 sync 一次，为 0 时不使用。
+	SyncInterval time.Duration
+	SyncCommits  int
+	// 提交时将修改的页面和 meta 追加到日志中，只 fsync 一次日志，不写入主文件，见 walCommit。
+	// 页面在后台 checkpoint 时才写入主文件，之前从内存中读取。只能与 DurabilityFull 一起使用。
+	WAL bool
+	Log Storage // 日志的存储后端，为空时使用 Path 加上 "-wal" 的文件
+	// 日志超过这个大小时唤醒后台 checkpoint，为 0 时使用 WALCheckpointSize；
+	// 小于 0 时只在 Checkpoint 和 Close 时 checkpoint。
+	CheckpointSize int64
+	// 只读打开已经存在的数据库，提交修改时返回 ErrReadOnly。
+	// 与 WAL 一起使用时日志中的提交只读入内存，不写入主文件。
+	ReadOnly bool
 
-	fd   int
 	tree BTree
 	free FreeList
-	mmap struct {
-		total  int      // mmap 大小，可以大于文件大小
-		chunks [][]byte // 多个 mmap，可以是非连续的
-	}
 	page struct {
 		flushed uint64            // 磁盘中数据库总页面数
 		nAppend uint64            // 未刷入磁盘的页面数
 		updates map[uint64][]byte // 内存中待更新的数据
+		fresh   map[uint64]bool   // 本事务中 pageAlloc 分配的页面，没有被任何提交引用
+		reuse   []uint64          // 本事务中分配之后又释放的页面，pageAlloc 优先复用
+	}
+	failed  bool
+	version uint64     // 最新写入的 meta 版本号，只增不减，回滚时也不恢复
+	checked pageBitmap // 已经验证过校验和的页面
+
+	writer sync.Mutex // 单写者：同一时间只有一个写事务
+	snap   struct {
+		mu      sync.Mutex             // 保护快照和读者列表
+		root    uint64                 // 最新提交的根
+		seq     uint64                 // 最新提交时 freelist 的 tailSeq
+		meta    []byte                 // 最新提交的 meta，见 KV.Stats
+		wal     walPages               // 最新提交时日志中的页面
+		readers map[*KVReader]struct{} // 活跃的读事务
+	}
+	group struct {
+		mu      sync.Mutex
+		queue   []*groupReq // 等待提交的请求
+		leading bool        // 有一个调用者正在提交
+	}
+	durable struct {
+		meta    []byte // 最后一次持久化的 meta
+		written struct {
+			meta    []byte // 已经写入但还没有持久化的 meta（DurabilitySingle）
+			commits uint64
+		}
+		err   error         // 延迟持久化的模式中 sync 失败，见 syncFailed
+		stop  chan struct{} // 停止后台 sync
+		done  chan struct{}
+		stats struct {
+			commits  atomic.Uint64
+			durable  atomic.Uint64 // 已经持久化的提交数
+			fsyncs   atomic.Uint64
+			failures atomic.Uint64
+		}
+	}
+	stats struct {
+		pages   atomic.Uint64 // 写入主文件的页面数
+		failed  atomic.Uint64 // 写入失败的提交
+		reverts atomic.Uint64 // 失败之后恢复磁盘上的 meta 的次数
+		// 以下见 KV.MetricsHandler
+		phases      [nPhases]histogram // 提交每个阶段的耗时
+		fileReads   atomic.Uint64      // 从存储（mmap）读取的页面
+		updateReads atomic.Uint64      // 从 page.updates 读取的页面
+		freePops    atomic.Uint64      // pageAlloc 复用 freelist 中的页面
+		appends     atomic.Uint64      // pageAlloc 追加的页面
+		writer      pageCounts         // 写者持有锁时累计，事务结束时合并，见 foldCounts
+	}
+	wal struct {
+		opened bool
+		pages  atomic.Pointer[walPages] // 日志中还没有 checkpoint 的页面，修改时持有 mu
+		ckpt   sync.Mutex               // 同一时间只有一个 checkpoint，也串行化主文件的 Extend
+		mu     sync.Mutex               // 保护以下字段，提交持有它写入日志
+		cond   *sync.Cond               // 日志从头开始、出错或停止时唤醒 walWait
+		offset int64                    // 下一条记录的位置
+		base   uint64                   // 日志开始时主文件 meta 的版本号
+		meta   []byte                   // 最后一条记录的 meta
+		dirty  bool                     // offset 处可能有失败的提交写入的记录，见 walRevert
+		err    error                    // checkpoint 失败，之后的写事务都失败
+		wake   chan struct{}            // 唤醒后台 checkpoint
+		stop   chan struct{}            // 停止后台 checkpoint
+		done   chan struct{}
 	}
-	failed bool
 }
 
 // pageRead 读取一个页面
 func (db *KV) pageRead(ptr uint64) []byte {
 	util.Assert(ptr < db.page.flushed+db.page.nAppend)
 	if node, ok := db.page.updates[ptr]; ok {
+		db.stats.writer.updateReads++
 		return node
 	}
+	db.stats.writer.fileReads++
+	return db.pageReadCommitted(ptr)
+}
+
+// pageReadCommitted 读取已提交的页面，日志中还没有 checkpoint 的页面在内存中
+func (db *KV) pageReadCommitted(ptr uint64) []byte {
+	if page, ok := walLoad(db)[ptr]; ok {
+		return page
+	}
 	return db.pageReadFile(ptr)
 }
 
 // pageAppend 分配一个新页面
 func (db *KV) pageAppend(node []byte) uint64 {
-	util.Assert(len(node) == BTreePageSize)
+	util.Assert(len(node) == db.PageSize)
 	ptr := db.page.flushed + db.page.nAppend
 	db.page.nAppend++
 	util.Assert(db.page.updates[ptr] == nil)
@@ -52,12 +145,49 @@ func (db *KV) pageAppend(node []byte) uint64 {
 
 // pageAlloc 分配一个新页面 先尝试复用
 func (db *KV) pageAlloc(node []byte) uint64 {
-	util.Assert(len(node) == BTreePageSize)
-	if ptr := db.free.PopHead(); ptr != 0 {
+	util.Assert(len(node) == db.PageSize)
+	if n := len(db.page.reuse); n > 0 {
+		ptr := db.page.reuse[n-1]
+		db.page.reuse = db.page.reuse[:n-1]
 		db.page.updates[ptr] = node
 		return ptr
 	}
-	return db.pageAppend(node)
+	ptr := db.free.PopHead()
+	if ptr != 0 {
+		db.stats.writer.freePops++
+		db.page.updates[ptr] = node
+	} else {
+		db.stats.writer.appends++
+		ptr = db.pageAppend(node)
+	}
+	db.page.fresh[ptr] = true
+	return ptr
+}
+
+// pageFree 释放树的页面
+// 本事务分配的页面直接留给本事务复用，事务中的内存和文件增长只取决于修改过的页面；
+// 其他页面可能仍被读者或磁盘上的树引用，放入 freelist。
+func (db *KV) pageFree(ptr uint64) {
+	if db.page.fresh[ptr] {
+		db.page.reuse = append(db.page.reuse, ptr)
+		return
+	}
+	db.free.PushTail(ptr)
+}
+
+// releaseReuse 将本事务没有再复用的页面放入 freelist，提交或重建 freelist 之前调用
+func releaseReuse(db *KV) {
+	for _, ptr := range db.page.reuse {
+		delete(db.page.fresh, ptr)
+		db.free.PushTail(ptr)
+	}
+	db.page.reuse = nil
+}
+
+// resetFresh 事务结束时清空本事务分配的页面
+func resetFresh(db *KV) {
+	db.page.fresh = make(map[uint64]bool)
+	db.page.reuse = nil
 }
 
 // pageWrite 更新一个存在的页面
@@ -66,63 +196,182 @@ func (db *KV) pageWrite(ptr uint64) []byte {
 	if node, ok := db.page.updates[ptr]; ok {
 		return node
 	}
-	node := make([]byte, BTreePageSize)
-	copy(node, db.pageReadFile(ptr))
+	node := make([]byte, db.PageSize)
+	db.stats.writer.fileReads++
+	copy(node, db.pageReadCommitted(ptr))
 	db.page.updates[ptr] = node
 	return node
 }
 
-// pageReadFile 从文件中读取一个页面
+// pageReadFile 从存储中读取一个页面，第一次读取时验证校验和
 func (db *KV) pageReadFile(ptr uint64) []byte {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTreePageSize
-		if ptr < end {
-			offset := BTreePageSize * (ptr - start)
-			return chunk[offset : offset+BTreePageSize]
+	page := db.Store.Read(int64(ptr)*int64(db.PageSize), db.PageSize)
+	if !db.checked.test(ptr) {
+		if binary.LittleEndian.Uint32(page[4:]) != pageChecksum(page) {
+			panic(ErrCorruptPage{Ptr: ptr})
+		}
+		db.checked.set(ptr)
+	}
+	return page
+}
+
+// pageBitmap 以页号为下标的位图，读者可以并发地查询和设置
+// 写者在扩展文件之后调用 grow，超出范围的页面视为没有设置。
+type pageBitmap struct {
+	words atomic.Pointer[[]atomic.Uint64]
+}
+
+// test 返回页面是否已经设置
+func (b *pageBitmap) test(ptr uint64) bool {
+	words := b.words.Load()
+	if words == nil || ptr/64 >= uint64(len(*words)) {
+		return false
+	}
+	return (*words)[ptr/64].Load()&(1<<(ptr%64)) != 0
+}
+
+// set 设置页面，超出范围时忽略
+func (b *pageBitmap) set(ptr uint64) {
+	if words := b.words.Load(); words != nil && ptr/64 < uint64(len(*words)) {
+		(*words)[ptr/64].Or(1 << (ptr % 64))
+	}
+}
+
+// clear 清除页面
+func (b *pageBitmap) clear(ptr uint64) {
+	if words := b.words.Load(); words != nil && ptr/64 < uint64(len(*words)) {
+		(*words)[ptr/64].And(^uint64(1 << (ptr % 64)))
+	}
+}
+
+// grow 扩大到至少容纳 n 个页面，只由写者或者持有 wal.ckpt 的 checkpoint 调用
+// 与 grow 并发的 set 可能丢失，只会导致页面再验证一次。
+func (b *pageBitmap) grow(n uint64) {
+	old := b.words.Load()
+	size := 0
+	if old != nil {
+		size = len(*old)
+	}
+	if uint64(size)*64 >= n {
+		return
+	}
+	words := make([]atomic.Uint64, max(size*2, int((n+63)/64)))
+	for i := 0; i < size; i++ {
+		words[i].Store((*old)[i].Load())
+	}
+	b.words.Store(&words)
+}
+
+// pageChecksum 计算页面的校验和，不包括校验和字段本身
+func pageChecksum(page []byte) uint32 {
+	crc := crc32.ChecksumIEEE(page[:4])
+	return crc32.Update(crc, crc32.IEEETable, page[8:])
+}
+
+var (
+	ErrEmptyKey      = errors.New("empty key")
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrBadCmp        = errors.New("bad cmp")
+	ErrBadOp         = errors.New("bad batch op")
+	ErrCorrupt       = errors.New("corrupt data")
+	ErrNotFound      = errors.New("key not found")
+	ErrPageSize      = errors.New("bad page size")
+	ErrReadOnly      = errors.New("read-only database")
+)
+
+// ErrCorruptPage 页面的校验和不正确
+type ErrCorruptPage struct {
+	Ptr uint64
+}
+
+func (e ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupt page %d", e.Ptr)
+}
+
+// Is 使 errors.Is(err, ErrCorrupt) 成立
+func (e ErrCorruptPage) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// recoverCorrupt 将读取损坏页面时的 panic 转换为错误
+func recoverCorrupt(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(ErrCorruptPage)
+		if !ok {
+			panic(r)
 		}
-		start = end
+		*err = e
 	}
-	panic("bad ptr")
 }
 
 // Open 打开数据库
 func (db *KV) Open() error {
-	if db.Fsync == nil {
-		db.Fsync = syscall.Fsync
+	if db.Store == nil {
+		db.Store = &FileStorage{Path: db.Path, ReadOnly: db.ReadOnly}
+	}
+	if !(DurabilityFull <= db.Durability && db.Durability <= DurabilityNone) {
+		return fmt.Errorf("KV.Open: bad durability mode %d", db.Durability)
 	}
-
 	db.page.updates = make(map[uint64][]byte)
+	db.page.fresh = make(map[uint64]bool)
+	db.checked.words.Store(nil)
+	db.snap.readers = map[*KVReader]struct{}{}
 
+	db.tree.prefix = db.PrefixCompression
 	db.tree.get = db.pageRead
 	db.tree.new = db.pageAlloc
-	db.tree.del = db.free.PushTail
+	db.tree.del = db.pageFree
 
 	db.free.get = db.pageRead
 	db.free.new = db.pageAppend
 	db.free.set = db.pageWrite
 
-	var err error
+	var size int64
 	// 打开或创建 DB 文件
-	if db.fd, err = createFileSync(db.Path); err != nil {
-		return err
+	err := db.Store.Open()
+	if err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	if db.WAL {
+		if err = walOpen(db); err != nil {
+			goto fail
+		}
 	}
 
 	// 获取文件大小
-	fInfo := syscall.Stat_t{}
-	if err = syscall.Fstat(db.fd, &fInfo); err != nil {
+	if size, err = db.Store.Size(); err != nil {
+		goto fail
+	}
+	if db.ReadOnly && size == 0 {
+		err = fmt.Errorf("%w: empty file", ErrReadOnly)
 		goto fail
 	}
 
 	// 创建初始 mmap
-	if err = extendMmap(db, int(fInfo.Size)); err != nil {
+	if err = db.Store.Extend(size); err != nil {
 		goto fail
 	}
 
 	// 阅读 meta 页面
-	if err = readRoot(db, fInfo.Size); err != nil {
+	if err = readRoot(db, size); err != nil {
 		goto fail
 	}
+	db.checked.grow(db.page.flushed)
+	markDurable(db, saveMeta(db), 0)
+	if db.WAL {
+		if err = walReplay(db); err != nil {
+			goto fail
+		}
+	}
+	publish(db)
+	if db.WAL && !db.ReadOnly && db.CheckpointSize >= 0 {
+		walStart(db)
+	}
+	if db.Durability == DurabilityPeriodic && db.SyncInterval > 0 {
+		db.durable.stop, db.durable.done = make(chan struct{}), make(chan struct{})
+		go syncLoop(db, db.durable.stop, db.durable.done)
+	}
 	return nil
 
 fail:
@@ -131,18 +380,38 @@ fail:
 
 }
 
-// Close 关闭数据库
+// setPageSize 设置页面大小
+func setPageSize(db *KV, pageSize int) {
+	db.PageSize = pageSize
+	db.tree.pageSize = pageSize
+	db.free.pageSize = pageSize
+}
+
+// MaxKeySize 返回键的最大长度，由页面大小决定
+func (db *KV) MaxKeySize() int {
+	return maxKeySize(db.PageSize)
+}
+
+// Close 关闭数据库，调用前所有的读事务都必须已经结束
+// 延迟持久化的模式中先持久化之前的所有提交，使用 WAL 时先做一次 checkpoint。
 func (db *KV) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		util.Assert(err == nil)
-	}
-	_ = syscall.Close(db.fd)
+	if db.durable.stop != nil {
+		close(db.durable.stop)
+		<-db.durable.done
+		db.durable.stop = nil
+	}
+	_ = db.Sync()
+	walClose(db)
+	_ = db.Store.Close()
 }
 
 // Get 获取值
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	r := db.BeginRead()
+	defer r.EndRead()
+	val, ok, err := r.Get(key)
+	// 读事务结束后页面可能被回收，返回副本
+	return bytes.Clone(val), ok, err
 }
 
 // Set 设置值
@@ -152,21 +421,31 @@ func (db *KV) Set(key []byte, val []byte) (bool, error) {
 
 // Update 更新值
 func (db *KV) Update(req *UpdateReq) (bool, error) {
-	meta := saveMeta(db)
-	if !db.tree.Update(req) {
-		return false, nil
+	if db.GroupCommit {
+		return db.groupSubmit(&groupReq{update: req})
+	}
+	tx := db.Begin()
+	updated, err := tx.Update(req)
+	if err != nil || !updated {
+		tx.Abort()
+		return false, err
 	}
-	err := updateOrRevert(db, meta)
+	err = tx.Commit()
 	return err == nil, err
 }
 
 // Del 删除值
 func (db *KV) Del(key []byte) (bool, error) {
-	meta := saveMeta(db)
-	if !db.tree.Delete(key) {
-		return false, nil
+	if db.GroupCommit {
+		return db.groupSubmit(&groupReq{del: key})
 	}
-	err := updateOrRevert(db, meta)
+	tx := db.Begin()
+	deleted, err := tx.Del(key)
+	if err != nil || !deleted {
+		tx.Abort()
+		return false, err
+	}
+	err = tx.Commit()
 	return err == nil, err
 }
 
@@ -179,75 +458,90 @@ func updateFile(db *KV) error {
 	if err := writePages(db); err != nil {
 		return err
 	}
-	if err := db.Fsync(db.fd); err != nil {
+	if err := fsyncPhase(db, phaseSyncPages); err != nil {
 		return err
 	}
 	if err := updateRoot(db); err != nil {
 		return err
 	}
-	if err := db.Fsync(db.fd); err != nil {
+	if err := fsyncPhase(db, phaseSyncMeta); err != nil {
 		return err
 	}
-	// 为下一次更新准备freelist
-	db.free.SetMaxSeq()
+	// 新的根已经持久化，之后的读者可以看到
+	publish(db)
 	return nil
 }
 
+// publish 发布最新提交的快照
+func publish(db *KV) {
+	db.snap.mu.Lock()
+	db.snap.root = db.tree.root
+	db.snap.seq = db.free.tailSeq
+	db.snap.meta = saveMeta(db)
+	db.snap.wal = walLoad(db)
+	db.snap.mu.Unlock()
+}
+
 // updateOrRevert 更新或回滚
+// 失败之后磁盘上的 meta 恢复为最后一次持久化的 meta，它引用的页面都没有被覆盖。
 func updateOrRevert(db *KV, meta []byte) error {
-	// 确保 On-Disk Meta 页面与错误后的 In-Memory 页面匹配
-	if db.failed {
-		if _, err := syscall.Pwrite(db.fd, meta, 0); err != nil {
+	err := revertMeta(db, db.durable.meta)
+	if err == nil {
+		err = commitFile(db)
+	}
+	if err != nil {
+		db.failed = true
+		db.stats.failed.Add(1)
+		rollback(db, meta)
+	}
+	return err
+}
+
+// revertMeta 确保 On-Disk Meta 页面与错误后的 In-Memory 页面匹配
+// 失败的提交可能已经写入了更新版本的 meta，用更大的版本号重写已提交的 meta 覆盖它；
+// 使用 WAL 时失败的提交可能已经写入了日志记录，使它失效。
+func revertMeta(db *KV, meta []byte) error {
+	if !db.failed {
+		return nil
+	}
+	if db.WAL {
+		if err := walRevert(db); err != nil {
+			return err
+		}
+	} else {
+		if err := writeMeta(db, meta); err != nil {
 			return fmt.Errorf("rewrite meta page: %w", err)
 		}
-		if err := db.Fsync(db.fd); err != nil {
+		if err := fsync(db); err != nil {
 			return err
 		}
-		db.failed = false
-	}
-	if err := updateFile(db); err != nil {
-		db.failed = true
-		loadMeta(db, meta)
-		db.page.nAppend = 0
-		db.page.updates = make(map[uint64][]byte)
-		return err
 	}
+	db.failed = false
+	db.durable.written.meta = nil // 已经被覆盖
+	db.stats.reverts.Add(1)
 	return nil
 }
 
-// createFileSync 创建文件并同步目录
-func createFileSync(file string) (int, error) {
-	flags := os.O_RDONLY | syscall.O_DIRECTORY
-	dirFd, err := syscall.Open(path.Dir(file), flags, 0o664)
-	if err != nil {
-		return -1, fmt.Errorf("open directory: %w", err)
-	}
-	defer func(fd int) {
-		_ = syscall.Close(fd)
-	}(dirFd)
-
-	flags = os.O_RDWR | os.O_CREATE
-	fd, err := util.Openat(dirFd, path.Base(file), flags, 0o664)
-	if err != nil {
-		return -1, fmt.Errorf("open file: %w", err)
-	}
-	if err = syscall.Fsync(dirFd); err != nil {
-		_ = syscall.Close(fd)
-		return -1, fmt.Errorf("fsync directory: %w", err)
-	}
-	return fd, nil
+// rollback 恢复内存中的 meta 并丢弃未写入的页面（包括 freelist 的修改）
+func rollback(db *KV, meta []byte) {
+	loadMeta(db, meta)
+	db.page.nAppend = 0
+	db.page.updates = make(map[uint64][]byte)
+	resetFresh(db)
 }
 
 // writePages 将内存中的临时页面写入磁盘文件
 func writePages(db *KV) error {
-	size := int(db.page.flushed+db.page.nAppend) * BTreePageSize
-	if err := extendMmap(db, size); err != nil {
+	defer observe(db, phaseWritePages, time.Now())
+	size := int64(db.page.flushed+db.page.nAppend) * int64(db.PageSize)
+	if err := db.Store.Extend(size); err != nil {
 		return err
 	}
+	db.checked.grow(db.page.flushed + db.page.nAppend)
 
-	for ptr, node := range db.page.updates {
-		offset := int64(ptr * BTreePageSize)
-		if _, err := syscall.Pwrite(db.fd, node, offset); err != nil {
+	// 按页号顺序写入，写入顺序是确定的，也更接近顺序写
+	for _, ptr := range slices.Sorted(maps.Keys(db.page.updates)) {
+		if err := writePage(db, ptr, db.page.updates[ptr]); err != nil {
 			return err
 		}
 	}
@@ -255,78 +549,152 @@ func writePages(db *KV) error {
 	db.page.flushed += db.page.nAppend
 	db.page.nAppend = 0
 	db.page.updates = make(map[uint64][]byte)
+	resetFresh(db)
 	return nil
 }
 
-// extendMmap 通过添加新映射来扩展 mmap
-func extendMmap(db *KV, size int) error {
-	if size <= db.mmap.total {
-		return nil
-	}
-	alloc := max(db.mmap.total, 64<<20)
-	for db.mmap.total+alloc < size {
-		// 地址空间翻倍
-		alloc *= 2
+// flushAppended 提前写入事务中追加的页面，减少内存占用（见 BulkLoad）
+// 这些页面在 meta 切换之前不会被引用，写入之后仍然可以通过 pageWrite 修改；
+// 复用的页面可能仍在已提交的 freelist 中，只能在提交时写入。
+func flushAppended(db *KV) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	db.wal.ckpt.Lock()
+	defer db.wal.ckpt.Unlock()
+	size := int64(db.page.flushed+db.page.nAppend) * int64(db.PageSize)
+	if err := db.Store.Extend(size); err != nil {
+		return err
 	}
-
-	chunk, err := syscall.Mmap(db.fd, int64(db.mmap.total), alloc, syscall.PROT_READ, syscall.MAP_SHARED)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+	db.checked.grow(db.page.flushed + db.page.nAppend)
+	for _, ptr := range slices.Sorted(maps.Keys(db.page.updates)) {
+		if ptr < db.page.flushed {
+			continue
+		}
+		if err := writePage(db, ptr, db.page.updates[ptr]); err != nil {
+			return err
+		}
+		delete(db.page.updates, ptr)
 	}
-	db.mmap.total += alloc
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
 	return nil
 }
 
-const DbSig = "BuildYourOwnDB06"
+// writePage 计算校验和并写入一个页面
+func writePage(db *KV, ptr uint64, page []byte) error {
+	binary.LittleEndian.PutUint32(page[4:], pageChecksum(page))
+	db.checked.clear(ptr)
+	db.stats.pages.Add(1)
+	return db.Store.Write(int64(ptr)*int64(db.PageSize), page)
+}
+
+const DbSig = "BuildYourOwnDB09"
 
-// | sig | root_ptr | page_used | head_page | head_seq | tail_page | tail_seq |
-// | 16B |    8B    |    8B     |     8B    |    8B    |     8B    |    8B    |
+// meta 页面中有两个 slot，交替写入，撕裂的写入只会破坏其中一个
+const (
+	metaSlotSize = 512 // 每个 slot 占一个扇区
+	metaSize     = 84
+)
+
+// | root_ptr | page_used | head_page | head_seq | tail_page | tail_seq |
+// |    8B    |    8B     |     8B    |    8B    |     8B    |    8B    |
 // saveMeta 保存元数据到内存
 func saveMeta(db *KV) []byte {
-	var data [64]byte
-	copy(data[:16], DbSig)
-	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
-	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
-	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
-	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
+	var data [48]byte
+	binary.LittleEndian.PutUint64(data[0:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[8:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[16:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[24:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[32:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[40:], db.free.tailSeq)
 	return data[:]
 }
 
 // loadMeta 从内存加载元数据
 func loadMeta(db *KV, data []byte) {
-	db.tree.root = binary.LittleEndian.Uint64(data[16:])
-	db.page.flushed = binary.LittleEndian.Uint64(data[24:])
-	db.free.headPage = binary.LittleEndian.Uint64(data[32:])
-	db.free.headSeq = binary.LittleEndian.Uint64(data[40:])
-	db.free.tailPage = binary.LittleEndian.Uint64(data[48:])
-	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:])
+	db.tree.root = binary.LittleEndian.Uint64(data[0:])
+	db.page.flushed = binary.LittleEndian.Uint64(data[8:])
+	db.free.headPage = binary.LittleEndian.Uint64(data[16:])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[24:])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[32:])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[40:])
+}
+
+// | sig | version | page_size | meta | crc32 |
+// | 16B |   8B    |    8B     | 48B  |  4B   |
+// writeMeta 以新的版本号写入 meta，版本号决定写入哪个 slot
+func writeMeta(db *KV, meta []byte) error {
+	db.version++
+	var data [metaSize]byte
+	copy(data[:16], DbSig)
+	binary.LittleEndian.PutUint64(data[16:], db.version)
+	binary.LittleEndian.PutUint64(data[24:], uint64(db.PageSize))
+	copy(data[32:80], meta)
+	binary.LittleEndian.PutUint32(data[80:], crc32.ChecksumIEEE(data[:80]))
+	return db.Store.Write(int64(db.version%2)*metaSlotSize, data[:])
+}
+
+// readMeta 读取一个 slot，签名或校验和不正确时返回 false
+func readMeta(data []byte) (version uint64, pageSize int, meta []byte, ok bool) {
+	if !bytes.Equal([]byte(DbSig), data[:16]) {
+		return 0, 0, nil, false
+	}
+	if crc32.ChecksumIEEE(data[:80]) != binary.LittleEndian.Uint32(data[80:]) {
+		return 0, 0, nil, false
+	}
+	version = binary.LittleEndian.Uint64(data[16:])
+	pageSize = int(binary.LittleEndian.Uint64(data[24:]))
+	return version, pageSize, data[32:80], true
 }
 
 // readRoot 读取根页面
 func readRoot(db *KV, fileSize int64) error {
-	if fileSize&BTreePageSize != 0 {
-		return fmt.Errorf("file size must be a multiple of %d", BTreePageSize)
-	}
 	if fileSize == 0 {
+		if db.PageSize == 0 {
+			db.PageSize = BTreePageSize
+		}
+		if !validPageSize(db.PageSize) {
+			return fmt.Errorf("%w: %d", ErrPageSize, db.PageSize)
+		}
+		setPageSize(db, db.PageSize)
 		// 保留 2 个页面: meta 页面和 freelist 节点
-		db.page.flushed = 2
+		db.page.flushed = 1
 		// 将初始节点添加到 freelist ，使其永远不会为空
-		db.free.headPage = 1
-		db.free.tailPage = 1
-		return nil
+		node := LNode(make([]byte, db.PageSize))
+		node.setHeader()
+		db.free.headPage = db.pageAppend(node)
+		db.free.tailPage = db.free.headPage
+		// 立即写入文件，之后的事务可以直接修改 freelist 节点
+		return updateFile(db)
+	}
+	if fileSize < MinPageSize {
+		return fmt.Errorf("file size must be at least %d", MinPageSize)
+	}
+	// 选择校验和正确且版本号最大的 slot
+	var meta []byte
+	pageSize := 0
+	for i := int64(0); i < 2; i++ {
+		version, size, data, ok := readMeta(db.Store.Read(i*metaSlotSize, metaSize))
+		if ok && (meta == nil || version > db.version) {
+			db.version, pageSize, meta = version, size, data
+		}
+	}
+	if meta == nil || !validPageSize(pageSize) {
+		return errors.New("bad meta page")
+	}
+	if db.PageSize != 0 && db.PageSize != pageSize {
+		return fmt.Errorf("%w: file uses %d, requested %d", ErrPageSize, pageSize, db.PageSize)
+	}
+	if fileSize%int64(pageSize) != 0 {
+		return fmt.Errorf("file size must be a multiple of %d", pageSize)
 	}
-	data := db.mmap.chunks[0]
-	loadMeta(db, data)
+	setPageSize(db, pageSize)
+	loadMeta(db, meta)
 	db.free.SetMaxSeq()
 
 	// 验证页面是否有效
-	bad := !bytes.Equal([]byte(DbSig), data[:16])
-	maxPages := uint64(fileSize / BTreePageSize)
-	bad = bad || !(0 < db.page.flushed && db.page.flushed <= maxPages)
-	bad = bad || !(0 < db.tree.root && db.tree.root < db.page.flushed)
+	maxPages := uint64(fileSize / int64(pageSize))
+	bad := !(0 < db.page.flushed && db.page.flushed <= maxPages)
+	bad = bad || !(db.tree.root < db.page.flushed) // 空树的 root 为 0
 	bad = bad || !(0 < db.free.headPage && db.free.headPage < db.page.flushed)
 	bad = bad || !(0 < db.free.tailPage && db.free.tailPage < db.page.flushed)
 	if bad {
@@ -337,8 +705,8 @@ func readRoot(db *KV, fileSize int64) error {
 
 // updateRoot 更新根页面
 func updateRoot(db *KV) error {
-	data := saveMeta(db)
-	if _, err := syscall.Pwrite(db.fd, data, 0); err != nil {
+	defer observe(db, phaseUpdateRoot, time.Now())
+	if err := writeMeta(db, saveMeta(db)); err != nil {
 		return fmt.Errorf("write meta page: %w", err)
 	}
 	return nil
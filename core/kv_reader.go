@@ -0,0 +1,177 @@
+package core
+
+import (
+	"bytes"
+
+	"db-practice/util"
+)
+
+// KVReader 只读事务
+// 读者在开始时固定最新提交的 tree.root 和 freelist 的 tailSeq，
+// 在整个生命周期内看到一致的快照。copy-on-write 的 B 树不会修改已提交的页面，
+// 而 FreeList 不会复用读者开始之后释放的页面，所以快照中的页面一直有效。
+// 读者只读取已提交的页面，不会等待写者的 fsync。
+type KVReader struct {
+	db    *KV
+	tree  BTree
+	seq   uint64   // 快照时 freelist 的 tailSeq
+	meta  []byte   // 快照的 meta，见 KV.Stats
+	wal   walPages // 快照时日志中还没有 checkpoint 的页面
+	reads uint64   // 读取的页面数，EndRead 时合并到 KV 的计数
+}
+
+// BeginRead 开始一个读事务
+func (db *KV) BeginRead() *KVReader {
+	r := &KVReader{db: db}
+	db.snap.mu.Lock()
+	r.tree.root = db.snap.root
+	r.tree.pageSize = db.tree.pageSize
+	r.seq = db.snap.seq
+	r.meta = db.snap.meta
+	r.wal = db.snap.wal
+	db.snap.readers[r] = struct{}{}
+	db.snap.mu.Unlock()
+	r.tree.get = r.pageRead
+	return r
+}
+
+// EndRead 结束读事务，之后快照中的页面可能被写者复用
+func (r *KVReader) EndRead() {
+	util.Assert(r.db != nil)
+	r.db.stats.fileReads.Add(r.reads)
+	r.db.snap.mu.Lock()
+	delete(r.db.snap.readers, r)
+	r.db.snap.mu.Unlock()
+	r.db = nil
+}
+
+// pageRead 读取快照中的页面
+func (r *KVReader) pageRead(ptr uint64) []byte {
+	r.reads++
+	if page, ok := r.wal[ptr]; ok {
+		return page
+	}
+	return r.db.pageReadFile(ptr)
+}
+
+// Get 获取值，返回的切片在 EndRead 之前有效
+func (r *KVReader) Get(key []byte) (val []byte, ok bool, err error) {
+	if err = r.tree.checkKey(key); err != nil {
+		return nil, false, err
+	}
+	defer recoverCorrupt(&err)
+	val, ok = r.tree.Get(key)
+	return val, ok, nil
+}
+
+// Seek 返回指向关于 'cmp' 关系的离键最近位置的迭代器，在 EndRead 之前有效
+func (r *KVReader) Seek(key []byte, cmp int) *BIter {
+	return r.tree.Seek(key, cmp)
+}
+
+// readIter 分批读取已提交数据的迭代器，不固定快照
+// 每一批在一个短的读事务中读取并复制，之后从这一批的最后一个键继续查找，
+// 所以不会阻止写者复用页面；不同的批次可能来自不同的提交。
+type readIter struct {
+	db      *KV
+	forward bool
+	keys    [][]byte
+	vals    [][]byte
+	pos     int
+	end     bool  // 已经读到树的末尾
+	next    error // 读取这一批时遇到的错误，读完这一批之后返回
+	err     error
+}
+
+// readBatch 和 readBatchSize 限制一批的键值对数和字节数
+const (
+	readBatch     = 64
+	readBatchSize = 1 << 20
+)
+
+// seekRead 返回分批读取已提交数据的迭代器，只能向 cmp 的方向移动
+func seekRead(db *KV, key []byte, cmp int) *readIter {
+	iter := &readIter{db: db, forward: cmp > 0}
+	readFill(iter, key, cmp)
+	return iter
+}
+
+// readFill 在一个读事务中读取从 key 开始的一批
+func readFill(iter *readIter, key []byte, cmp int) {
+	r := iter.db.BeginRead()
+	defer r.EndRead()
+	iter.keys, iter.vals, iter.pos = nil, nil, 0
+	it := r.Seek(key, cmp)
+	for size := 0; it.Valid() && len(iter.keys) < readBatch && size < readBatchSize; {
+		k, v := it.Deref()
+		if it.Err() != nil {
+			break
+		}
+		iter.keys = append(iter.keys, bytes.Clone(k))
+		iter.vals = append(iter.vals, bytes.Clone(v))
+		size += len(k) + len(v)
+		if iter.forward {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+	iter.end = !it.Valid()
+	iter.next = it.Err()
+	if len(iter.keys) == 0 {
+		iter.err = iter.next
+	}
+}
+
+// Valid 判断迭代器是否有效
+func (iter *readIter) Valid() bool {
+	return iter.pos < len(iter.keys)
+}
+
+// Key 当前的键
+func (iter *readIter) Key() []byte {
+	util.Assert(iter.Valid())
+	return iter.keys[iter.pos]
+}
+
+// Deref 当前的键值对，在迭代器的整个生命周期内有效
+func (iter *readIter) Deref() (key []byte, val []byte) {
+	util.Assert(iter.Valid())
+	return iter.keys[iter.pos], iter.vals[iter.pos]
+}
+
+// Err 返回读取中遇到的错误，出错后迭代器不再有效
+func (iter *readIter) Err() error {
+	return iter.err
+}
+
+// Next 移动到下一个键，只能用于 cmp > 0 的迭代器
+func (iter *readIter) Next() {
+	util.Assert(iter.forward)
+	readAdvance(iter)
+}
+
+// Prev 移动到上一个键，只能用于 cmp < 0 的迭代器
+func (iter *readIter) Prev() {
+	util.Assert(!iter.forward)
+	readAdvance(iter)
+}
+
+// readAdvance 移动到下一个位置，读完这一批之后继续读取下一批
+func readAdvance(iter *readIter) {
+	util.Assert(iter.Valid())
+	iter.pos++
+	if iter.pos < len(iter.keys) {
+		return
+	}
+	switch {
+	case iter.next != nil:
+		iter.err = iter.next
+	case !iter.end:
+		cmp := CmpLt
+		if iter.forward {
+			cmp = CmpGt
+		}
+		readFill(iter, iter.keys[len(iter.keys)-1], cmp)
+	}
+}
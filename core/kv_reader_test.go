@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestKVReaderSnapshot(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	for i := 0; i < 2000; i++ {
+		c.add(fmt.Sprintf("key%d", i), "old")
+	}
+
+	r := c.db.BeginRead()
+	// 写者不断覆盖和删除，如果读者的页面被复用，快照就会被破坏
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if i%2 == 0 {
+				c.del(key)
+			} else {
+				c.add(key, fmt.Sprintf("new%d", round))
+			}
+		}
+		c.verify(t)
+	}
+	for i := 0; i < 2000; i++ {
+		val, ok, err := r.Get([]byte(fmt.Sprintf("key%d", i)))
+		is.NoError(t, err)
+		is.True(t, ok)
+		is.Equal(t, "old", string(val))
+	}
+	n := 0
+	for iter := r.Seek(nil, CmpGt); iter.Valid(); iter.Next() {
+		_, val := iter.Deref()
+		is.Equal(t, "old", string(val))
+		n++
+	}
+	is.Equal(t, 2000, n)
+	r.EndRead()
+
+	// 读者结束后页面可以继续复用
+	for i := 1; i < 2000; i += 2 {
+		c.add(fmt.Sprintf("key%d", i), "x")
+	}
+	size := c.db.page.flushed
+	for i := 1; i < 2000; i += 2 {
+		c.add(fmt.Sprintf("key%d", i), "y")
+	}
+	is.Equal(t, size, c.db.page.flushed)
+
+	// 新的读者看到最新提交的数据
+	r = c.db.BeginRead()
+	val, ok, err := r.Get([]byte("key1"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, "y", string(val))
+	_, ok, err = r.Get([]byte("key0"))
+	is.NoError(t, err)
+	is.False(t, ok)
+	r.EndRead()
+}
+
+func TestKVReaderConcurrent(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	readerConcurrent(t, c)
+}
+
+// readerConcurrent 多个读者与提交并发，每个快照都是一致的
+func readerConcurrent(t *testing.T, c *D) {
+	const nKeys = 200
+	write := func(version int) {
+		tx := c.db.Begin()
+		for i := 0; i < nKeys; i++ {
+			tx.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("v%d", version)))
+		}
+		is.NoError(t, tx.Commit())
+	}
+	write(0)
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// 每个快照中所有的键都来自同一次提交
+				r := c.db.BeginRead()
+				first, ok, err := r.Get([]byte("key0"))
+				is.NoError(t, err)
+				is.True(t, ok)
+				n := 0
+				for iter := r.Seek(nil, CmpGt); iter.Valid(); iter.Next() {
+					_, val := iter.Deref()
+					is.Equal(t, string(first), string(val))
+					n++
+				}
+				is.Equal(t, nKeys, n)
+				r.EndRead()
+			}
+		}()
+	}
+	for v := 1; v < heavy(200, 30); v++ {
+		write(v)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestKVReaderNoBlock(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k", "1")
+
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	c.store.SyncErr = func() error {
+		syncing <- struct{}{}
+		<-release
+		return nil
+	}
+	go func() {
+		_, _ = c.db.Set([]byte("k"), []byte("2"))
+	}()
+
+	// 写者阻塞在 fsync 时读者仍然可以读取已提交的数据
+	<-syncing
+	val, ok, err := c.db.Get([]byte("k"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, "1", string(val))
+	release <- struct{}{}
+	<-syncing
+	val, ok, err = c.db.Get([]byte("k"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, "1", string(val))
+	release <- struct{}{}
+
+	// 等待写者结束
+	tx := c.db.Begin()
+	tx.Abort()
+	c.store.SyncErr = nil
+	val, ok, err = c.db.Get([]byte("k"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, "2", string(val))
+}
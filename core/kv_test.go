@@ -1,9 +1,10 @@
 package core
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
-	"os"
 	"sort"
 	"testing"
 
@@ -14,25 +15,18 @@ import (
 
 // 测试DB
 type D struct {
-	db  KV
-	ref map[string]string
-}
-
-// noFsync 用于测试，不进行fsync操作
-func noFsync(int) error {
-	return nil
+	db    KV
+	store *FaultStorage
+	ref   map[string]string
 }
 
 // newD 创建测试用的DB
 func newD() *D {
-	err := os.Remove("test.db")
-	util.Assert(err == nil || os.IsNotExist(err))
-
 	d := &D{}
 	d.ref = map[string]string{}
-	d.db.Path = "test.db"
-	d.db.Fsync = noFsync // faster
-	err = d.db.Open()
+	d.store = &FaultStorage{Storage: &MemStorage{}}
+	d.db.Store = d.store
+	err := d.db.Open()
 	util.Assert(err == nil)
 	return d
 }
@@ -40,16 +34,14 @@ func newD() *D {
 // reopen 关闭并重新打开DB
 func (d *D) reopen() {
 	d.db.Close()
-	d.db = KV{Path: d.db.Path, Fsync: d.db.Fsync}
+	d.db = KV{Store: d.store}
 	err := d.db.Open()
 	util.Assert(err == nil)
 }
 
-// dispose 关闭并删除DB
+// dispose 关闭DB
 func (d *D) dispose() {
 	d.db.Close()
-	err := os.Remove("test.db")
-	util.Assert(err == nil)
 }
 
 // add 添加键值对
@@ -105,6 +97,15 @@ func (d *D) verify(t *testing.T) {
 		nKeys := node.nKeys()
 		util.Assert(nKeys >= 1)
 		if node.bType() == BNodeLeaf {
+			for i := uint16(0); i < nKeys; i++ {
+				if !node.isOverflow(i) {
+					continue
+				}
+				for _, ptr := range overflowPages(&d.db.tree, node.getVal(i)) {
+					is.Zero(t, pages[ptr])
+					pages[ptr] = 4 // overflow
+				}
+			}
 			return
 		}
 		for i := uint16(0); i < nKeys; i++ {
@@ -137,6 +138,7 @@ func (d *D) verify(t *testing.T) {
 
 // funcTestKVBasic 测试KV的基本功能
 func funcTestKVBasic(t *testing.T, reopen bool) {
+	total, checked := heavy(25000, 5000), heavy(2000, 300)
 	c := newD()
 	defer c.dispose()
 
@@ -144,11 +146,11 @@ func funcTestKVBasic(t *testing.T, reopen bool) {
 	c.verify(t)
 
 	// insert
-	for i := 0; i < 25000; i++ {
+	for i := 0; i < total; i++ {
 		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
 		val := fmt.Sprintf("vvv%d", fmix32(uint32(-i)))
 		c.add(key, val)
-		if i < 2000 {
+		if i < checked {
 			c.verify(t)
 		}
 	}
@@ -160,7 +162,7 @@ func funcTestKVBasic(t *testing.T, reopen bool) {
 	t.Log("insertion done")
 
 	// del
-	for i := 2000; i < 25000; i++ {
+	for i := checked; i < total; i++ {
 		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
 		is.True(t, c.del(key))
 	}
@@ -172,7 +174,7 @@ func funcTestKVBasic(t *testing.T, reopen bool) {
 	t.Log("deletion done")
 
 	// overwrite
-	for i := 0; i < 2000; i++ {
+	for i := 0; i < checked; i++ {
 		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
 		val := fmt.Sprintf("vvv%d", fmix32(uint32(+i)))
 		c.add(key, val)
@@ -182,7 +184,7 @@ func funcTestKVBasic(t *testing.T, reopen bool) {
 	is.False(t, c.del("kk"))
 
 	// remove all
-	for i := 0; i < 2000; i++ {
+	for i := 0; i < checked; i++ {
 		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
 		is.True(t, c.del(key))
 		c.verify(t)
@@ -204,8 +206,8 @@ func TestKVBasic(t *testing.T) {
 }
 
 // fsyncErr 模拟fsync错误
-func fsyncErr(errors ...int) func(int) error {
-	return func(int) error {
+func fsyncErr(errors ...int) func() error {
+	return func() error {
 		fail := errors[0]
 		errors = errors[1:]
 		if fail != 0 {
@@ -225,49 +227,290 @@ func TestKVFsyncErr(t *testing.T) {
 		util.Assert(err == nil || !updated)
 		return err
 	}
-	get := c.db.Get
+	get := func(key []byte) ([]byte, bool) {
+		val, ok, err := c.db.Get(key)
+		util.Assert(err == nil)
+		return val, ok
+	}
 
 	err := set([]byte("k"), []byte("1"))
 	util.Assert(err == nil)
 	val, ok := get([]byte("k"))
 	util.Assert(ok && string(val) == "1")
 
-	c.db.Fsync = fsyncErr(1)
+	c.store.SyncErr = fsyncErr(1)
 	err = set([]byte("k"), []byte("2"))
 	util.Assert(err != nil)
 	val, ok = get([]byte("k"))
 	util.Assert(ok && string(val) == "1")
 
-	c.db.Fsync = noFsync
+	c.store.SyncErr = nil
 	err = set([]byte("k"), []byte("3"))
 	util.Assert(err == nil)
 	val, ok = get([]byte("k"))
 	util.Assert(ok && string(val) == "3")
 
-	c.db.Fsync = fsyncErr(0, 1)
+	c.store.SyncErr = fsyncErr(0, 1)
 	err = set([]byte("k"), []byte("4"))
 	util.Assert(err != nil)
 	val, ok = get([]byte("k"))
 	util.Assert(ok && string(val) == "3")
 
-	c.db.Fsync = noFsync
+	c.store.SyncErr = nil
 	err = set([]byte("k"), []byte("5"))
 	util.Assert(err == nil)
 	val, ok = get([]byte("k"))
 	util.Assert(ok && string(val) == "5")
 
-	c.db.Fsync = fsyncErr(0, 1)
+	c.store.SyncErr = fsyncErr(0, 1)
 	err = set([]byte("k"), []byte("6"))
 	util.Assert(err != nil)
 	val, ok = get([]byte("k"))
 	util.Assert(ok && string(val) == "5")
 }
 
-func TestKVRandLength(t *testing.T) {
+func TestKVMetaSlots(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	c.add("k", "1")
+	c.add("k", "2")
+	// 两个 slot 交替写入
+	version := c.db.version
+	c.add("k", "3")
+	is.Equal(t, version+1, c.db.version)
+
+	// 最新的 slot 损坏时回退到上一次提交
+	slot := int64(c.db.version%2) * metaSlotSize
+	is.NoError(t, c.store.Write(slot+30, []byte{0xff}))
+	c.reopen()
+	is.Equal(t, version, c.db.version)
+	c.ref["k"] = "2"
+	c.verify(t)
+
+	// 回退后继续写入不会覆盖仍然有效的 slot
+	c.add("k", "4")
+	c.reopen()
+	c.verify(t)
+
+	// 两个 slot 都损坏时无法打开
+	is.NoError(t, c.store.Write(30, []byte{0xff}))
+	is.NoError(t, c.store.Write(metaSlotSize+30, []byte{0xff}))
+	c.db.Close()
+	c.db = KV{Store: c.store}
+	is.Error(t, c.db.Open())
+}
+
+// corruptPage 修改存储中页面的一个字节
+func corruptPage(t *testing.T, store Storage, ptr uint64) {
+	offset := int64(ptr*BTreePageSize) + BTreePageSize - 1
+	b := store.Read(offset, 1)[0]
+	is.NoError(t, store.Write(offset, []byte{^b}))
+}
+
+func TestKVCorruptPage(t *testing.T) {
 	c := newD()
 	defer c.dispose()
+	for i := 0; i < 2000; i++ {
+		c.add(fmt.Sprintf("key%d", i), "val")
+	}
 
+	// 损坏第一个叶子结点
+	ptr := c.db.tree.root
+	for BNode(c.db.tree.get(ptr)).bType() == BNodeNode {
+		ptr = BNode(c.db.tree.get(ptr)).getPtr(0)
+	}
+	key := bytes.Clone(BNode(c.db.tree.get(ptr)).getKey(1))
+	corruptPage(t, c.store, ptr)
+	c.reopen()
+
+	_, _, err := c.db.Get(key)
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, err)
+	// 其他页面不受影响
+	val, ok, err := c.db.Get([]byte("key999"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, "val", string(val))
+
+	// 迭代器遇到损坏的页面后不再有效
+	r := c.db.BeginRead()
+	defer r.EndRead()
+	iter := r.Seek(nil, CmpGt)
+	is.False(t, iter.Valid())
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, iter.Err())
+	iter = r.Seek([]byte("key999"), CmpLe)
+	n := 0
+	for ; iter.Valid(); iter.Prev() {
+		n++
+	}
+	is.True(t, n < 2000)
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, iter.Err())
+
+	// 修改损坏的页面时放弃整个事务
+	tx := c.db.Begin()
+	_, err = tx.Set([]byte("key999"), []byte("new"))
+	is.NoError(t, err)
+	_, err = tx.Set(key, []byte("new"))
+	is.True(t, errors.Is(err, ErrCorrupt))
+	_, err = tx.Set([]byte("key998"), []byte("new"))
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, err)
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, tx.Commit())
+	val, _, err = c.db.Get([]byte("key999"))
+	is.NoError(t, err)
+	is.Equal(t, "val", string(val))
+}
+
+func TestPageBitmap(t *testing.T) {
+	var b pageBitmap
+	is.False(t, b.test(0))
+	b.set(0) // 超出范围
+	is.False(t, b.test(0))
+	b.grow(100)
+	b.set(3)
+	b.set(99)
+	is.True(t, b.test(3))
+	is.True(t, b.test(99))
+	is.False(t, b.test(4))
+	is.False(t, b.test(1000))
+	b.grow(1000) // 保留已经设置的页面
+	is.True(t, b.test(3))
+	is.True(t, b.test(99))
+	b.clear(3)
+	is.False(t, b.test(3))
+	is.True(t, b.test(99))
+
+	// 位图的大小跟随文件
+	c := newD()
+	defer c.dispose()
 	for i := 0; i < 2000; i++ {
+		c.add(fmt.Sprintf("key%d", i), "val")
+	}
+	is.True(t, uint64(len(*c.db.checked.words.Load()))*64 >= c.db.page.flushed)
+	is.False(t, c.db.checked.test(c.db.tree.root)) // 写入时清除
+	_, _, err := c.db.Get([]byte("key0"))
+	is.NoError(t, err)
+	is.True(t, c.db.checked.test(c.db.tree.root))
+}
+
+func TestKVInputErr(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k", "v")
+
+	_, err := c.db.Set(nil, []byte("v"))
+	is.Equal(t, ErrEmptyKey, err)
+	_, err = c.db.Set(make([]byte, BTreeMaxKeySize+1), []byte("v"))
+	is.Equal(t, ErrKeyTooLarge, err)
+	_, err = c.db.Set([]byte("k"), make([]byte, MaxValSize+1))
+	is.Equal(t, ErrValueTooLarge, err)
+	_, err = c.db.Del(nil)
+	is.Equal(t, ErrEmptyKey, err)
+	_, err = c.db.Del(make([]byte, BTreeMaxKeySize+1))
+	is.Equal(t, ErrKeyTooLarge, err)
+	// 空键不会读到哨兵
+	_, _, err = c.db.Get(nil)
+	is.Equal(t, ErrEmptyKey, err)
+
+	r := c.db.BeginRead()
+	iter := r.Seek([]byte("k"), 0)
+	is.False(t, iter.Valid())
+	is.Equal(t, ErrBadCmp, iter.Err())
+	r.EndRead()
+
+	// 参数错误不影响事务中的其他修改
+	tx := c.db.Begin()
+	_, err = tx.Set([]byte("k2"), []byte("v2"))
+	is.NoError(t, err)
+	_, err = tx.Set(nil, nil)
+	is.Equal(t, ErrEmptyKey, err)
+	is.NoError(t, tx.Commit())
+	c.ref["k2"] = "v2"
+	c.verify(t)
+}
+
+func TestKVPageSize(t *testing.T) {
+	for _, pageSize := range []int{MinPageSize, 2048, MaxPageSize} {
+		c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+		c.db = KV{Store: c.store, PageSize: pageSize}
+		is.NoError(t, c.db.Open())
+		is.Equal(t, maxKeySize(pageSize), c.db.MaxKeySize())
+
+		var keys []string
+		for i := 0; i < 500; i++ {
+			kLen := 1 + int(fmix32(uint32(2*i+0)))%c.db.MaxKeySize()
+			vLen := int(fmix32(uint32(2*i+1))) % (2 * pageSize) // 部分值存储在溢出页中
+			key := fmt.Sprintf("%0*d", kLen, i)
+			c.add(key, bigVal(key, vLen))
+			keys = append(keys, key)
+		}
+		for i := 0; i < len(keys); i += 3 {
+			is.True(t, c.del(keys[i]))
+		}
+		c.verify(t)
+		_, err := c.db.Set(make([]byte, c.db.MaxKeySize()+1), nil)
+		is.Equal(t, ErrKeyTooLarge, err)
+
+		// 重新打开时使用记录的页面大小
+		c.reopen()
+		is.Equal(t, pageSize, c.db.PageSize)
+		is.Zero(t, fileSize(c.store)%int64(pageSize))
+		c.verify(t)
+
+		// 与文件冲突的页面大小
+		c.db.Close()
+		c.db = KV{Store: c.store, PageSize: BTreePageSize}
+		is.True(t, errors.Is(c.db.Open(), ErrPageSize))
+		c.db = KV{Store: c.store, PageSize: pageSize}
+		is.NoError(t, c.db.Open())
+		c.verify(t)
+		c.dispose()
+	}
+
+	// 不支持的页面大小
+	for _, pageSize := range []int{MinPageSize / 2, 3000, 2 * MaxPageSize} {
+		db := KV{Store: &MemStorage{}, PageSize: pageSize}
+		is.True(t, errors.Is(db.Open(), ErrPageSize))
+	}
+}
+
+func TestKVPrefix(t *testing.T) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	c.db = KV{Store: c.store, PageSize: 2048, PrefixCompression: true}
+	is.NoError(t, c.db.Open())
+	key := func(i int) string {
+		return fmt.Sprintf("\x00\x00\x00\x65%08d", fmix32(uint32(i)))
+	}
+	for i := 0; i < 3000; i++ {
+		c.add(key(i), bigVal("v", int(fmix32(uint32(i))%3000)))
+	}
+	c.verify(t)
+
+	// 迭代器返回完整的键
+	r := c.db.BeginRead()
+	n := 0
+	for iter := r.Seek([]byte("\x00\x00\x00\x65"), CmpGe); iter.Valid(); iter.Next() {
+		k, v := iter.Deref()
+		is.Equal(t, c.ref[string(k)], string(v))
+		n++
+	}
+	r.EndRead()
+	is.Equal(t, len(c.ref), n)
+
+	// 关闭压缩之后仍然可以读取和修改压缩的结点
+	c.reopen()
+	is.False(t, c.db.tree.prefix)
+	c.verify(t)
+	for i := 0; i < 3000; i += 2 {
+		is.True(t, c.del(key(i)))
+	}
+	c.verify(t)
+}
+
+func TestKVRandLength(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	for i := 0; i < heavy(2000, 500); i++ {
 		kLen := fmix32(uint32(2*i+0)) % BTreeMaxKeySize
 		vLen := fmix32(uint32(2*i+1)) % BTreeMaxValSize
 		if kLen == 0 {
@@ -286,7 +529,7 @@ func TestKVRandLength(t *testing.T) {
 }
 
 func TestKVIncLength(t *testing.T) {
-	for l := 1; l < BTreeMaxKeySize+BTreeMaxValSize; l++ {
+	for l := 1; l < BTreeMaxKeySize+BTreeMaxValSize; l += heavy(1, 16) {
 		c := newD()
 
 		kLen := l
@@ -318,10 +561,10 @@ func TestKVIncLength(t *testing.T) {
 }
 
 // fileSize 获取文件大小
-func fileSize(path string) int64 {
-	fInfo, err := os.Stat(path)
+func fileSize(store Storage) int64 {
+	size, err := store.Size()
 	util.Assert(err == nil)
-	return fInfo.Size()
+	return size
 }
 
 // test the free list: file size do not increase under various operations
@@ -336,20 +579,20 @@ func TestKVFileSize(t *testing.T) {
 	}
 	fill(0)
 	fill(1)
-	size := fileSize(c.db.Path)
+	size := fileSize(c.store)
 
 	// update the same key
 	fill(2)
-	util.Assert(size == fileSize(c.db.Path))
+	util.Assert(size == fileSize(c.store))
 
 	// remove everything
 	for i := 0; i < 2000; i++ {
 		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
 		c.del(key)
 	}
-	util.Assert(size == fileSize(c.db.Path))
+	util.Assert(size == fileSize(c.store))
 
 	// add them back
 	fill(3)
-	util.Assert(size == fileSize(c.db.Path))
+	util.Assert(size == fileSize(c.store))
 }
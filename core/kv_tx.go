@@ -0,0 +1,127 @@
+package core
+
+import (
+	"errors"
+
+	"db-practice/util"
+)
+
+// KVTX 读写事务
+// 事务内的所有修改都保存在内存中（page.updates），
+// 提交时一次性写入所有页面并只切换一次 meta 页面。
+// 同一时间只有一个写事务，其他 Begin 调用会等待当前事务结束。
+type KVTX struct {
+	db   *KV
+	meta []byte // 事务开始时的 meta，用于回滚
+	err  error  // 修改时读取到损坏的页面或之前的 sync 失败，事务只能放弃
+}
+
+// Begin 开始一个事务
+func (db *KV) Begin() *KVTX {
+	if db.WAL {
+		walWait(db)
+	}
+	db.writer.Lock()
+	util.Assert(len(db.page.updates) == 0 && db.page.nAppend == 0)
+	// 之前事务释放的页面可以复用，但不能复用活跃读者仍可能访问的页面，
+	// 也不能复用磁盘上的树（最后一次持久化的 meta）仍然引用的页面
+	db.free.SetMaxSeq()
+	db.free.LimitMaxSeq(durableSeq(db))
+	db.snap.mu.Lock()
+	for r := range db.snap.readers {
+		db.free.LimitMaxSeq(r.seq)
+	}
+	db.snap.mu.Unlock()
+	if db.WAL && db.durable.err == nil {
+		db.durable.err = walErr(db) // 后台 checkpoint 的错误
+	}
+	return &KVTX{db: db, meta: saveMeta(db), err: db.durable.err}
+}
+
+// finish 结束事务，事务结束后不能再使用
+func (tx *KVTX) finish() *KV {
+	util.Assert(tx.db != nil)
+	db := tx.db
+	tx.db = nil
+	foldCounts(db)
+	return db
+}
+
+// Commit 提交事务，失败时回滚到事务开始前的状态
+func (tx *KVTX) Commit() error {
+	db := tx.finish()
+	defer db.writer.Unlock()
+	if tx.err != nil {
+		rollback(db, tx.meta)
+		return tx.err
+	}
+	if len(db.page.updates) == 0 && db.page.nAppend == 0 {
+		return nil // 只读事务
+	}
+	if db.ReadOnly {
+		rollback(db, tx.meta)
+		return ErrReadOnly
+	}
+	releaseReuse(db)
+	return updateOrRevert(db, tx.meta)
+}
+
+// Abort 放弃事务中的所有修改
+func (tx *KVTX) Abort() {
+	db := tx.finish()
+	defer db.writer.Unlock()
+	rollback(db, tx.meta)
+}
+
+// fail 修改到一半时读取到损坏的页面，树可能处于不一致的状态
+func (tx *KVTX) fail(err *error) {
+	if errors.Is(*err, ErrCorrupt) {
+		tx.err = *err
+	}
+}
+
+// Get 获取值，可以读到本事务未提交的修改
+func (tx *KVTX) Get(key []byte) (val []byte, ok bool, err error) {
+	if tx.err != nil {
+		return nil, false, tx.err
+	}
+	if err = tx.db.tree.checkKey(key); err != nil {
+		return nil, false, err
+	}
+	defer recoverCorrupt(&err)
+	val, ok = tx.db.tree.Get(key)
+	return val, ok, nil
+}
+
+// Seek 返回指向关于 'cmp' 关系的离键最近位置的迭代器
+func (tx *KVTX) Seek(key []byte, cmp int) *BIter {
+	if tx.err != nil {
+		return &BIter{err: tx.err}
+	}
+	return tx.db.tree.Seek(key, cmp)
+}
+
+// Set 设置值
+func (tx *KVTX) Set(key []byte, val []byte) (bool, error) {
+	return tx.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// Update 更新值
+func (tx *KVTX) Update(req *UpdateReq) (updated bool, err error) {
+	if tx.err != nil {
+		return false, tx.err
+	}
+	defer tx.fail(&err)
+	defer recoverCorrupt(&err)
+	return tx.db.tree.Update(req)
+}
+
+// Del 删除值
+func (tx *KVTX) Del(key []byte) (deleted bool, err error) {
+	if tx.err != nil {
+		return false, tx.err
+	}
+	defer tx.fail(&err)
+	defer recoverCorrupt(&err)
+	return tx.db.tree.Delete(key)
+}
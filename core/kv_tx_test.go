@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestKVTX(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	nSync := 0
+	c.store.SyncErr = func() error {
+		nSync++
+		return nil
+	}
+
+	// 一个事务中的多个修改只需要一次提交
+	tx := c.db.Begin()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := fmt.Sprintf("val%d", i)
+		updated, err := tx.Set([]byte(key), []byte(val))
+		is.NoError(t, err)
+		is.True(t, updated)
+		c.ref[key] = val
+	}
+	// 事务内可以读到未提交的修改
+	val, ok, err := tx.Get([]byte("key3"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, []byte("val3"), val)
+	iter := tx.Seek([]byte("key5"), CmpGt)
+	is.True(t, iter.Valid())
+	key, _ := iter.Deref()
+	is.Equal(t, []byte("key6"), key)
+	is.NoError(t, tx.Commit())
+	is.Equal(t, 2, nSync)
+	c.verify(t)
+
+	// 放弃事务
+	tx = c.db.Begin()
+	deleted, err := tx.Del([]byte("key0"))
+	is.NoError(t, err)
+	is.True(t, deleted)
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprintf("new%d", i)), []byte("v"))
+	}
+	_, ok, err = tx.Get([]byte("key0"))
+	is.NoError(t, err)
+	is.False(t, ok)
+	tx.Abort()
+	is.Equal(t, 2, nSync)
+	c.verify(t)
+
+	// 只读事务不写文件
+	tx = c.db.Begin()
+	_, ok, err = tx.Get([]byte("key0"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.NoError(t, tx.Commit())
+	is.Equal(t, 2, nSync)
+
+	// 提交失败时回滚整个事务
+	c.store.SyncErr = fsyncErr(0, 1)
+	tx = c.db.Begin()
+	tx.Del([]byte("key1"))
+	tx.Set([]byte("key2"), []byte("xxx"))
+	is.Error(t, tx.Commit())
+	c.store.SyncErr = nil
+	c.verify(t)
+
+	tx = c.db.Begin()
+	tx.Del([]byte("key1"))
+	delete(c.ref, "key1")
+	is.NoError(t, tx.Commit())
+	c.verify(t)
+
+	c.reopen()
+	c.verify(t)
+}
+
+func TestKVTXPageReuse(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	// 本事务分配的页面释放之后直接复用，内存和文件只随修改过的页面增长
+	tx := c.db.Begin()
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%08d", fmix32(uint32(i)))
+		val := fmt.Sprintf("val%020d", i)
+		_, err := tx.Set([]byte(key), []byte(val))
+		is.NoError(t, err)
+		c.ref[key] = val
+	}
+	updates := len(c.db.page.updates)
+	is.NoError(t, tx.Commit())
+	report, err := c.db.Check()
+	is.NoError(t, err)
+	is.True(t, uint64(updates) < report.Nodes*2)
+	is.True(t, c.db.page.flushed < report.Nodes*2)
+	c.verify(t)
+
+	// 释放之后没有再复用的页面在提交时放入 freelist
+	tx = c.db.Begin()
+	for i := 0; i < 20000; i += 2 {
+		key := fmt.Sprintf("key%08d", fmix32(uint32(i)))
+		_, err = tx.Del([]byte(key))
+		is.NoError(t, err)
+		delete(c.ref, key)
+	}
+	is.NotEmpty(t, c.db.page.reuse)
+	is.NoError(t, tx.Commit())
+	_, err = c.db.Check()
+	is.NoError(t, err)
+	c.verify(t)
+}
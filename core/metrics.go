@@ -0,0 +1,231 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 提交的阶段，见 updateFile
+const (
+	phaseWritePages = iota // 写入页面
+	phaseSyncPages         // 第一次 fsync，页面在 meta 之前持久化
+	phaseUpdateRoot        // 写入 meta
+	phaseSyncMeta          // 第二次 fsync
+	nPhases
+)
+
+var phaseNames = [nPhases]string{"write_pages", "sync_pages", "update_root", "sync_meta"}
+
+// latencyBuckets 耗时直方图每个桶的上界（秒）
+var latencyBuckets = [...]float64{
+	0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// histogram 耗时直方图，零值可用，可以与读取并发记录
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64 // 每个桶的次数（不累计），最后一个是 +Inf
+	sum    atomic.Uint64                          // 总耗时，纳秒
+}
+
+// observe 记录一次耗时
+func (h *histogram) observe(d time.Duration) {
+	h.counts[sort.SearchFloat64s(latencyBuckets[:], d.Seconds())].Add(1)
+	h.sum.Add(uint64(d))
+}
+
+// observe 记录从 start 开始的一个提交阶段的耗时
+func observe(db *KV, phase int, start time.Time) {
+	db.stats.phases[phase].observe(time.Since(start))
+}
+
+// pageCounts 页面读取和分配的计数，见 KV.MetricsHandler
+// 在读者或写者本地累计，避免每次读取都修改共享的原子计数。
+type pageCounts struct {
+	fileReads   uint64
+	updateReads uint64
+	freePops    uint64
+	appends     uint64
+}
+
+// foldCounts 将写者累计的计数合并到总数，调用者持有写锁
+func foldCounts(db *KV) {
+	c := &db.stats.writer
+	db.stats.fileReads.Add(c.fileReads)
+	db.stats.updateReads.Add(c.updateReads)
+	db.stats.freePops.Add(c.freePops)
+	db.stats.appends.Add(c.appends)
+	*c = pageCounts{}
+}
+
+// 表的操作，见 DB.MetricsHandler
+const (
+	opGet = iota
+	opInsert
+	opUpdate
+	opUpsert
+	opDelete
+	opScan
+	nOps
+)
+
+var opNames = [nOps]string{"get", "insert", "update", "upsert", "delete", "scan"}
+
+// tableOps 一个表每种操作的次数
+type tableOps [nOps]atomic.Uint64
+
+// countOp 记录一次表的操作
+func countOp(db *DB, table string, op int) {
+	ops, ok := db.ops.Load(table)
+	if !ok {
+		ops, _ = db.ops.LoadOrStore(table, new(tableOps))
+	}
+	ops.(*tableOps)[op].Add(1)
+}
+
+// setOp 返回 DBUpdateReq.Mode 对应的操作
+func setOp(mode int) int {
+	switch mode {
+	case ModeInsertOnly:
+		return opInsert
+	case ModeUpdateOnly:
+		return opUpdate
+	default:
+		return opUpsert
+	}
+}
+
+// promWriter 以 Prometheus 的文本格式输出指标
+type promWriter struct {
+	buf bytes.Buffer
+}
+
+var promEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// header 输出一个指标的 HELP 和 TYPE
+func (p *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(&p.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample 输出一个样本，labels 是成对的标签名和值
+func (p *promWriter) sample(name string, value any, labels ...string) {
+	p.buf.WriteString(name)
+	for i := 0; i < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(&p.buf, `%s%s="%s"`, sep, labels[i], promEscape.Replace(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		p.buf.WriteString("}")
+	}
+	fmt.Fprintf(&p.buf, " %v\n", value)
+}
+
+// counter 输出只有一个样本的计数器
+func (p *promWriter) counter(name, help string, value uint64) {
+	p.header(name, "counter", help)
+	p.sample(name, value)
+}
+
+// histogram 输出直方图，桶的次数是累计的
+func (p *promWriter) histogram(name string, h *histogram, labels ...string) {
+	total := uint64(0)
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = fmt.Sprint(latencyBuckets[i])
+		}
+		p.sample(name+"_bucket", total, append(labels[:len(labels):len(labels)], "le", le)...)
+	}
+	p.sample(name+"_sum", time.Duration(h.sum.Load()).Seconds(), labels...)
+	p.sample(name+"_count", total, labels...)
+}
+
+// writeKVMetrics 输出 KV 的指标，不遍历树
+func writeKVMetrics(p *promWriter, db *KV) {
+	name := "kv_commit_phase_seconds"
+	p.header(name, "histogram", "Commit latency by phase: write_pages, sync_pages (first fsync), update_root, sync_meta (second fsync).")
+	for i := range db.stats.phases {
+		p.histogram(name, &db.stats.phases[i], "phase", phaseNames[i])
+	}
+
+	name = "kv_page_reads_total"
+	p.header(name, "counter", "Pages read by the writer and readers, from the mapped file or from pages updated in the transaction.")
+	p.sample(name, db.stats.fileReads.Load(), "source", "mmap")
+	p.sample(name, db.stats.updateReads.Load(), "source", "updates")
+	name = "kv_page_allocs_total"
+	p.header(name, "counter", "Pages allocated for tree nodes, reused from the freelist or appended to the file.")
+	p.sample(name, db.stats.freePops.Load(), "source", "freelist")
+	p.sample(name, db.stats.appends.Load(), "source", "append")
+
+	s := db.SyncStats()
+	p.counter("kv_commits_total", "Successful commits.", s.Commits)
+	p.header("kv_pending_commits", "gauge", "Commits not yet durable.")
+	p.sample("kv_pending_commits", s.Pending)
+	p.counter("kv_fsyncs_total", "Fsync calls on the database file and the log, including failed ones.", s.Fsyncs)
+	p.counter("kv_fsync_failures_total", "Failed fsync calls.", s.Failures)
+	p.counter("kv_pages_written_total", "Pages written to the database file.", db.stats.pages.Load())
+	p.counter("kv_failed_commits_total", "Commits that failed to write.", db.stats.failed.Load())
+	p.counter("kv_reverts_total", "Meta page restores after failed commits.", db.stats.reverts.Load())
+
+	db.snap.mu.Lock()
+	meta := db.snap.meta
+	db.snap.mu.Unlock()
+	if meta != nil {
+		p.header("kv_pages", "gauge", "Pages used in the database file.")
+		p.sample("kv_pages", binary.LittleEndian.Uint64(meta[8:]))
+		p.header("kv_free_pages", "gauge", "Pages on the freelist.")
+		p.sample("kv_free_pages", binary.LittleEndian.Uint64(meta[40:])-binary.LittleEndian.Uint64(meta[24:]))
+	}
+}
+
+// serveMetrics 返回输出 write 的指标的 http.Handler
+func serveMetrics(write func(p *promWriter)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var p promWriter
+		write(&p)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(p.buf.Bytes())
+	})
+}
+
+// MetricsHandler 返回以 Prometheus 文本格式输出指标的 http.Handler，
+// 只读取计数器，可以频繁抓取；树的统计见 KV.Stats。
+// 页面读取和分配的计数在读事务或写事务结束时才计入。
+func (db *KV) MetricsHandler() http.Handler {
+	return serveMetrics(func(p *promWriter) {
+		writeKVMetrics(p, db)
+	})
+}
+
+// MetricsHandler 在 KV.MetricsHandler 的基础上输出每个表的操作次数
+// 操作按 DBTX 的方法计数（包括 DB 的同名方法），不论是否成功或者提交。
+func (db *DB) MetricsHandler() http.Handler {
+	return serveMetrics(func(p *promWriter) {
+		writeKVMetrics(p, &db.kv)
+		var tables []string
+		db.ops.Range(func(table, _ any) bool {
+			tables = append(tables, table.(string))
+			return true
+		})
+		slices.Sort(tables)
+		name := "db_table_operations_total"
+		p.header(name, "counter", "Table operations by table and type.")
+		for _, table := range tables {
+			v, _ := db.ops.Load(table)
+			ops := v.(*tableOps)
+			for op := range ops {
+				p.sample(name, ops[op].Load(), "table", table, "op", opNames[op])
+			}
+		}
+	})
+}
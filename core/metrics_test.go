@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// scrape 抓取指标，返回样本名（包括标签）到值的映射
+func scrape(t *testing.T, h http.Handler) map[string]float64 {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	is.Equal(t, 200, w.Code)
+	is.Contains(t, w.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	line := regexp.MustCompile(`^([a-z_]+(\{[a-z_]+="(\\.|[^"\\])*"(,[a-z_]+="(\\.|[^"\\])*")*\})?) (\S+)$`)
+	samples := map[string]float64{}
+	for _, s := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(s, "# HELP ") || strings.HasPrefix(s, "# TYPE ") {
+			continue
+		}
+		m := line.FindStringSubmatch(s)
+		is.NotNil(t, m, s)
+		v, err := strconv.ParseFloat(m[6], 64)
+		is.NoError(t, err, s)
+		_, dup := samples[m[1]]
+		is.False(t, dup, s)
+		samples[m[1]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	before := scrape(t, c.db.MetricsHandler()) // 包括打开时初始化的文件
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%05d", i), bigVal("v", i%100))
+	}
+	for i := 0; i < 1000; i += 2 {
+		c.del(fmt.Sprintf("key%05d", i))
+	}
+	m := scrape(t, c.db.MetricsHandler())
+	is.Equal(t, float64(1500), m["kv_commits_total"])
+	for _, phase := range phaseNames {
+		labels := fmt.Sprintf(`{phase="%s"}`, phase)
+		count := m["kv_commit_phase_seconds_count"+labels]
+		is.Equal(t, float64(1500), count-before["kv_commit_phase_seconds_count"+labels], phase)
+		is.Equal(t, count, m[fmt.Sprintf(`kv_commit_phase_seconds_bucket{phase="%s",le="+Inf"}`, phase)])
+		is.True(t, m["kv_commit_phase_seconds_sum"+labels] > 0)
+		prev := 0.0
+		for _, le := range latencyBuckets {
+			v := m[fmt.Sprintf(`kv_commit_phase_seconds_bucket{phase="%s",le="%v"}`, phase, le)]
+			is.True(t, v >= prev)
+			prev = v
+		}
+	}
+	is.NotZero(t, m[`kv_page_reads_total{source="mmap"}`])
+	is.NotZero(t, m[`kv_page_reads_total{source="updates"}`])
+	is.NotZero(t, m[`kv_page_allocs_total{source="freelist"}`])
+	is.NotZero(t, m[`kv_page_allocs_total{source="append"}`])
+	is.Equal(t, float64(3000), m["kv_fsyncs_total"]-before["kv_fsyncs_total"])
+	is.Equal(t, float64(c.db.page.flushed), m["kv_pages"])
+	s, err := c.db.Stats()
+	is.NoError(t, err)
+	is.Equal(t, float64(s.FreePages), m["kv_free_pages"])
+	is.Equal(t, float64(s.PagesWritten), m["kv_pages_written_total"])
+}
+
+func TestDBMetrics(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	for _, name := range []string{"t", `a"b`} {
+		r.create(&TableDef{
+			Name:  name,
+			Types: []uint32{TypeInt64, TypeBytes},
+			Cols:  []string{"id", "name"},
+			PKeys: 1,
+		})
+	}
+	for i := 0; i < 20; i++ {
+		r.add("t", *(&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte("x")))
+	}
+	_, err := r.db.Update("t", *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("y")))
+	is.NoError(t, err)
+	_, err = r.db.Delete("t", *(&Record{}).AddInt64("id", 2))
+	is.NoError(t, err)
+	sc := Scanner{
+		Cmp1: CmpGe, Cmp2: CmpLe,
+		Key1: *(&Record{}).AddInt64("id", 0),
+		Key2: *(&Record{}).AddInt64("id", 9),
+	}
+	is.NoError(t, r.db.Scan("t", &sc))
+	_, err = r.db.Insert(`a"b`, *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("x")))
+	is.NoError(t, err)
+	_, err = r.db.Insert("none", *(&Record{}).AddInt64("id", 1))
+	is.Error(t, err)
+
+	m := scrape(t, r.db.MetricsHandler())
+	op := func(table, op string) float64 {
+		v, ok := m[fmt.Sprintf(`db_table_operations_total{table="%s",op="%s"}`, table, op)]
+		is.True(t, ok, table, op)
+		return v
+	}
+	is.Equal(t, float64(1), op("t", "update"))
+	is.Equal(t, float64(1), op("t", "delete"))
+	is.Equal(t, float64(1), op("t", "scan"))
+	is.Equal(t, float64(20), op("t", "upsert")) // R.add
+	is.Equal(t, float64(1), op(`a\"b`, "insert"))
+	is.Zero(t, op(`a\"b`, "delete"))
+	_, ok := m[`db_table_operations_total{table="none",op="insert"}`]
+	is.False(t, ok)
+	is.NotZero(t, m["kv_commits_total"])
+}
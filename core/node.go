@@ -4,23 +4,36 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"slices"
 
 	"db-practice/util"
 )
 
+// 页面大小在创建数据库时选择（见 KV.PageSize），以下是默认页面大小下的值
 const (
-	Header          = 4
+	Header          = 8
 	BTreePageSize   = 4096
 	BTreeMaxKeySize = 1000
 	BTreeMaxValSize = 3000
 
-	BNodeNode = 1 // 中间结点没有val
-	BNodeLeaf = 2 // 叶子结点有val
+	MinPageSize = 1024
+	MaxPageSize = 16384 // 分裂前的结点可能有 3 页大，偏移量必须能用 uint16 表示
 
-	PointerSize = 8
-	offsetSize  = 2
-	KeyLenSize  = 2
-	ValLenSize  = 2
+	BNodeNode     = 1 // 中间结点没有val
+	BNodeLeaf     = 2 // 叶子结点有val
+	BNodeFree     = 3 // freelist 结点
+	BNodeOverflow = 4 // 溢出页
+
+	valOverflow = 0x8000 // vlen 的最高位：值存储在溢出页中
+	nodePrefix  = 0x8000 // type 的最高位：结点中的键共享前缀
+	nodeHints   = 0x4000 // type 的次高位：结点中有键的提示
+
+	PointerSize   = 8
+	offsetSize    = 2
+	KeyLenSize    = 2
+	ValLenSize    = 2
+	prefixLenSize = 2
+	hintSize      = 4
 )
 
 // BNode btree 的一个结点
@@ -30,6 +43,7 @@ const (
 // |------------|-------------------|
 // | type       | 2 bytes           |
 // | nkeys      | 2 bytes           |
+// | checksum   | 4 bytes           |（写入磁盘时计算，见 pageChecksum）
 // | pointers   | nkeys * 8 bytes   |（仅用于内部节点，叶子节点没有指针）
 // | offsets    | nkeys * 2 bytes   |
 // 2. 键值对格式
@@ -40,11 +54,87 @@ const (
 // | key    | klen bytes |
 // | val    | vlen bytes |
 // 叶子节点和内部节点使用相同的格式。
+// 超过 BTreeMaxValSize 的值存储在溢出页中，见 ONode。
+// 3. 前缀压缩（type 的最高位为 1）
+// 头部之后存储所有键的公共前缀，klen 和 key 只记录去掉前缀之后的部分：
+// | type | nkeys | checksum | plen | prefix | pointers | offsets | kvs |
+// |  2B  |  2B   |    4B    |  2B  | plen B |   ...    |   ...   | ... |
+// 两种格式的结点可以共存，修改时总是先还原为完整的键，见 nodePack。
+// 4. 键的提示（type 的次高位为 1）
+// 指针之前存储每个键（去掉公共前缀之后）的前 4 个字节，不足的部分补 0，
+// 查找时先在提示中二分查找，只有提示相同的键才需要比较完整的键：
+// | header | plen | prefix | hints     | pointers | offsets | kvs |
+// |        |  (压缩时才有)  | nkeys * 4B |   ...    |   ...   | ... |
 type BNode []byte
 
 // bType 返回结点的类型
 func (b BNode) bType() uint16 {
-	return binary.LittleEndian.Uint16(b)
+	return binary.LittleEndian.Uint16(b) &^ (nodePrefix | nodeHints)
+}
+
+// hasHints 结点中是否有键的提示
+func (b BNode) hasHints() bool {
+	return binary.LittleEndian.Uint16(b)&nodeHints != 0
+}
+
+// setHints 标记结点中有键的提示，在 setPrefix 之后、添加键之前调用
+func (b BNode) setHints() {
+	binary.LittleEndian.PutUint16(b, binary.LittleEndian.Uint16(b)|nodeHints)
+}
+
+// hintPos 返回第一个提示的位置
+func (b BNode) hintPos() uint16 {
+	if !b.isPrefixed() {
+		return Header
+	}
+	return Header + prefixLenSize + binary.LittleEndian.Uint16(b[Header:])
+}
+
+// getHint 返回索引为idx的键的提示
+func (b BNode) getHint(idx uint16) uint32 {
+	util.Assert(idx < b.nKeys())
+	return binary.BigEndian.Uint32(b[b.hintPos()+hintSize*idx:])
+}
+
+// setHint 设置索引为idx的键的提示
+func (b BNode) setHint(idx uint16, hint uint32) {
+	binary.BigEndian.PutUint32(b[b.hintPos()+hintSize*idx:], hint)
+}
+
+// keyHint 返回键去掉公共前缀之后的前 4 个字节，按大端序比较与键的顺序一致
+func keyHint(suffix []byte) uint32 {
+	var buf [hintSize]byte
+	copy(buf[:], suffix)
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+// isPrefixed 结点是否使用前缀压缩的格式
+func (b BNode) isPrefixed() bool {
+	return binary.LittleEndian.Uint16(b)&nodePrefix != 0
+}
+
+// getPrefix 返回结点中键的公共前缀
+func (b BNode) getPrefix() []byte {
+	if !b.isPrefixed() {
+		return nil
+	}
+	pLen := binary.LittleEndian.Uint16(b[Header:])
+	return b[Header+prefixLenSize:][:pLen]
+}
+
+// setPrefix 设置键的公共前缀，在 setHeader 之后、添加键之前调用
+func (b BNode) setPrefix(prefix []byte) {
+	binary.LittleEndian.PutUint16(b, binary.LittleEndian.Uint16(b)|nodePrefix)
+	binary.LittleEndian.PutUint16(b[Header:], uint16(len(prefix)))
+	copy(b[Header+prefixLenSize:], prefix)
+}
+
+// base 返回指针的起始位置
+func (b BNode) base() uint16 {
+	if !b.hasHints() {
+		return b.hintPos()
+	}
+	return b.hintPos() + hintSize*b.nKeys()
 }
 
 // nKeys 返回结点中键的数量
@@ -61,12 +151,12 @@ func (b BNode) setHeader(btype, nKeys uint16) {
 // getPtr 返回索引为idx的子节点指针值
 func (b BNode) getPtr(idx uint16) uint64 {
 	util.Assert(idx < b.nKeys())
-	return binary.LittleEndian.Uint64(b[Header+PointerSize*idx:])
+	return binary.LittleEndian.Uint64(b[b.base()+PointerSize*idx:])
 }
 
 // setPtr 设置索引为idx的子节点指针值
 func (b BNode) setPtr(idx uint16, val uint64) {
-	binary.LittleEndian.PutUint64(b[Header+PointerSize*idx:], val)
+	binary.LittleEndian.PutUint64(b[b.base()+PointerSize*idx:], val)
 }
 
 // offsetPos 返回索引为idx的偏移量存储位置
@@ -74,7 +164,7 @@ func (b BNode) offsetPos(idx uint16) uint16 {
 	// idx == b.nKeys()时，返回最后一个偏移量位置 记录node大小
 	util.Assert(idx > 0 && idx <= b.nKeys())
 	// 第一个kv的offset为0
-	return Header + PointerSize*b.nKeys() + offsetSize*(idx-1)
+	return b.base() + PointerSize*b.nKeys() + offsetSize*(idx-1)
 }
 
 // getOffsetPos 返回索引为idx的偏移量存储位置
@@ -102,39 +192,75 @@ func (b BNode) setOffset(idx uint16, offset uint16) {
 func (b BNode) kvPos(idx uint16) uint16 {
 	// idx == b.nKeys()时，返回最后一个偏移量位置 记录node大小
 	util.Assert(idx <= b.nKeys())
-	return Header + PointerSize*b.nKeys() + offsetSize*b.nKeys() + b.getOffset(idx)
+	return b.base() + PointerSize*b.nKeys() + offsetSize*b.nKeys() + b.getOffset(idx)
 }
 
-// getKey 返回索引为idx的键值
+// getKey 返回索引为idx的完整的键，压缩的结点返回拼接前缀之后的副本
 func (b BNode) getKey(idx uint16) []byte {
+	if !b.isPrefixed() {
+		return b.getSuffix(idx)
+	}
+	return slices.Concat(b.getPrefix(), b.getSuffix(idx))
+}
+
+// getSuffix 返回索引为idx的键去掉公共前缀之后的部分
+func (b BNode) getSuffix(idx uint16) []byte {
 	util.Assert(idx < b.nKeys())
 	pos := b.kvPos(idx)
 	kLen := binary.LittleEndian.Uint16(b[pos:])
 	return b[pos+KeyLenSize+ValLenSize:][:kLen]
 }
 
+// compareKey 比较索引为idx的键与key，不拼接前缀
+func (b BNode) compareKey(idx uint16, key []byte) int {
+	prefix := b.getPrefix()
+	n := min(len(prefix), len(key))
+	if cmp := bytes.Compare(prefix, key[:n]); cmp != 0 {
+		return cmp
+	}
+	if n < len(prefix) {
+		return 1 // key 比前缀短
+	}
+	return bytes.Compare(b.getSuffix(idx), key[n:])
+}
+
 // getVal 返回索引为idx的值
 func (b BNode) getVal(idx uint16) []byte {
 	util.Assert(idx < b.nKeys())
 	pos := b.kvPos(idx)
 	kLen := binary.LittleEndian.Uint16(b[pos:])
-	vLen := binary.LittleEndian.Uint16(b[pos+KeyLenSize:])
+	vLen := binary.LittleEndian.Uint16(b[pos+KeyLenSize:]) &^ valOverflow
 	start := pos + KeyLenSize + ValLenSize + kLen
 	return b[start:][:vLen]
 }
 
-// getKeyLen 返回索引为idx的键的长度
+// isOverflow 索引为idx的值是否存储在溢出页中
+func (b BNode) isOverflow(idx uint16) bool {
+	util.Assert(idx < b.nKeys())
+	pos := b.kvPos(idx)
+	return binary.LittleEndian.Uint16(b[pos+KeyLenSize:])&valOverflow != 0
+}
+
+// setOverflow 标记索引为idx的值为溢出页的引用
+func (b BNode) setOverflow(idx uint16) {
+	util.Assert(idx < b.nKeys())
+	pos := b.kvPos(idx)
+	vLen := binary.LittleEndian.Uint16(b[pos+KeyLenSize:])
+	binary.LittleEndian.PutUint16(b[pos+KeyLenSize:], vLen|valOverflow)
+}
+
+// getKeyLen 返回索引为idx的完整的键的长度
 func (b BNode) getKeyLen(idx uint16) uint16 {
 	util.Assert(idx < b.nKeys())
 	pos := b.kvPos(idx)
-	return binary.LittleEndian.Uint16(b[pos:])
+	return uint16(len(b.getPrefix())) + binary.LittleEndian.Uint16(b[pos:])
 }
 
 // getValLen 返回索引为idx的值的长度
 func (b BNode) getValLen(idx uint16) uint16 {
 	util.Assert(idx < b.nKeys())
 	pos := b.kvPos(idx)
-	return binary.LittleEndian.Uint16(b[pos+KeyLenSize:])
+	return binary.LittleEndian.Uint16(b[pos+KeyLenSize:]) &^ valOverflow
 }
 
 // nBytes 返回结点的大小
@@ -142,11 +268,21 @@ func (b BNode) nBytes() uint16 {
 	return b.kvPos(b.nKeys())
 }
 
+// unpackedBytes 返回还原完整的键并去掉提示之后结点的大小
+func (b BNode) unpackedBytes() int {
+	size := int(b.nBytes() - b.base() + Header)
+	if b.isPrefixed() {
+		size += int(b.nKeys()) * len(b.getPrefix())
+	}
+	return size
+}
+
 // String 返回结点信息
 func (b BNode) String() string {
 	nodeS := struct {
 		Type         string   `json:"type"`
 		NKeys        uint16   `json:"nKeys"`
+		Prefix       string   `json:"prefix,omitempty"`
 		Pointers     []uint64 `json:"pointers"`
 		Offsets      []uint16 `json:"offsets"`
 		OffsetsStart []uint16 `json:"offsets_start"`
@@ -158,6 +294,7 @@ func (b BNode) String() string {
 		} `json:"key-value"`
 	}{}
 	nodeS.NKeys = b.nKeys()
+	nodeS.Prefix = string(b.getPrefix())
 	for i := range b.nKeys() {
 		nodeS.Pointers = append(nodeS.Pointers, b.getPtr(i))
 		nodeS.Offsets = append(nodeS.Offsets, b.getOffset(i))
@@ -184,27 +321,49 @@ func (b BNode) String() string {
 }
 
 // nodeLookupLE 返回小于等于key的最大键的索引 kid[i] <= key
+// 第一个键是哨兵或者父结点中的键，总是小于等于 key，只需在 [1, nKeys) 中查找。
 func nodeLookupLE(node BNode, key []byte) uint16 {
-	// TODO: 二分查找
-	nKeys := node.nKeys()
-	found := uint16(0)
-	for i := uint16(1); i < nKeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		if cmp >= 0 {
-			break
+	lo, hi := uint16(1), node.nKeys()
+	// 提示小于 key 的键都小于 key，提示大于 key 的键都大于 key
+	prefix := node.getPrefix()
+	if node.hasHints() && bytes.HasPrefix(key, prefix) {
+		hint := keyHint(key[len(prefix):])
+		lo, hi = nodeSearch(lo, hi, func(i uint16) bool { return node.getHint(i) >= hint }),
+			nodeSearch(lo, hi, func(i uint16) bool { return node.getHint(i) > hint })
+	}
+	// 第一个大于 key 的键
+	return nodeSearch(lo, hi, func(i uint16) bool { return node.compareKey(i, key) > 0 }) - 1
+}
+
+// nodeSearch 二分查找 [lo, hi) 中第一个使 f 为真的索引，f 必须是单调的
+func nodeSearch(lo, hi uint16, f func(uint16) bool) uint16 {
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if f(mid) {
+			hi = mid
+		} else {
+			lo = mid + 1
 		}
 	}
-	return found
+	return lo
 }
 
 // nodeAppendRange 复制结点信息到新结点
 func nodeAppendRange(dstNode, srcNode BNode, dst, src, n uint16) {
+	util.Assert(!dstNode.isPrefixed() && !dstNode.hasHints())
 	if n == 0 {
 		return
 	}
+	if srcNode.isPrefixed() {
+		// 逐个还原完整的键
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(dstNode, dst+i, srcNode.getPtr(src+i), srcNode.getKey(src+i), srcNode.getVal(src+i))
+			if srcNode.isOverflow(src + i) {
+				dstNode.setOverflow(dst + i)
+			}
+		}
+		return
+	}
 	// 复制子节点指针
 	for i := uint16(0); i < n; i++ {
 		dstNode.setPtr(dst+i, srcNode.getPtr(src+i))
@@ -266,7 +425,121 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 	nodeAppendRange(new, right, left.nKeys(), 0, right.nKeys())
 }
 
+// nodeEntry 构建结点时的一个键
+type nodeEntry struct {
+	key      []byte
+	val      []byte
+	ptr      uint64
+	overflow bool
+}
+
+// size 返回键在不压缩的结点中占用的字节数
+func (e *nodeEntry) size() int {
+	return PointerSize + offsetSize + KeyLenSize + ValLenSize + len(e.key) + len(e.val)
+}
+
+// nodeBuild 由有序的键构建不压缩的结点
+func nodeBuild(typ uint16, entries []nodeEntry) BNode {
+	size := Header
+	for i := range entries {
+		size += entries[i].size()
+	}
+	node := BNode(make([]byte, size))
+	node.setHeader(typ, uint16(len(entries)))
+	for i, e := range entries {
+		nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+		if e.overflow {
+			node.setOverflow(uint16(i))
+		}
+	}
+	return node
+}
+
+// nodePrefixLen 返回 [start, start+n) 范围内的键的公共前缀长度
+// 键是有序的，首尾两个键的公共前缀就是所有键的公共前缀。
+func nodePrefixLen(node BNode, start, n uint16) int {
+	first, last := node.getKey(start), node.getKey(start+n-1)
+	l := 0
+	for l < len(first) && l < len(last) && first[l] == last[l] {
+		l++
+	}
+	return l
+}
+
+// nodeRangeBytes 返回 [start, start+n) 范围内的键组成的结点的大小，
+// 以及前缀压缩之后的大小（不能节省空间时与前者相同）
+func nodeRangeBytes(node BNode, start, n uint16) (raw int, packed int) {
+	util.Assert(!node.isPrefixed() && n > 0)
+	raw = Header + (PointerSize+offsetSize)*int(n) + int(node.getOffset(start+n)-node.getOffset(start))
+	pLen := nodePrefixLen(node, start, n)
+	return raw, min(raw, raw-int(n)*pLen+prefixLenSize+pLen)
+}
+
+// nodePack 生成写入磁盘的页面，prefix 为真且能节省空间时只存储一次公共前缀，
+// 页面中还有空间时添加键的提示。提示不计入结点的大小，拆分和合并时不需要考虑。
+func nodePack(node BNode, pageSize int, prefix bool) BNode {
+	if n := node.nKeys(); n > 0 && !node.isPrefixed() && !node.hasHints() {
+		raw, packed := nodeRangeBytes(node, 0, n)
+		pLen := 0
+		if prefix && packed < raw {
+			pLen = nodePrefixLen(node, 0, n)
+		} else {
+			packed = raw
+		}
+		util.Assert(packed <= pageSize)
+		hints := packed+hintSize*int(n) <= pageSize
+		if pLen > 0 || hints {
+			page := BNode(make([]byte, pageSize))
+			page.setHeader(node.bType(), n)
+			if pLen > 0 {
+				page.setPrefix(node.getKey(0)[:pLen])
+			}
+			if hints {
+				page.setHints()
+			}
+			for i := uint16(0); i < n; i++ {
+				suffix := node.getKey(i)[pLen:]
+				nodeAppendKV(page, i, node.getPtr(i), suffix, node.getVal(i))
+				if node.isOverflow(i) {
+					page.setOverflow(i)
+				}
+				if hints {
+					page.setHint(i, keyHint(suffix))
+				}
+			}
+			return page
+		}
+	}
+	util.Assert(int(node.nBytes()) <= pageSize)
+	if len(node) >= pageSize {
+		return node[:pageSize]
+	}
+	page := BNode(make([]byte, pageSize))
+	copy(page, node)
+	return page
+}
+
+// validPageSize 页面大小必须是 2 的幂
+func validPageSize(pageSize int) bool {
+	return MinPageSize <= pageSize && pageSize <= MaxPageSize && pageSize&(pageSize-1) == 0
+}
+
+// maxKeySize 返回键的最大长度
+func maxKeySize(pageSize int) int {
+	return pageSize/4 - 24
+}
+
+// maxValSize 返回叶子结点中值的最大长度，更大的值存储在溢出页中
+func maxValSize(pageSize int) int {
+	return pageSize*3/4 - 72
+}
+
 func init() {
-	nodeMax := Header + 8 + 2 + 4 + BTreeMaxKeySize + BTreeMaxValSize
-	util.Assert(BTreePageSize >= nodeMax)
+	util.Assert(maxKeySize(BTreePageSize) == BTreeMaxKeySize)
+	util.Assert(maxValSize(BTreePageSize) == BTreeMaxValSize)
+	for size := MinPageSize; size <= MaxPageSize; size *= 2 {
+		nodeMax := Header + 8 + 2 + 4 + maxKeySize(size) + maxValSize(size)
+		util.Assert(size >= nodeMax)
+		util.Assert(maxValSize(size) < valOverflow)
+	}
 }
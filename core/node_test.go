@@ -1,9 +1,13 @@
 package core
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"slices"
 	"testing"
+
+	is "github.com/stretchr/testify/require"
 )
 
 func TestBNode_bType(t *testing.T) {
@@ -53,3 +57,120 @@ func TestBNode_modify(t *testing.T) {
 	fmt.Println("len(right.data):", len(right.data))
 	fmt.Println("cap(right.data):", cap(right.data))
 }
+
+func TestBNode_prefix(t *testing.T) {
+	keys := []string{"user:1001", "user:1002", "user:2", "user:20"}
+	node := BNode(make([]byte, BTreePageSize))
+	node.setHeader(BNodeLeaf, uint16(len(keys)))
+	for i, key := range keys {
+		nodeAppendKV(node, uint16(i), 0, []byte(key), []byte(fmt.Sprint(i)))
+	}
+	node.setOverflow(2)
+
+	// 不压缩时只添加提示
+	plain := nodePack(node, BTreePageSize, false)
+	is.False(t, plain.isPrefixed())
+	is.True(t, plain.hasHints())
+	is.Equal(t, int(node.nBytes()), plain.unpackedBytes())
+
+	packed := nodePack(node, BTreePageSize, true)
+	is.True(t, packed.isPrefixed())
+	is.Equal(t, uint16(BNodeLeaf), packed.bType())
+	is.Equal(t, "user:", string(packed.getPrefix()))
+	is.Equal(t, int(node.nBytes()), packed.unpackedBytes())
+	is.True(t, packed.nBytes() < plain.nBytes())
+	for i, key := range keys {
+		idx := uint16(i)
+		is.Equal(t, key, string(packed.getKey(idx)))
+		is.Equal(t, key, string(plain.getKey(idx)))
+		is.Equal(t, uint16(len(key)), packed.getKeyLen(idx))
+		is.Equal(t, node.getVal(idx), packed.getVal(idx))
+		is.Equal(t, node.isOverflow(idx), packed.isOverflow(idx))
+	}
+	for _, key := range []string{"", "a", "user", "user:", "user:1001", "user:15", "user:3", "v"} {
+		is.Equal(t, nodeLookupLE(node, []byte(key)), nodeLookupLE(packed, []byte(key)), key)
+		is.Equal(t, nodeLookupLE(node, []byte(key)), nodeLookupLE(plain, []byte(key)), key)
+		for i := range keys {
+			is.Equal(t, node.compareKey(uint16(i), []byte(key)), packed.compareKey(uint16(i), []byte(key)))
+		}
+	}
+
+	// 修改时还原完整的键
+	unpacked := BNode(make([]byte, BTreePageSize))
+	leafDelete(unpacked, packed, 1)
+	is.False(t, unpacked.isPrefixed())
+	is.Equal(t, "user:2", string(unpacked.getKey(1)))
+	is.True(t, unpacked.isOverflow(1))
+}
+
+// nodeLookupLinear 顺序查找，作为 nodeLookupLE 的参照
+func nodeLookupLinear(node BNode, key []byte) uint16 {
+	found := uint16(0)
+	for i := uint16(1); i < node.nKeys(); i++ {
+		if bytes.Compare(node.getKey(i), key) > 0 {
+			break
+		}
+		found = i
+	}
+	return found
+}
+
+// lookupNode 创建包含 n 个键的叶子结点，键的前 4 个字节经常相同
+func lookupNode(n int) (BNode, [][]byte) {
+	var keys [][]byte
+	for i := 0; i < n; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("k%03d%d", i/4, fmix32(uint32(i))%100)))
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	keys = slices.CompactFunc(keys, bytes.Equal)
+	keys[0] = nil // 哨兵
+	node := BNode(make([]byte, 2*BTreePageSize))
+	node.setHeader(BNodeLeaf, uint16(len(keys)))
+	for i, key := range keys {
+		nodeAppendKV(node, uint16(i), 0, key, []byte("v"))
+	}
+	return node, keys
+}
+
+func TestBNode_lookup(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 100, 300} {
+		node, keys := lookupNode(n)
+		nodes := []BNode{node, nodePack(node, 2*BTreePageSize, false), nodePack(node, 2*BTreePageSize, true)}
+		is.True(t, nodes[1].hasHints())
+		var probes [][]byte
+		for _, key := range keys {
+			probes = append(probes, key, append(slices.Clone(key), 0), key[:len(key)/2])
+		}
+		probes = append(probes, []byte("a"), []byte("k"), []byte("k0"), []byte("z"))
+		for _, node := range nodes {
+			for _, key := range probes {
+				is.Equal(t, nodeLookupLinear(node, key), nodeLookupLE(node, key), string(key))
+			}
+		}
+	}
+
+	// 页面中没有空间时不添加提示
+	node, _ := lookupNode(300)
+	is.False(t, nodePack(node, int(node.nBytes()), false).hasHints())
+}
+
+func BenchmarkNodeLookup(b *testing.B) {
+	// 4 KiB 的叶子结点中约 100 个小的键
+	node, keys := lookupNode(110)
+	hinted := nodePack(node, BTreePageSize, false)
+	for _, bench := range []struct {
+		name   string
+		node   BNode
+		lookup func(BNode, []byte) uint16
+	}{
+		{"linear", node, nodeLookupLinear},
+		{"binary", node, nodeLookupLE},
+		{"hints", hinted, nodeLookupLE},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bench.lookup(bench.node, keys[i%len(keys)])
+			}
+		})
+	}
+}
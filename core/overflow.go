@@ -0,0 +1,150 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"db-practice/util"
+)
+
+// ONode 溢出页，存储超过 maxValSize 的值
+// | type | unused | checksum | next | data |
+// |  2B  |   2B   |    4B    |  8B  | ...  |
+// 叶子结点中只存储引用，vlen 的最高位为 1：
+// | len | head |
+// | 8B  |  8B  |
+type ONode []byte
+
+const (
+	OverflowHeader = 16
+	OverflowCap    = BTreePageSize - OverflowHeader // 默认页面大小下每页的数据量
+	overflowRefLen = 16
+
+	MaxValSize = 1 << 20 // 值的最大长度
+)
+
+// overflowCap 返回每个溢出页存储的数据量
+func overflowCap(pageSize int) int {
+	return pageSize - OverflowHeader
+}
+
+// newONode 创建一个空的溢出页
+func newONode(pageSize int) ONode {
+	node := ONode(make([]byte, pageSize))
+	binary.LittleEndian.PutUint16(node, BNodeOverflow)
+	return node
+}
+
+// getNext 获取下一个溢出页的指针
+func (node ONode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[8:])
+}
+
+// setNext 设置下一个溢出页的指针
+func (node ONode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[8:], next)
+}
+
+// String 返回溢出页信息
+func (node ONode) String() string {
+	nodeS := struct {
+		Type string `json:"type"`
+		Next uint64 `json:"next"`
+	}{Type: "overflow", Next: node.getNext()}
+	marshal, _ := json.Marshal(nodeS)
+	return string(marshal)
+}
+
+// newOverflowRef 创建叶子结点中的引用
+func newOverflowRef(size uint64, head uint64) []byte {
+	ref := make([]byte, overflowRefLen)
+	binary.LittleEndian.PutUint64(ref, size)
+	binary.LittleEndian.PutUint64(ref[8:], head)
+	return ref
+}
+
+// overflowRef 解析叶子结点中的引用
+func overflowRef(ref []byte) (size uint64, head uint64) {
+	util.Assert(len(ref) == overflowRefLen)
+	return binary.LittleEndian.Uint64(ref), binary.LittleEndian.Uint64(ref[8:])
+}
+
+// overflowWrite 将值写入新分配的溢出页，返回引用
+func overflowWrite(tree *BTree, val []byte) []byte {
+	// 从后向前分配，每个页面分配时 next 已知
+	next, cap := uint64(0), overflowCap(tree.pageSize)
+	for end := len(val); end > 0; {
+		start := (end - 1) / cap * cap
+		node := newONode(tree.pageSize)
+		node.setNext(next)
+		copy(node[OverflowHeader:], val[start:end])
+		next = tree.new(node)
+		end = start
+	}
+	return newOverflowRef(uint64(len(val)), next)
+}
+
+// overflowRead 读取溢出页中的值
+func overflowRead(tree *BTree, ref []byte) []byte {
+	size, ptr := overflowRef(ref)
+	val := make([]byte, 0, size)
+	for uint64(len(val)) < size {
+		node := ONode(tree.get(ptr))
+		n := min(size-uint64(len(val)), uint64(overflowCap(tree.pageSize)))
+		val = append(val, node[OverflowHeader:][:n]...)
+		ptr = node.getNext()
+	}
+	return val
+}
+
+// overflowFree 释放溢出页
+func overflowFree(tree *BTree, ref []byte) {
+	size, ptr := overflowRef(ref)
+	cap := uint64(overflowCap(tree.pageSize))
+	for n := (size + cap - 1) / cap; n > 0; n-- {
+		next := ONode(tree.get(ptr)).getNext()
+		tree.del(ptr)
+		ptr = next
+	}
+}
+
+// overflowPages 返回引用的所有溢出页
+func overflowPages(tree *BTree, ref []byte) []uint64 {
+	size, ptr := overflowRef(ref)
+	cap := uint64(overflowCap(tree.pageSize))
+	var pages []uint64
+	for n := (size + cap - 1) / cap; n > 0; n-- {
+		pages = append(pages, ptr)
+		ptr = ONode(tree.get(ptr)).getNext()
+	}
+	return pages
+}
+
+// leafValue 返回要写入叶子结点的值，大的值写入溢出页，只存储引用
+func leafValue(req *UpdateReq) ([]byte, bool) {
+	if req.ref != nil {
+		return req.ref, true
+	}
+	if len(req.Val) <= maxValSize(req.tree.pageSize) {
+		return req.Val, false
+	}
+	return overflowWrite(req.tree, req.Val), true
+}
+
+// leafGetVal 返回叶子结点中的完整值
+func leafGetVal(tree *BTree, node BNode, idx uint16) []byte {
+	if node.isOverflow(idx) {
+		return overflowRead(tree, node.getVal(idx))
+	}
+	return node.getVal(idx)
+}
+
+// leafValEqual 判断叶子结点中的值是否等于 val，长度不同时不读取溢出页
+func leafValEqual(tree *BTree, node BNode, idx uint16, val []byte) bool {
+	if !node.isOverflow(idx) {
+		return bytes.Equal(node.getVal(idx), val)
+	}
+	size, _ := overflowRef(node.getVal(idx))
+	return size == uint64(len(val)) && bytes.Equal(overflowRead(tree, node.getVal(idx)), val)
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// bigVal 生成长度为 n 的值
+func bigVal(seed string, n int) string {
+	return strings.Repeat(seed, n/len(seed)+1)[:n]
+}
+
+func TestOverflow(t *testing.T) {
+	c := newC()
+	c.add("k", "v")
+	nPages := len(c.pages)
+
+	for _, n := range []int{BTreeMaxValSize, BTreeMaxValSize + 1, OverflowCap, OverflowCap + 1, 3*OverflowCap + 7} {
+		key := fmt.Sprintf("key%d", n)
+		c.add(key, bigVal(key, n))
+	}
+	c.verify(t)
+
+	// 更新和删除时释放旧的溢出页
+	for _, n := range []int{BTreeMaxValSize + 1, OverflowCap} {
+		c.add(fmt.Sprintf("key%d", n), "small")
+	}
+	c.add(fmt.Sprintf("key%d", OverflowCap+1), bigVal("x", 2*OverflowCap))
+	c.verify(t)
+	for _, n := range []int{BTreeMaxValSize, BTreeMaxValSize + 1, OverflowCap, OverflowCap + 1, 3*OverflowCap + 7} {
+		is.True(t, c.del(fmt.Sprintf("key%d", n)))
+	}
+	c.verify(t)
+	is.Equal(t, nPages, len(c.pages))
+
+	_, err := c.tree.Upsert([]byte("k"), make([]byte, MaxValSize+1))
+	is.Equal(t, ErrValueTooLarge, err)
+}
+
+func TestKVOverflow(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		c.add(key, bigVal(key, int(fmix32(uint32(i))%(4*BTreePageSize))))
+	}
+	c.verify(t)
+
+	// 读者看到的是旧值，旧值的溢出页不会被复用
+	r := c.db.BeginRead()
+	old, ok, err := r.Get([]byte("key1"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	old = bytes.Clone(old)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		switch i % 3 {
+		case 0:
+			c.add(key, "small")
+		case 1:
+			c.add(key, bigVal("new", 2*BTreePageSize))
+		case 2:
+			c.del(key)
+		}
+	}
+	c.verify(t)
+	val, _, err := r.Get([]byte("key1"))
+	is.NoError(t, err)
+	is.Equal(t, old, val)
+	n := 0
+	for iter := r.Seek(nil, CmpGt); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		is.Equal(t, bigVal(string(key), len(val)), string(val))
+		n++
+	}
+	is.Equal(t, 50, n)
+	r.EndRead()
+
+	c.reopen()
+	c.verify(t)
+	val, ok, err = c.db.Get([]byte("key1"))
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.Equal(t, bigVal("new", 2*BTreePageSize), string(val))
+
+	// 删除所有键后所有溢出页都回到空闲链表
+	for i := 0; i < 50; i++ {
+		c.del(fmt.Sprintf("key%d", i))
+	}
+	c.verify(t)
+}
+
+func TestTableOverflow(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:  "docs",
+		Cols:  []string{"id", "doc"},
+		Types: []uint32{TypeInt64, TypeBytes},
+		PKeys: 1,
+	})
+
+	doc := []byte(`{"data":"` + bigVal("json", 10*BTreePageSize) + `"}`)
+	rec := Record{}
+	rec.AddInt64("id", 1).AddStr("doc", doc)
+	r.add("docs", rec)
+
+	got := (&Record{}).AddInt64("id", 1)
+	is.True(t, r.get("docs", got))
+	is.Equal(t, doc, got.Get("doc").Str)
+
+	sc := Scanner{
+		Cmp1: CmpGe, Cmp2: CmpLe,
+		Key1: *(&Record{}).AddInt64("id", 0),
+		Key2: *(&Record{}).AddInt64("id", 10),
+	}
+	is.NoError(t, r.db.Scan("docs", &sc))
+	is.True(t, sc.Valid())
+	row := Record{}
+	is.NoError(t, sc.Deref(&row))
+	is.Equal(t, doc, row.Get("doc").Str)
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package core
+
+// raceEnabled 使用 -race 时测试缩小规模，见 heavy
+const raceEnabled = true
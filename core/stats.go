@@ -0,0 +1,103 @@
+package core
+
+import (
+	"encoding/binary"
+)
+
+// Stats KV 的运行时统计
+type Stats struct {
+	Levels   []TreeLevel // 从根开始每一层，树的高度是 len(Levels)
+	LeafFill float64     // 叶子结点的平均填充率
+	NodeFill float64     // 中间结点的平均填充率
+
+	Pages      uint64 // 文件中使用的页面数（page.flushed）
+	FreePages  uint64 // freelist 中的页面数（tailSeq - headSeq）
+	MmapChunks int    // 存储的映射块数，存储不支持时为 0
+	MmapSize   int64  // 映射的总大小
+
+	SyncStats
+	PagesWritten   uint64  // 写入主文件的页面数
+	PagesPerCommit float64 // 平均每次提交写入的页面数
+	FailedCommits  uint64  // 写入失败的提交
+	Reverts        uint64  // 失败之后恢复磁盘上的 meta（或使日志记录失效）的次数
+}
+
+// Stats 返回最新提交的统计信息，遍历整棵树，不阻塞读者和写者
+func (db *KV) Stats() (Stats, error) {
+	return collectStats(db, nil)
+}
+
+// collectStats 见 KV.Stats，leaf 见 treeWalk
+func collectStats(db *KV, leaf func(key []byte, size uint64)) (s Stats, err error) {
+	r := db.BeginRead()
+	meta := r.meta // 与树来自同一次提交
+	s.Levels, err = treeWalk(&r.tree, leaf)
+	r.EndRead()
+	if err != nil {
+		return Stats{}, err
+	}
+	// 所有中间结点一起计算填充率
+	var nodes, bytes uint64
+	for i, level := range s.Levels {
+		if i == len(s.Levels)-1 {
+			s.LeafFill = float64(level.Bytes) / float64(level.Nodes*uint64(db.PageSize))
+		} else {
+			nodes, bytes = nodes+level.Nodes, bytes+level.Bytes
+		}
+	}
+	if nodes > 0 {
+		s.NodeFill = float64(bytes) / float64(nodes*uint64(db.PageSize))
+	}
+
+	s.Pages = binary.LittleEndian.Uint64(meta[8:])
+	s.FreePages = binary.LittleEndian.Uint64(meta[40:]) - binary.LittleEndian.Uint64(meta[24:])
+	if m, ok := db.Store.(mappedStorage); ok {
+		s.MmapChunks, s.MmapSize = m.Mapped()
+	}
+
+	s.SyncStats = db.SyncStats()
+	s.PagesWritten = db.stats.pages.Load()
+	if s.Commits > 0 {
+		s.PagesPerCommit = float64(s.PagesWritten) / float64(s.Commits)
+	}
+	s.FailedCommits = db.stats.failed.Load()
+	s.Reverts = db.stats.reverts.Load()
+	return s, nil
+}
+
+// TableStats 一个表的统计
+type TableStats struct {
+	Name  string
+	Rows  uint64 // 记录数
+	Bytes uint64 // 键和值的字节数，溢出页中的值按长度计算，不包括结点的开销
+}
+
+// DBStats DB 的运行时统计
+type DBStats struct {
+	Stats
+	Tables []TableStats // 按表名排序
+}
+
+// Stats 在 KV.Stats 的基础上统计每个表的记录数和大小
+func (db *DB) Stats() (DBStats, error) {
+	tdefs, err := db.Tables()
+	if err != nil {
+		return DBStats{}, err
+	}
+	s := DBStats{Tables: make([]TableStats, len(tdefs))}
+	prefixes := map[uint32]*TableStats{}
+	for i, tdef := range tdefs {
+		s.Tables[i].Name = tdef.Name
+		prefixes[tdef.Prefix] = &s.Tables[i]
+	}
+	s.Stats, err = collectStats(&db.kv, func(key []byte, size uint64) {
+		if len(key) < 4 {
+			return // 哨兵
+		}
+		if t := prefixes[binary.BigEndian.Uint32(key)]; t != nil {
+			t.Rows++
+			t.Bytes += uint64(len(key)) + size
+		}
+	})
+	return s, err
+}
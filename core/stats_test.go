@@ -0,0 +1,89 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	s, err := c.db.Stats()
+	is.NoError(t, err)
+	is.Empty(t, s.Levels)
+	is.NotZero(t, s.MmapChunks)
+
+	for i := 0; i < 3000; i++ {
+		c.add(fmt.Sprintf("key%05d", i), bigVal("v", i%300))
+	}
+	for i := 0; i < 3000; i += 3 {
+		c.del(fmt.Sprintf("key%05d", i))
+	}
+	s, err = c.db.Stats()
+	is.NoError(t, err)
+	report, err := c.db.Check()
+	is.NoError(t, err)
+	is.Equal(t, report.Depth, len(s.Levels))
+	nodes := uint64(0)
+	for _, level := range s.Levels {
+		nodes += level.Nodes
+	}
+	is.Equal(t, report.Nodes, nodes)
+	is.Equal(t, c.db.page.flushed, s.Pages)
+	is.Equal(t, report.Free, s.FreePages)
+	is.True(t, s.LeafFill > 0 && s.LeafFill <= 1)
+	is.True(t, s.NodeFill > 0 && s.NodeFill <= 1)
+	is.True(t, s.MmapSize >= int64(s.Pages)*int64(c.db.PageSize))
+	is.Equal(t, uint64(4000), s.Commits)
+	is.True(t, s.PagesWritten >= s.Commits)
+	is.True(t, s.PagesPerCommit >= 1)
+	is.Zero(t, s.FailedCommits)
+	is.Zero(t, s.Reverts)
+
+	// 失败的提交和下一次提交之前的恢复
+	c.store.SyncErr = fsyncErr(1)
+	_, err = c.db.Set([]byte("k"), []byte("v"))
+	is.Error(t, err)
+	c.store.SyncErr = nil
+	c.add("k", "v")
+	s, err = c.db.Stats()
+	is.NoError(t, err)
+	is.Equal(t, uint64(4001), s.Commits)
+	is.Equal(t, uint64(1), s.FailedCommits)
+	is.Equal(t, uint64(1), s.Reverts)
+	is.Equal(t, uint64(1), s.Failures)
+}
+
+func TestDBStats(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	for _, name := range []string{"b", "a"} {
+		r.create(&TableDef{
+			Name:  name,
+			Types: []uint32{TypeInt64, TypeBytes},
+			Cols:  []string{"id", "name"},
+			PKeys: 1,
+		})
+	}
+	for i := 0; i < 500; i++ {
+		r.add("a", *(&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(bigVal("a", i*13))))
+	}
+	for i := 0; i < 200; i++ {
+		r.add("b", *(&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte("b")))
+	}
+	r.del("b", *(&Record{}).AddInt64("id", 7))
+
+	s, err := r.db.Stats()
+	is.NoError(t, err)
+	is.Equal(t, 2, len(s.Tables))
+	is.Equal(t, "a", s.Tables[0].Name)
+	is.Equal(t, "b", s.Tables[1].Name)
+	is.Equal(t, uint64(500), s.Tables[0].Rows)
+	is.Equal(t, uint64(199), s.Tables[1].Rows)
+	is.True(t, s.Tables[0].Bytes > s.Tables[1].Bytes)
+	is.True(t, s.Tables[0].Bytes > 13*499*500/2) // 值的长度之和
+	is.NotEmpty(t, s.Levels)
+	is.NotZero(t, s.MmapChunks)
+}
@@ -0,0 +1,64 @@
+package core
+
+// Storage KV 的存储后端
+// KV 通过它读取页面（只读切片，在 Close 之前有效），写入页面和 meta，
+// 以及扩展可读范围和持久化。Read 可以与写者的调用并发。
+type Storage interface {
+	// Open 打开存储，Close 之后可以重新打开
+	Open() error
+	// Close 关闭存储
+	Close() error
+	// Read 读取 offset 处 size 字节的页面，调用前必须已经 Extend 到该位置
+	Read(offset int64, size int) []byte
+	// Write 将 data 写入 offset 处
+	Write(offset int64, data []byte) error
+	// Size 返回已写入数据的大小
+	Size() (int64, error)
+	// Extend 保证 Read 可以读取前 size 字节
+	Extend(size int64) error
+	// Sync 持久化之前的所有写入
+	Sync() error
+	// Truncate 将数据截断为 size 字节，之后不能再读取被截断的部分
+	Truncate(size int64) error
+}
+
+// mappedStorage 可以报告映射大小的存储后端，见 KV.Stats
+type mappedStorage interface {
+	// Mapped 返回映射的块数和总大小
+	Mapped() (int, int64)
+}
+
+// FaultStorage 包装另一个存储后端并注入错误，用于测试
+type FaultStorage struct {
+	Storage
+	WriteErr func(offset int64, data []byte) error // 返回非 nil 时写入失败
+	SyncErr  func() error                          // 返回非 nil 时 sync 失败
+}
+
+// Write 写入数据，可能被注入错误
+func (s *FaultStorage) Write(offset int64, data []byte) error {
+	if s.WriteErr != nil {
+		if err := s.WriteErr(offset, data); err != nil {
+			return err
+		}
+	}
+	return s.Storage.Write(offset, data)
+}
+
+// Sync 持久化，可能被注入错误
+func (s *FaultStorage) Sync() error {
+	if s.SyncErr != nil {
+		if err := s.SyncErr(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.Sync()
+}
+
+// Mapped 返回被包装的存储的映射大小，不支持时为 0
+func (s *FaultStorage) Mapped() (int, int64) {
+	if m, ok := s.Storage.(mappedStorage); ok {
+		return m.Mapped()
+	}
+	return 0, 0
+}
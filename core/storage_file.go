@@ -0,0 +1,181 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync/atomic"
+	"syscall"
+
+	"db-practice/util"
+)
+
+// FileStorage 基于文件和 mmap 的存储后端
+// 页面通过 mmap 读取，通过 pwrite 写入。
+type FileStorage struct {
+	Path     string
+	Fsync    func(int) error // 默认为 syscall.Fsync，测试时可以替换
+	ReadOnly bool            // 只读打开已经存在的文件
+
+	fd   int
+	mmap struct {
+		total  int64                    // mmap 大小，可以大于文件大小
+		chunks atomic.Pointer[[][]byte] // 多个 mmap，可以是非连续的；读者并发读取
+	}
+}
+
+// Open 打开或创建文件，只读时文件必须存在
+func (fs *FileStorage) Open() error {
+	if fs.Fsync == nil {
+		fs.Fsync = syscall.Fsync
+	}
+	fs.mmap.total = 0
+	fs.mmap.chunks.Store(&[][]byte{})
+	var err error
+	if fs.ReadOnly {
+		fs.fd, err = syscall.Open(fs.Path, os.O_RDONLY, 0)
+		return err
+	}
+	fs.fd, err = createFileSync(fs.Path)
+	return err
+}
+
+// Close 解除映射并关闭文件
+func (fs *FileStorage) Close() error {
+	for _, chunk := range *fs.mmap.chunks.Load() {
+		err := syscall.Munmap(chunk)
+		util.Assert(err == nil)
+	}
+	fs.mmap.chunks.Store(&[][]byte{})
+	return syscall.Close(fs.fd)
+}
+
+// Read 从 mmap 中读取
+func (fs *FileStorage) Read(offset int64, size int) []byte {
+	return mmapRead(*fs.mmap.chunks.Load(), offset, size)
+}
+
+// mmapRead 从 mmap 中读取 offset 处的 size 字节
+func mmapRead(chunks [][]byte, offset int64, size int) []byte {
+	return mmapTail(chunks, offset)[:size]
+}
+
+// mmapTail 返回 offset 所在的块中从 offset 开始的部分
+func mmapTail(chunks [][]byte, offset int64) []byte {
+	start := int64(0)
+	for _, chunk := range chunks {
+		end := start + int64(len(chunk))
+		if offset < end {
+			return chunk[offset-start:]
+		}
+		start = end
+	}
+	panic("bad ptr")
+}
+
+// Mapped 返回 mmap 的块数和总大小
+func (fs *FileStorage) Mapped() (int, int64) {
+	return mmapSize(*fs.mmap.chunks.Load())
+}
+
+// mmapSize 返回块数和总大小
+func mmapSize(chunks [][]byte) (int, int64) {
+	size := int64(0)
+	for _, chunk := range chunks {
+		size += int64(len(chunk))
+	}
+	return len(chunks), size
+}
+
+// Write 写入文件
+func (fs *FileStorage) Write(offset int64, data []byte) error {
+	_, err := syscall.Pwrite(fs.fd, data, offset)
+	return err
+}
+
+// Size 返回文件大小
+func (fs *FileStorage) Size() (int64, error) {
+	fInfo := syscall.Stat_t{}
+	if err := syscall.Fstat(fs.fd, &fInfo); err != nil {
+		return 0, err
+	}
+	return fInfo.Size, nil
+}
+
+// Extend 通过添加新映射来扩展 mmap
+func (fs *FileStorage) Extend(size int64) error {
+	if size <= fs.mmap.total {
+		return nil
+	}
+	alloc := max(fs.mmap.total, 64<<20)
+	for fs.mmap.total+alloc < size {
+		// 地址空间翻倍
+		alloc *= 2
+	}
+
+	chunk, err := syscall.Mmap(fs.fd, fs.mmap.total, int(alloc), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	fs.mmap.total += alloc
+	// 读者可能正在使用旧的 chunks，复制后再替换
+	chunks := append(slices.Clip(*fs.mmap.chunks.Load()), chunk)
+	fs.mmap.chunks.Store(&chunks)
+	return nil
+}
+
+// Truncate 截断文件，解除完全在 size 之后的映射
+// 包含 size 的块保持不变，文件重新增长之后映射仍然有效；
+// 调用者保证没有读者读取被截断的部分，见 KV.truncate。
+func (fs *FileStorage) Truncate(size int64) error {
+	if err := syscall.Ftruncate(fs.fd, size); err != nil {
+		return err
+	}
+	chunks := *fs.mmap.chunks.Load()
+	keep, start := 0, int64(0)
+	for keep < len(chunks) && start <= size {
+		start += int64(len(chunks[keep]))
+		keep++
+	}
+	if keep == len(chunks) {
+		return nil
+	}
+	kept := slices.Clip(chunks[:keep])
+	fs.mmap.chunks.Store(&kept)
+	fs.mmap.total = start
+	for _, chunk := range chunks[keep:] {
+		if err := syscall.Munmap(chunk); err != nil {
+			return fmt.Errorf("munmap: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sync 持久化文件
+func (fs *FileStorage) Sync() error {
+	return fs.Fsync(fs.fd)
+}
+
+// createFileSync 创建文件并同步目录
+func createFileSync(file string) (int, error) {
+	flags := os.O_RDONLY | syscall.O_DIRECTORY
+	dirFd, err := syscall.Open(path.Dir(file), flags, 0o664)
+	if err != nil {
+		return -1, fmt.Errorf("open directory: %w", err)
+	}
+	defer func(fd int) {
+		_ = syscall.Close(fd)
+	}(dirFd)
+
+	flags = os.O_RDWR | os.O_CREATE
+	fd, err := util.Openat(dirFd, path.Base(file), flags, 0o664)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	if err = syscall.Fsync(dirFd); err != nil {
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("fsync directory: %w", err)
+	}
+	return fd, nil
+}
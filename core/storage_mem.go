@@ -0,0 +1,101 @@
+package core
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// MemStorage 纯内存的存储后端，用于单元测试和临时数据库
+// 与 mmap 一样由多个只增长的块组成，已返回的切片始终有效。
+// Close 不会丢弃数据，同一个 MemStorage 可以重新打开。
+type MemStorage struct {
+	mu     sync.Mutex // 保护 size 和 total
+	size   int64
+	total  int64
+	chunks atomic.Pointer[[][]byte]
+}
+
+// Open 打开存储
+func (m *MemStorage) Open() error {
+	if m.chunks.Load() == nil {
+		m.chunks.Store(&[][]byte{})
+	}
+	return nil
+}
+
+// Close 关闭存储，数据保留在内存中
+func (m *MemStorage) Close() error {
+	return nil
+}
+
+// Read 读取数据
+func (m *MemStorage) Read(offset int64, size int) []byte {
+	return mmapRead(*m.chunks.Load(), offset, size)
+}
+
+// Write 写入数据
+func (m *MemStorage) Write(offset int64, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.extend(offset + int64(len(data)))
+	for chunks := *m.chunks.Load(); len(data) > 0; {
+		n := copy(mmapTail(chunks, offset), data)
+		offset, data = offset+int64(n), data[n:]
+		m.size = max(m.size, offset)
+	}
+	return nil
+}
+
+// Size 返回已写入数据的大小
+func (m *MemStorage) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size, nil
+}
+
+// Extend 扩展可读范围
+func (m *MemStorage) Extend(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.extend(size)
+	return nil
+}
+
+// extend 添加新的块
+func (m *MemStorage) extend(size int64) {
+	if size <= m.total {
+		return
+	}
+	alloc := max(m.total, 1<<20)
+	for m.total+alloc < size {
+		alloc *= 2
+	}
+	m.total += alloc
+	chunks := append(slices.Clip(*m.chunks.Load()), make([]byte, alloc))
+	m.chunks.Store(&chunks)
+}
+
+// Truncate 截断数据，被截断的部分清零，块保留在内存中
+func (m *MemStorage) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for offset, chunks := size, *m.chunks.Load(); offset < m.size; {
+		tail := mmapTail(chunks, offset)
+		n := min(int64(len(tail)), m.size-offset)
+		clear(tail[:n])
+		offset += n
+	}
+	m.size = min(m.size, size)
+	return nil
+}
+
+// Mapped 返回块数和总大小
+func (m *MemStorage) Mapped() (int, int64) {
+	return mmapSize(*m.chunks.Load())
+}
+
+// Sync 内存中的数据无需持久化
+func (m *MemStorage) Sync() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	noFsync := func(int) error { return nil }
+
+	db := KV{Store: &FileStorage{Path: path, Fsync: noFsync}}
+	is.NoError(t, db.Open())
+	for i := 0; i < 2000; i++ {
+		_, err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+		is.NoError(t, err)
+	}
+	db.Close()
+
+	// 默认使用 Path 对应的文件
+	db = KV{Path: path}
+	is.NoError(t, db.Open())
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		val, ok, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		is.NoError(t, err)
+		is.True(t, ok)
+		is.Equal(t, fmt.Sprintf("val%d", i), string(val))
+	}
+	size, err := db.Store.Size()
+	is.NoError(t, err)
+	is.Equal(t, int64(db.page.flushed*BTreePageSize), size)
+
+	// 压缩之后截断文件，文件重新增长之后 mmap 仍然有效
+	for i := 100; i < 2000; i++ {
+		_, err = db.Del([]byte(fmt.Sprintf("key%d", i)))
+		is.NoError(t, err)
+	}
+	is.NoError(t, db.Compact())
+	small, err := db.Store.Size()
+	is.NoError(t, err)
+	is.True(t, small < size)
+	for i := 0; i < 2000; i++ {
+		_, err = db.Set([]byte(fmt.Sprintf("new%d", i)), []byte(fmt.Sprintf("val%d", i)))
+		is.NoError(t, err)
+	}
+	val, ok, err := db.Get([]byte("new1999"))
+	is.True(t, ok && err == nil)
+	is.Equal(t, "val1999", string(val))
+}
+
+func TestMemStorage(t *testing.T) {
+	m := &MemStorage{}
+	is.NoError(t, m.Open())
+	size, err := m.Size()
+	is.NoError(t, err)
+	is.Zero(t, size)
+
+	// 跨越多个块的写入
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	is.NoError(t, m.Write(100, data))
+	size, _ = m.Size()
+	is.Equal(t, int64(100+len(data)), size)
+	for _, off := range []int64{100, 1 << 20, 2<<20 - 10, 3 << 20} {
+		is.Equal(t, data[off-100:off-100+10], m.Read(off, 10))
+	}
+
+	// 已返回的切片在扩展后仍然有效
+	page := m.Read(0, BTreePageSize)
+	is.NoError(t, m.Extend(64<<20))
+	is.NoError(t, m.Write(0, []byte{1, 2, 3}))
+	is.Equal(t, []byte{1, 2, 3}, page[:3])
+
+	// Close 之后数据仍然保留
+	is.NoError(t, m.Close())
+	is.NoError(t, m.Open())
+	is.Equal(t, []byte{1, 2, 3}, m.Read(0, 3))
+
+	// 截断的部分重新写入之前读取为 0
+	is.NoError(t, m.Truncate(2))
+	size, _ = m.Size()
+	is.Equal(t, int64(2), size)
+	is.NoError(t, m.Write(1<<20, []byte{1}))
+	is.Equal(t, []byte{1, 2, 0, 0}, m.Read(0, 4))
+	is.Equal(t, make([]byte, 10), m.Read(2<<20, 10))
+}
+
+func TestFaultStorage(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	c.add("k", "1")
+
+	// 写入页面失败时回滚
+	c.store.WriteErr = func(offset int64, data []byte) error {
+		return errors.New("write error")
+	}
+	_, err := c.db.Set([]byte("k"), []byte("2"))
+	is.Error(t, err)
+	c.store.WriteErr = nil
+	c.verify(t)
+
+	// 只有 meta 写入失败
+	c.store.WriteErr = func(offset int64, data []byte) error {
+		if offset < BTreePageSize {
+			return errors.New("write error")
+		}
+		return nil
+	}
+	_, err = c.db.Set([]byte("k"), []byte("3"))
+	is.Error(t, err)
+	c.store.WriteErr = nil
+	c.verify(t)
+
+	c.add("k", "4")
+	c.verify(t)
+	c.reopen()
+	c.verify(t)
+}
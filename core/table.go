@@ -5,6 +5,9 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"iter"
+	"sync"
+	"time"
 
 	"db-practice/util"
 )
@@ -93,17 +96,48 @@ type DBUpdateReq struct {
 }
 
 type DB struct {
-	Path string
+	Path  string
+	Store Storage // 存储后端，为空时使用 Path 对应的文件
+	// 页面大小，见 KV.PageSize
+	PageSize int
+	// 见 KV.PrefixCompression
+	PrefixCompression bool
+	// 见 KV.Durability、KV.SyncInterval 和 KV.SyncCommits
+	Durability   int
+	SyncInterval time.Duration
+	SyncCommits  int
+	// 见 KV.WAL、KV.Log 和 KV.CheckpointSize
+	WAL            bool
+	Log            Storage
+	CheckpointSize int64
+	// 见 KV.ReadOnly
+	ReadOnly bool
 	// internal
 	kv     KV
+	mu     sync.RWMutex         // 保护 tables，DB.Get 和 DB.Scan 不持有写锁
 	tables map[string]*TableDef // cached table schemas
+	ops    sync.Map             // 表名 -> *tableOps，见 DB.MetricsHandler
 }
 
 // Open 打开数据库
 func (db *DB) Open() error {
 	db.kv.Path = db.Path
+	db.kv.Store = db.Store
+	db.kv.PageSize = db.PageSize
+	db.kv.PrefixCompression = db.PrefixCompression
+	db.kv.Durability = db.Durability
+	db.kv.SyncInterval = db.SyncInterval
+	db.kv.SyncCommits = db.SyncCommits
+	db.kv.WAL = db.WAL
+	db.kv.Log = db.Log
+	db.kv.CheckpointSize = db.CheckpointSize
+	db.kv.ReadOnly = db.ReadOnly
 	db.tables = map[string]*TableDef{}
-	return db.kv.Open()
+	if err := db.kv.Open(); err != nil {
+		return err
+	}
+	db.PageSize = db.kv.PageSize
+	return nil
 }
 
 // Close 关闭数据库
@@ -111,53 +145,115 @@ func (db *DB) Close() {
 	db.kv.Close()
 }
 
+// Sync 持久化之前的所有提交，见 KV.Sync
+func (db *DB) Sync() error {
+	return db.kv.Sync()
+}
+
+// SyncStats 返回持久化的统计信息
+func (db *DB) SyncStats() SyncStats {
+	return db.kv.SyncStats()
+}
+
+// Checkpoint 见 KV.Checkpoint
+func (db *DB) Checkpoint() error {
+	return db.kv.Checkpoint()
+}
+
+// Check 见 KV.Check
+func (db *DB) Check() (CheckReport, error) {
+	return db.kv.Check()
+}
+
+// Meta 见 KV.Meta
+func (db *DB) Meta() MetaInfo {
+	return db.kv.Meta()
+}
+
+// Page 见 KV.Page
+func (db *DB) Page(ptr uint64) (PageInfo, error) {
+	return db.kv.Page(ptr)
+}
+
+// TreeLevels 见 KV.TreeLevels
+func (db *DB) TreeLevels() ([]TreeLevel, error) {
+	return db.kv.TreeLevels()
+}
+
+// ExportTree 见 KV.ExportTree
+func (db *DB) ExportTree(maxDepth int) (*ExportNode, error) {
+	return db.kv.ExportTree(maxDepth)
+}
+
+// Compact 见 KV.Compact
+func (db *DB) Compact() error {
+	return db.kv.Compact()
+}
+
+// CompactStep 见 KV.CompactStep
+func (db *DB) CompactStep(limit int) (bool, error) {
+	return db.kv.CompactStep(limit)
+}
+
 // TableNew 创建新表
 func (db *DB) TableNew(tdef *TableDef) error {
-	// 0. 健全性检查
-	if err := tableDefCheck(tdef); err != nil {
+	tx := db.Begin()
+	if err := tx.TableNew(tdef); err != nil {
+		tx.Abort()
 		return err
 	}
-	// 1. 检查现有表
-	table := (&Record{}).AddStr("name", []byte(tdef.Name))
-	ok, err := dbGet(db, TdefTable, table)
-	util.Assert(err == nil)
-	if ok {
-		return fmt.Errorf("table exists: %s", tdef.Name)
-	}
-	// 2. 分配新前缀
-	util.Assert(tdef.Prefix == 0)
-	tdef.Prefix = TablePrefixMin
-	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = dbGet(db, TdefMeta, meta)
-	util.Assert(err == nil)
-	if ok {
-		tdef.Prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
-		util.Assert(tdef.Prefix > TablePrefixMin)
-	} else {
-		meta.AddStr("val", make([]byte, 4))
+	return tx.Commit()
+}
+
+// Tables 返回 @table 中所有表的定义，按表名排序，不包括内部表
+func (db *DB) Tables() (tdefs []TableDef, err error) {
+	r := db.kv.BeginRead()
+	defer r.EndRead()
+	start := encodeKey(nil, TdefTable.Prefix, nil)
+	iter := r.Seek(start, CmpGe)
+	for ; iter.Valid() && bytes.HasPrefix(iter.Key(), start); iter.Next() {
+		key, val := iter.Deref()
+		vals := []Value{{Type: TypeBytes}, {Type: TypeBytes}}
+		if err = decodeKey(key, vals[:1]); err != nil {
+			return nil, err
+		}
+		if err = decodeValues(val, vals[1:]); err != nil {
+			return nil, err
+		}
+		tdef := TableDef{}
+		if err = json.Unmarshal(vals[1].Str, &tdef); err != nil {
+			return nil, fmt.Errorf("%w: table %s: %v", ErrCorrupt, vals[0].Str, err)
+		}
+		tdefs = append(tdefs, tdef)
 	}
-	// 3. 更新下一个前缀
-	// FIXME: integer overflow.
-	binary.LittleEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+1)
-	_, err = dbUpdate(db, TdefMeta, &DBUpdateReq{Record: *meta})
-	if err != nil {
-		return err
+	return tdefs, iter.Err()
+}
+
+// DecodeKey 将表中的 B 树键解码为主键的列
+func (tdef *TableDef) DecodeKey(key []byte) (Record, error) {
+	if len(key) < 4 || binary.BigEndian.Uint32(key) != tdef.Prefix {
+		return Record{}, fmt.Errorf("key not in table %s", tdef.Name)
 	}
-	// 4. 存储 schema
-	val, err := json.Marshal(tdef)
-	util.Assert(err == nil)
-	table.AddStr("def", val)
-	_, err = dbUpdate(db, TdefTable, &DBUpdateReq{Record: *table})
-	return err
+	rec := Record{Cols: tdef.Cols[:tdef.PKeys], Vals: make([]Value, tdef.PKeys)}
+	for i := range rec.Vals {
+		rec.Vals[i].Type = tdef.Types[i]
+	}
+	return rec, decodeKey(key, rec.Vals)
 }
 
-// Get 获取记录
+// Get 在最新提交的快照中获取记录，不等待写者
 func (db *DB) Get(table string, rec *Record) (bool, error) {
-	tdef := getTableDef(db, table)
+	r := db.kv.BeginRead()
+	defer r.EndRead()
+	tdef, err := readTableDef(db, r, table)
+	if err != nil {
+		return false, err
+	}
 	if tdef == nil {
 		return false, fmt.Errorf("table %s not found", table)
 	}
-	return dbGet(db, tdef, rec)
+	countOp(db, table, opGet)
+	return dbGet(r, tdef, rec)
 }
 
 // Insert 插入记录
@@ -167,11 +263,17 @@ func (db *DB) Insert(table string, rec Record) (bool, error) {
 
 // Set 添加记录
 func (db *DB) Set(table string, dbReq *DBUpdateReq) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	tx := db.Begin()
+	updated, err := tx.Set(table, dbReq)
+	if err != nil {
+		tx.Abort()
+		return false, err
 	}
-	return dbUpdate(db, tdef, dbReq)
+	if err = tx.Commit(); err != nil {
+		dbReq.Added, dbReq.Updated = false, false
+		return false, err
+	}
+	return updated, nil
 }
 
 // Update 更新记录
@@ -184,65 +286,131 @@ func (db *DB) Upsert(table string, rec Record) (bool, error) {
 	return db.Set(table, &DBUpdateReq{Record: rec, Mode: ModeUpsert})
 }
 
+// BulkLoad 按主键严格递增的顺序批量加载记录，只提交一次
+func (db *DB) BulkLoad(table string, recs iter.Seq[Record], fill float64) error {
+	tx := db.Begin()
+	if err := tx.BulkLoad(table, recs, fill); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
 // Delete 删除记录
 func (db *DB) Delete(table string, rec Record) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	tx := db.Begin()
+	deleted, err := tx.Delete(table, rec)
+	if err != nil {
+		tx.Abort()
+		return false, err
 	}
-	return dbDelete(db, tdef, rec)
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return deleted, nil
 }
 
-// Scan 扫描记录
+// Scan 扫描已提交的记录，不等待写者
+// 记录分批在短的读事务中读取，扫描不固定快照，也不需要关闭；
+// 每一行都来自某次提交，但扫描期间的提交可能只有一部分可见，见 readIter。
 func (db *DB) Scan(table string, req *Scanner) error {
-	tdef := getTableDef(db, table)
+	r := db.kv.BeginRead()
+	tdef, err := readTableDef(db, r, table)
+	r.EndRead()
+	if err != nil {
+		return err
+	}
 	if tdef == nil {
 		return fmt.Errorf("table not found: %s", table)
 	}
-	return dbScan(db, tdef, req)
+	countOp(db, table, opScan)
+	return dbScan(func(key []byte, cmp int) scanIter {
+		return seekRead(&db.kv, key, cmp)
+	}, tdef, req)
 }
 
 // dbDelete 按主键删除记录
-func dbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
 	values, err := checkRecord(tdef, rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	return db.kv.Del(key)
+	return tx.kv.Del(key)
+}
+
+// getTableDef 获取表定义，表不存在时返回 nil
+func getTableDef(tx *DBTX, name string) (*TableDef, error) {
+	if tdef, ok := InternalTables[name]; ok {
+		return tdef, nil // 暴露内部表
+	}
+	if tdef := tx.tables[name]; tdef != nil {
+		return tdef, nil
+	}
+	tx.db.mu.RLock()
+	tdef := tx.db.tables[name]
+	tx.db.mu.RUnlock()
+	if tdef != nil {
+		return tdef, nil
+	}
+	// 在事务提交前只缓存到事务中
+	tdef, err := getTableDefDB(tx.kv, name)
+	if tdef != nil {
+		tx.tables[name] = tdef
+	}
+	return tdef, err
 }
 
-// getTableDef 获取表定义
-func getTableDef(db *DB, name string) *TableDef {
+// readTableDef 在读事务中获取表定义，表不存在时返回 nil
+// 快照中的表定义已经提交，可以直接缓存到 DB.tables。
+func readTableDef(db *DB, r *KVReader, name string) (*TableDef, error) {
 	if tdef, ok := InternalTables[name]; ok {
-		return tdef // 暴露内部表
+		return tdef, nil
 	}
+	db.mu.RLock()
 	tdef := db.tables[name]
-	if tdef == nil {
-		if tdef = getTableDefDB(db, name); tdef != nil {
+	db.mu.RUnlock()
+	if tdef != nil {
+		return tdef, nil
+	}
+	tdef, err := getTableDefDB(r, name)
+	if tdef != nil {
+		db.mu.Lock()
+		if cached := db.tables[name]; cached != nil {
+			tdef = cached
+		} else {
 			db.tables[name] = tdef
 		}
+		db.mu.Unlock()
 	}
-	return tdef
+	return tdef, err
+}
+
+// kvRead 表的读取，DBTX 读取事务中的树（KVTX），DB 读取已提交的快照（KVReader）
+type kvRead interface {
+	Get(key []byte) ([]byte, bool, error)
 }
 
 // getTableDefDB 获取表定义
-func getTableDefDB(db *DB, name string) *TableDef {
+func getTableDefDB(kv kvRead, name string) (*TableDef, error) {
 	rec := (&Record{}).AddStr("name", []byte(name))
-	ok, err := dbGet(db, TdefTable, rec)
-	util.Assert(err == nil)
-	if !ok {
-		return nil
+	ok, err := dbGet(kv, TdefTable, rec)
+	if err != nil || !ok {
+		return nil, err
 	}
 	tdef := &TableDef{}
-	err = json.Unmarshal(rec.Get("def").Str, tdef)
-	util.Assert(err == nil)
-	return tdef
+	if err = json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrCorrupt, name, err)
+	}
+	if err = tableDefCheck(tdef); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return tdef, nil
 }
 
 // dbGet 根据主键获取一行记录
-func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
+func dbGet(kv kvRead, tdef *TableDef, rec *Record) (bool, error) {
 	// 根据模式对输入列排序
 	values, err := checkRecord(tdef, *rec, tdef.PKeys)
 	if err != nil {
@@ -250,15 +418,17 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	}
 	// 编码主键
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	val, ok := db.kv.Get(key)
-	if !ok {
-		return false, nil
+	val, ok, err := kv.Get(key)
+	if err != nil || !ok {
+		return false, err
 	}
 	// 将值解码为列
 	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
 		values[i].Type = tdef.Types[i]
 	}
-	decodeValues(val, values[tdef.PKeys:])
+	if err = decodeValues(val, values[tdef.PKeys:]); err != nil {
+		return false, err
+	}
 	rec.Cols = tdef.Cols
 	rec.Vals = values
 	return true, nil
@@ -266,7 +436,9 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 
 // reorderRecord 将Record按TableDef的顺序重新排列
 func reorderRecord(tdef *TableDef, rec Record) ([]Value, error) {
-	util.Assert(len(rec.Cols) == len(rec.Vals))
+	if len(rec.Cols) != len(rec.Vals) {
+		return nil, fmt.Errorf("bad record: %d columns, %d values", len(rec.Cols), len(rec.Vals))
+	}
 	out := make([]Value, len(tdef.Cols))
 	for i, c := range tdef.Cols {
 		v := rec.Get(c)
@@ -320,8 +492,11 @@ func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 }
 
 // decodeKey 解码主键
-func decodeKey(in []byte, out []Value) {
-	decodeValues(in[4:], out)
+func decodeKey(in []byte, out []Value) error {
+	if len(in) < 4 {
+		return fmt.Errorf("%w: bad key", ErrCorrupt)
+	}
+	return decodeValues(in[4:], out)
 }
 
 // encodeValues 保序编码
@@ -344,23 +519,35 @@ func encodeValues(out []byte, vals []Value) []byte {
 }
 
 // decodeValues 解码保序编码的值
-func decodeValues(in []byte, out []Value) {
+func decodeValues(in []byte, out []Value) error {
 	for i := range out {
 		switch out[i].Type {
 		case TypeInt64:
+			if len(in) < 8 {
+				return fmt.Errorf("%w: bad int64 value", ErrCorrupt)
+			}
 			u := binary.BigEndian.Uint64(in[:8])
 			out[i].I64 = int64(u - (1 << 63))
 			in = in[8:]
 		case TypeBytes:
 			idx := bytes.IndexByte(in, 0)
-			util.Assert(idx >= 0)
-			out[i].Str = unescapeString(in[:idx])
+			if idx < 0 {
+				return fmt.Errorf("%w: unterminated string", ErrCorrupt)
+			}
+			str, err := unescapeString(in[:idx])
+			if err != nil {
+				return err
+			}
+			out[i].Str = str
 			in = in[idx+1:]
 		default:
 			panic("unexpected type")
 		}
 	}
-	util.Assert(len(in) == 0)
+	if len(in) != 0 {
+		return fmt.Errorf("%w: trailing bytes", ErrCorrupt)
+	}
+	return nil
 }
 
 // escapeString 转义 null 字节，以便字符串不包含 null 字节
@@ -389,9 +576,9 @@ func escapeString(in []byte) []byte {
 }
 
 // unescapeString 取消转义 null 字节
-func unescapeString(in []byte) []byte {
+func unescapeString(in []byte) ([]byte, error) {
 	if bytes.Count(in, []byte{1}) == 0 {
-		return in // 快速判断：无转义
+		return in, nil // 快速判断：无转义
 	}
 
 	out := make([]byte, 0, len(in))
@@ -400,17 +587,19 @@ func unescapeString(in []byte) []byte {
 			// 01 01 -> 00
 			// 01 02 -> 01
 			i++
-			util.Assert(in[i] == 1 || in[i] == 2)
+			if !(i < len(in) && (in[i] == 1 || in[i] == 2)) {
+				return nil, fmt.Errorf("%w: bad escape", ErrCorrupt)
+			}
 			out = append(out, in[i]-1)
 		} else {
 			out = append(out, in[i])
 		}
 	}
-	return out
+	return out, nil
 }
 
 // dbUpdate 更新记录
-func dbUpdate(db *DB, tdef *TableDef, dbReq *DBUpdateReq) (bool, error) {
+func dbUpdate(tx *DBTX, tdef *TableDef, dbReq *DBUpdateReq) (bool, error) {
 	values, err := checkRecord(tdef, dbReq.Record, len(tdef.Cols))
 	if err != nil {
 		return false, err
@@ -418,18 +607,46 @@ func dbUpdate(db *DB, tdef *TableDef, dbReq *DBUpdateReq) (bool, error) {
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
 	val := encodeValues(nil, values[tdef.PKeys:])
 	req := UpdateReq{Key: key, Val: val, Mode: dbReq.Mode}
-	if _, err = db.kv.Update(&req); err != nil {
+	if _, err = tx.kv.Update(&req); err != nil {
 		return false, err
 	}
 	dbReq.Added, dbReq.Updated = req.Added, req.Updated
 	return req.Updated, nil
 }
 
+// dbBulkLoad 编码记录之后批量加载，记录不完整时停止并返回错误
+func dbBulkLoad(tx *DBTX, tdef *TableDef, recs iter.Seq[Record], fill float64) error {
+	var recErr error
+	items := func(yield func([]byte, []byte) bool) {
+		for rec := range recs {
+			values, err := checkRecord(tdef, rec, len(tdef.Cols))
+			if err != nil {
+				recErr = err
+				return
+			}
+			key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+			if !yield(key, encodeValues(nil, values[tdef.PKeys:])) {
+				return
+			}
+		}
+	}
+	err := tx.kv.BulkLoad(items, fill)
+	if recErr != nil {
+		// 加载了一部分的树不能提交
+		tx.kv.err = recErr
+		return recErr
+	}
+	return err
+}
+
 // tableDefCheck 检查表定义
 func tableDefCheck(tdef *TableDef) error {
 	bad := tdef.Name == "" || len(tdef.Cols) == 0
 	bad = bad || len(tdef.Cols) != len(tdef.Types)
 	bad = bad || !(1 <= tdef.PKeys && tdef.PKeys <= len(tdef.Cols))
+	for _, typ := range tdef.Types {
+		bad = bad || !(typ == TypeBytes || typ == TypeInt64)
+	}
 	if bad {
 		return fmt.Errorf("bad table schema: %s", tdef.Name)
 	}
@@ -445,8 +662,19 @@ type Scanner struct {
 	Key2 Record
 	// internal
 	tdef   *TableDef
-	iter   *BIter // 底层 B 树迭代器
-	keyEnd []byte // 编码后的 Key2
+	iter   scanIter // 底层迭代器
+	keyEnd []byte   // 编码后的 Key2
+}
+
+// scanIter Scanner 底层的迭代器
+// DBTX.Scan 使用事务中的 BIter，DB.Scan 使用分批读取的 readIter。
+type scanIter interface {
+	Valid() bool
+	Key() []byte
+	Deref() (key []byte, val []byte)
+	Next()
+	Prev()
+	Err() error
 }
 
 // Valid 是否在范围内
@@ -454,10 +682,15 @@ func (sc *Scanner) Valid() bool {
 	if !sc.iter.Valid() {
 		return false
 	}
-	key, _ := sc.iter.Deref()
+	key := sc.iter.Key()
 	return cmpOK(key, sc.Cmp2, sc.keyEnd)
 }
 
+// Err 返回扫描中遇到的错误，出错后 Valid 返回 false
+func (sc *Scanner) Err() error {
+	return sc.iter.Err()
+}
+
 // Next 移动底层 B 树迭代器
 func (sc *Scanner) Next() {
 	util.Assert(sc.Valid())
@@ -469,21 +702,27 @@ func (sc *Scanner) Next() {
 }
 
 // Deref 返回当前行
-func (sc *Scanner) Deref(rec *Record) {
+func (sc *Scanner) Deref(rec *Record) error {
 	util.Assert(sc.Valid())
 	// 从迭代器中获取 KV
 	key, val := sc.iter.Deref()
+	if err := sc.iter.Err(); err != nil {
+		return err
+	}
 	// 将 KV 解码为列
 	rec.Cols = sc.tdef.Cols
 	rec.Vals = rec.Vals[:0]
 	for _, v := range sc.tdef.Types {
 		rec.Vals = append(rec.Vals, Value{Type: v})
 	}
-	decodeKey(key, rec.Vals[:sc.tdef.PKeys])
-	decodeValues(val, rec.Vals[sc.tdef.PKeys:])
+	if err := decodeKey(key, rec.Vals[:sc.tdef.PKeys]); err != nil {
+		return err
+	}
+	return decodeValues(val, rec.Vals[sc.tdef.PKeys:])
 }
 
-func dbScan(db *DB, tdef *TableDef, req *Scanner) error {
+// dbScan 开始范围查询，seek 返回底层的迭代器
+func dbScan(seek func(key []byte, cmp int) scanIter, tdef *TableDef, req *Scanner) error {
 	// 0. 健全性检查
 	switch {
 	case req.Cmp1 > 0 && req.Cmp2 < 0:
@@ -506,6 +745,6 @@ func dbScan(db *DB, tdef *TableDef, req *Scanner) error {
 	keyStart := encodeKey(nil, tdef.Prefix, values1[:tdef.PKeys])
 	req.keyEnd = encodeKey(nil, tdef.Prefix, values2[:tdef.PKeys])
 	// 3. 搜索开始key
-	req.iter = db.kv.tree.Seek(keyStart, req.Cmp1)
-	return nil
+	req.iter = seek(keyStart, req.Cmp1)
+	return req.iter.Err()
 }
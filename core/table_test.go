@@ -1,10 +1,13 @@
 package core
 
 import (
+	"errors"
+	"fmt"
+	"iter"
 	"math"
-	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	is "github.com/stretchr/testify/require"
@@ -18,21 +21,17 @@ type R struct {
 }
 
 func newR() *R {
-	err := os.Remove("r.db")
-	util.Assert(err == nil || os.IsNotExist(err))
-
 	r := &R{
-		db:  DB{Path: "r.db"},
+		db:  DB{Store: &FaultStorage{Storage: &MemStorage{}}},
 		ref: map[string][]Record{},
 	}
-	err = r.db.Open()
+	err := r.db.Open()
 	util.Assert(err == nil)
 	return r
 }
 
 func (r *R) dispose() {
 	r.db.Close()
-	_ = os.Remove("r.db")
 }
 
 func (r *R) create(tdef *TableDef) {
@@ -203,7 +202,8 @@ func TestStringEscape(t *testing.T) {
 	for i, s := range in {
 		b := escapeString(s)
 		is.Equal(t, out[i], b)
-		s2 := unescapeString(b)
+		s2, err := unescapeString(b)
+		is.NoError(t, err)
 		is.Equal(t, s, s2)
 	}
 }
@@ -217,7 +217,7 @@ func TestTableEncoding(t *testing.T) {
 		v := Value{Type: TypeInt64, I64: int64(i)}
 		b := encodeValues(nil, []Value{v})
 		out := []Value{v}
-		decodeValues(b, out)
+		util.Assert(decodeValues(b, out) == nil)
 		util.Assert(out[0].I64 == int64(i))
 		encoded = append(encoded, string(b))
 	}
@@ -313,3 +313,236 @@ func TestTableScan(t *testing.T) {
 
 	r.dispose()
 }
+
+func TestTableScanBatches(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:  "t",
+		Types: []uint32{TypeInt64, TypeBytes},
+		Cols:  []string{"id", "name"},
+		PKeys: 1,
+	})
+	row := func(id int, name string) Record {
+		return *(&Record{}).AddInt64("id", int64(id)).AddStr("name", []byte(name))
+	}
+	for i := 0; i < 2000; i++ {
+		r.add("t", row(i, "old"))
+	}
+
+	// 扫描期间的提交不会导致跳过行，扫描不占用读事务
+	sc := Scanner{
+		Cmp1: CmpGe, Cmp2: CmpLe,
+		Key1: *(&Record{}).AddInt64("id", 0),
+		Key2: *(&Record{}).AddInt64("id", 1999),
+	}
+	is.NoError(t, r.db.Scan("t", &sc))
+	n := 0
+	for got := (Record{}); sc.Valid(); sc.Next() {
+		is.Empty(t, r.db.kv.snap.readers)
+		is.NoError(t, sc.Deref(&got))
+		is.Equal(t, int64(n), got.Get("id").I64)
+		name := string(got.Get("name").Str)
+		is.True(t, name == "old" || strings.HasPrefix(name, "new"), name)
+		for j := 0; j < 3; j++ {
+			_, err := r.db.Upsert("t", row((n*3+j)%2000, bigVal("new", n%500+3)))
+			is.NoError(t, err)
+		}
+		n++
+	}
+	is.NoError(t, sc.Err())
+	is.Equal(t, 2000, n)
+
+	// 反向扫描
+	sc = Scanner{
+		Cmp1: CmpLt, Cmp2: CmpGe,
+		Key1: *(&Record{}).AddInt64("id", 1500),
+		Key2: *(&Record{}).AddInt64("id", 100),
+	}
+	is.NoError(t, r.db.Scan("t", &sc))
+	n = 1499
+	for got := (Record{}); sc.Valid(); sc.Next() {
+		is.NoError(t, sc.Deref(&got))
+		is.Equal(t, int64(n), got.Get("id").I64)
+		n--
+	}
+	is.NoError(t, sc.Err())
+	is.Equal(t, 99, n)
+
+	// 读取不等待写事务，提前放弃的扫描不影响页面的复用
+	tx := r.db.Begin()
+	_, err := tx.Upsert("t", row(0, "tx"))
+	is.NoError(t, err)
+	rec := (&Record{}).AddInt64("id", 0)
+	ok, err := r.db.Get("t", rec)
+	is.NoError(t, err)
+	is.True(t, ok)
+	is.NotEqual(t, "tx", string(rec.Get("name").Str))
+	is.NoError(t, r.db.Scan("t", &sc))
+	is.True(t, sc.Valid())
+	is.NoError(t, tx.Commit())
+	is.Empty(t, r.db.kv.snap.readers)
+}
+
+func TestTableBulkLoad(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:  "tbl_test",
+		Cols:  []string{"id", "val"},
+		Types: []uint32{TypeInt64, TypeBytes},
+		PKeys: 1,
+	})
+	r.create(&TableDef{
+		Name:  "tbl_other",
+		Cols:  []string{"name", "val"},
+		Types: []uint32{TypeBytes, TypeInt64},
+		PKeys: 1,
+	})
+	other := Record{}
+	other.AddStr("name", []byte("x")).AddInt64("val", 1)
+	r.add("tbl_other", other)
+	for i := -10; i < 10; i++ {
+		rec := Record{}
+		rec.AddInt64("id", int64(i*100)).AddStr("val", []byte("old"))
+		r.add("tbl_test", rec)
+	}
+
+	// 按主键排序的记录，编码之后的键也是有序的
+	row := func(id int) Record {
+		rec := Record{}
+		rec.AddInt64("id", int64(id)).AddStr("val", []byte(fmt.Sprint("new", id)))
+		return rec
+	}
+	rows := func(ids ...int) iter.Seq[Record] {
+		return func(yield func(Record) bool) {
+			for _, id := range ids {
+				if !yield(row(id)) {
+					return
+				}
+			}
+		}
+	}
+	var ids []int
+	for i := -1000; i < 1000; i++ {
+		ids = append(ids, i)
+	}
+	is.NoError(t, r.db.BulkLoad("tbl_test", rows(ids...), 0))
+	r.ref["tbl_test"] = nil
+	for _, id := range ids {
+		r.ref["tbl_test"] = append(r.ref["tbl_test"], row(id))
+	}
+	for _, id := range []int{-1000, -100, 0, 500, 999} {
+		got := Record{}
+		got.AddInt64("id", int64(id))
+		is.True(t, r.get("tbl_test", &got))
+	}
+	got := Record{}
+	got.AddStr("name", []byte("x"))
+	is.True(t, r.get("tbl_other", &got))
+
+	// 错误的输入不修改数据库
+	is.Equal(t, ErrUnsorted, r.db.BulkLoad("tbl_test", rows(1, 3, 2), 0))
+	bad := func(yield func(Record) bool) {
+		_ = yield(row(5000)) && yield(*(&Record{}).AddInt64("id", 5001))
+	}
+	is.Error(t, r.db.BulkLoad("tbl_test", bad, 0))
+	is.Error(t, r.db.BulkLoad("tbl_none", rows(1), 0))
+	got = Record{}
+	got.AddInt64("id", 5000)
+	is.False(t, r.get("tbl_test", &got))
+	got = Record{}
+	got.AddInt64("id", 1)
+	is.True(t, r.get("tbl_test", &got))
+}
+
+func TestTableCorruptPage(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:  "tbl_test",
+		Cols:  []string{"id", "val"},
+		Types: []uint32{TypeInt64, TypeBytes},
+		PKeys: 1,
+	})
+	for i := int64(0); i < 1000; i++ {
+		rec := Record{}
+		rec.AddInt64("id", i).AddStr("val", []byte("hello"))
+		r.add("tbl_test", rec)
+	}
+
+	// 损坏最后一个叶子结点
+	tree := &r.db.kv.tree
+	ptr := tree.root
+	for node := BNode(tree.get(ptr)); node.bType() == BNodeNode; node = tree.get(ptr) {
+		ptr = node.getPtr(node.nKeys() - 1)
+	}
+	corruptPage(t, r.db.Store, ptr)
+	r.db.Close()
+	r.db = DB{Store: r.db.Store}
+	is.NoError(t, r.db.Open())
+
+	_, err := r.db.Get("tbl_test", (&Record{}).AddInt64("id", 999))
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, err)
+
+	// 扫描在损坏的页面处停止
+	sc := Scanner{
+		Cmp1: CmpGe, Cmp2: CmpLe,
+		Key1: *(&Record{}).AddInt64("id", 0),
+		Key2: *(&Record{}).AddInt64("id", 999),
+	}
+	is.NoError(t, r.db.Scan("tbl_test", &sc))
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		n++
+	}
+	is.True(t, n < 1000)
+	is.Equal(t, ErrCorruptPage{Ptr: ptr}, sc.Err())
+}
+
+func TestTableInputErr(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	err := r.db.TableNew(&TableDef{
+		Name:  "bad_type",
+		Cols:  []string{"id"},
+		Types: []uint32{99},
+		PKeys: 1,
+	})
+	is.Error(t, err)
+
+	r.create(&TableDef{
+		Name:  "tbl_test",
+		Cols:  []string{"name", "val"},
+		Types: []uint32{TypeBytes, TypeBytes},
+		PKeys: 1,
+	})
+	// 编码后的主键太长
+	rec := Record{}
+	rec.AddStr("name", make([]byte, BTreeMaxKeySize)).AddStr("val", nil)
+	_, err = r.db.Insert("tbl_test", rec)
+	is.Equal(t, ErrKeyTooLarge, err)
+	rec = Record{}
+	rec.AddStr("name", []byte("k")).AddStr("val", make([]byte, MaxValSize+1))
+	_, err = r.db.Insert("tbl_test", rec)
+	is.Equal(t, ErrValueTooLarge, err)
+
+	// 损坏的表定义
+	def := Record{}
+	def.AddStr("name", []byte("bad_def")).AddStr("def", []byte("{"))
+	_, err = r.db.Upsert("@table", def)
+	is.NoError(t, err)
+	_, err = r.db.Get("bad_def", (&Record{}).AddStr("name", []byte("k")))
+	is.True(t, errors.Is(err, ErrCorrupt))
+
+	// 损坏的值
+	row := Record{}
+	row.AddStr("name", []byte("k")).AddStr("val", []byte("v"))
+	r.add("tbl_test", row)
+	key := encodeKey(nil, r.db.tables["tbl_test"].Prefix, []Value{{Type: TypeBytes, Str: []byte("k")}})
+	_, err = r.db.kv.Set(key, []byte{1, 3, 0})
+	is.NoError(t, err)
+	_, err = r.db.Get("tbl_test", (&Record{}).AddStr("name", []byte("k")))
+	is.True(t, errors.Is(err, ErrCorrupt))
+}
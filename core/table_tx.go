@@ -0,0 +1,197 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"iter"
+)
+
+// DBTX 表级事务，可以跨多个表
+// 事务中的读取可以看到自己未提交的写入，提交时只切换一次 meta 页面。
+type DBTX struct {
+	db     *DB
+	kv     *KVTX
+	tables map[string]*TableDef // 本事务中加载或创建的表定义，提交后才进入 DB.tables
+	// 调用者传入 TableNew 的表定义 -> 本事务中的副本，提交成功后才写回 Prefix
+	created map[*TableDef]*TableDef
+}
+
+// Begin 开始一个事务
+func (db *DB) Begin() *DBTX {
+	return &DBTX{
+		db:      db,
+		kv:      db.kv.Begin(),
+		tables:  map[string]*TableDef{},
+		created: map[*TableDef]*TableDef{},
+	}
+}
+
+// Commit 提交事务
+func (tx *DBTX) Commit() error {
+	if err := tx.kv.Commit(); err != nil {
+		return err
+	}
+	tx.db.mu.Lock()
+	for name, tdef := range tx.tables {
+		tx.db.tables[name] = tdef
+	}
+	tx.db.mu.Unlock()
+	for caller, tdef := range tx.created {
+		caller.Prefix = tdef.Prefix
+	}
+	return nil
+}
+
+// Abort 放弃事务，事务中缓存的表定义也一并丢弃
+func (tx *DBTX) Abort() {
+	tx.kv.Abort()
+}
+
+// ExportTree 见 KVTX.ExportTree
+func (tx *DBTX) ExportTree(maxDepth int) (*ExportNode, error) {
+	return tx.kv.ExportTree(maxDepth)
+}
+
+// TableNew 创建新表
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+	// 0. 健全性检查
+	if err := tableDefCheck(tdef); err != nil {
+		return err
+	}
+	// 1. 检查现有表
+	table := (&Record{}).AddStr("name", []byte(tdef.Name))
+	ok, err := dbGet(tx.kv, TdefTable, table)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("table exists: %s", tdef.Name)
+	}
+	// 2. 分配新前缀
+	if tdef.Prefix != 0 {
+		return fmt.Errorf("bad table schema: %s", tdef.Name)
+	}
+	// 在副本上分配，放弃或提交失败时调用者的表定义不变，可以重试
+	caller, copied := tdef, *tdef
+	tdef = &copied
+	tdef.Prefix = TablePrefixMin
+	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+	ok, err = dbGet(tx.kv, TdefMeta, meta)
+	if err != nil {
+		return err
+	}
+	if ok {
+		val := meta.Get("val").Str
+		if len(val) != 4 {
+			return fmt.Errorf("%w: bad next_prefix", ErrCorrupt)
+		}
+		tdef.Prefix = binary.LittleEndian.Uint32(val)
+		if tdef.Prefix <= TablePrefixMin {
+			return fmt.Errorf("%w: bad next_prefix", ErrCorrupt)
+		}
+	} else {
+		meta.AddStr("val", make([]byte, 4))
+	}
+	// 3. 更新下一个前缀
+	// FIXME: integer overflow.
+	binary.LittleEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+1)
+	_, err = dbUpdate(tx, TdefMeta, &DBUpdateReq{Record: *meta})
+	if err != nil {
+		return err
+	}
+	// 4. 存储 schema
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	table.AddStr("def", val)
+	if _, err = dbUpdate(tx, TdefTable, &DBUpdateReq{Record: *table}); err != nil {
+		return err
+	}
+	tx.tables[tdef.Name] = tdef
+	tx.created[caller] = tdef
+	return nil
+}
+
+// Get 获取记录
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	if tdef == nil {
+		return false, fmt.Errorf("table %s not found", table)
+	}
+	countOp(tx.db, table, opGet)
+	return dbGet(tx.kv, tdef, rec)
+}
+
+// Insert 插入记录
+func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
+	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: ModeInsertOnly})
+}
+
+// Set 添加记录
+func (tx *DBTX) Set(table string, dbReq *DBUpdateReq) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	if tdef == nil {
+		return false, fmt.Errorf("table not found: %s", table)
+	}
+	countOp(tx.db, table, setOp(dbReq.Mode))
+	return dbUpdate(tx, tdef, dbReq)
+}
+
+// Update 更新记录
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: ModeUpdateOnly})
+}
+
+// Upsert 插入或更新记录
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: ModeUpsert})
+}
+
+// Delete 删除记录
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	if tdef == nil {
+		return false, fmt.Errorf("table not found: %s", table)
+	}
+	countOp(tx.db, table, opDelete)
+	return dbDelete(tx, tdef, rec)
+}
+
+// Scan 扫描记录
+func (tx *DBTX) Scan(table string, req *Scanner) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", table)
+	}
+	countOp(tx.db, table, opScan)
+	return dbScan(func(key []byte, cmp int) scanIter {
+		return tx.kv.Seek(key, cmp)
+	}, tdef, req)
+}
+
+// BulkLoad 按主键严格递增的顺序批量加载记录，已有的记录被覆盖
+// 见 KVTX.BulkLoad，出错之后事务只能放弃。
+func (tx *DBTX) BulkLoad(table string, recs iter.Seq[Record], fill float64) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", table)
+	}
+	return dbBulkLoad(tx, tdef, recs, fill)
+}
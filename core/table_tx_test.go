@@ -0,0 +1,116 @@
+package core
+
+import (
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestDBTX(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	newTdef := func(name string) *TableDef {
+		return &TableDef{
+			Name:  name,
+			Cols:  []string{"id", "name"},
+			Types: []uint32{TypeInt64, TypeBytes},
+			PKeys: 1,
+		}
+	}
+	row := func(id int64, name string) Record {
+		rec := Record{}
+		rec.AddInt64("id", id).AddStr("name", []byte(name))
+		return rec
+	}
+	key := func(id int64) *Record {
+		return (&Record{}).AddInt64("id", id)
+	}
+
+	// 放弃的事务中创建的表不会留在缓存中
+	tx := r.db.Begin()
+	is.NoError(t, tx.TableNew(newTdef("t1")))
+	added, err := tx.Insert("t1", row(1, "a"))
+	is.NoError(t, err)
+	is.True(t, added)
+	ok, err := tx.Get("t1", key(1))
+	is.NoError(t, err)
+	is.True(t, ok)
+	tx.Abort()
+	is.Nil(t, r.db.tables["t1"])
+	_, err = r.db.Get("t1", key(1))
+	is.Error(t, err)
+
+	// 放弃或者提交失败之后调用者的表定义不变，可以重试
+	tdef := newTdef("t0")
+	tx = r.db.Begin()
+	is.NoError(t, tx.TableNew(tdef))
+	tx.Abort()
+	is.Zero(t, tdef.Prefix)
+	r.db.Store.(*FaultStorage).SyncErr = fsyncErr(1)
+	is.Error(t, r.db.TableNew(tdef))
+	is.Zero(t, tdef.Prefix)
+	r.db.Store.(*FaultStorage).SyncErr = nil
+	is.NoError(t, r.db.TableNew(tdef))
+	is.NotZero(t, tdef.Prefix)
+	is.Equal(t, tdef.Prefix, r.db.tables["t0"].Prefix)
+
+	// 创建表并写入初始数据
+	tx = r.db.Begin()
+	is.NoError(t, tx.TableNew(newTdef("t1")))
+	is.NoError(t, tx.TableNew(newTdef("t2")))
+	for i := int64(0); i < 10; i++ {
+		_, err = tx.Insert("t1", row(i, "a"))
+		is.NoError(t, err)
+	}
+	is.NoError(t, tx.Commit())
+	is.NotNil(t, r.db.tables["t1"])
+	is.NotNil(t, r.db.tables["t2"])
+
+	// 在两个表之间移动一行
+	nSync := 0
+	r.db.Store.(*FaultStorage).SyncErr = func() error {
+		nSync++
+		return nil
+	}
+	tx = r.db.Begin()
+	deleted, err := tx.Delete("t1", *key(3))
+	is.NoError(t, err)
+	is.True(t, deleted)
+	added, err = tx.Insert("t2", row(3, "a"))
+	is.NoError(t, err)
+	is.True(t, added)
+
+	// 事务中的扫描能看到未提交的修改
+	sc := Scanner{Cmp1: CmpGe, Cmp2: CmpLe, Key1: *key(0), Key2: *key(100)}
+	is.NoError(t, tx.Scan("t1", &sc))
+	var ids []int64
+	for got := (Record{}); sc.Valid(); sc.Next() {
+		sc.Deref(&got)
+		ids = append(ids, got.Get("id").I64)
+	}
+	is.Equal(t, []int64{0, 1, 2, 4, 5, 6, 7, 8, 9}, ids)
+	is.NoError(t, tx.Commit())
+	is.Equal(t, 2, nSync)
+
+	ok, err = r.db.Get("t1", key(3))
+	is.NoError(t, err)
+	is.False(t, ok)
+	ok, err = r.db.Get("t2", key(3))
+	is.NoError(t, err)
+	is.True(t, ok)
+
+	// 放弃的移动不产生任何影响
+	tx = r.db.Begin()
+	_, err = tx.Delete("t2", *key(3))
+	is.NoError(t, err)
+	_, err = tx.Insert("t1", row(3, "a"))
+	is.NoError(t, err)
+	tx.Abort()
+	ok, err = r.db.Get("t2", key(3))
+	is.NoError(t, err)
+	is.True(t, ok)
+	ok, err = r.db.Get("t1", key(3))
+	is.NoError(t, err)
+	is.False(t, ok)
+}
@@ -0,0 +1,425 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WAL 的一条记录是一次提交修改的所有页面和提交之后的 meta：
+// | crc32 | npages | base | meta | ptr | page | ... |
+// |  4B   |   4B   |  8B  | 48B  | 8B  |      |     |
+// crc32 覆盖之后的所有字节。base 是日志开始时主文件 meta 的版本号，
+// 同一段日志中的记录都相同，日志从头开始覆盖写入之后，之前留下的记录因为 base 不同而失效。
+//
+// 提交只顺序写入日志并 fsync 一次，修改的页面留在内存中（walPages），读者和写者先在其中查找。
+// 后台的 checkpoint 将这些页面写入主文件，fsync 之后写入最后一条记录的 meta 再 fsync，
+// 然后从内存中删除这些页面；期间没有新的提交时日志从头开始。
+// checkpoint 不持有写锁，只在读取和更新日志的状态时与提交互斥。
+const walHeaderSize = 64
+
+// WALCheckpointSize 默认的 checkpoint 阈值，见 KV.CheckpointSize
+const WALCheckpointSize = 16 << 20
+
+// walStall 日志超过 checkpoint 阈值的这个倍数时，新的写事务等待日志从头开始
+const walStall = 4
+
+// walPages 日志中还没有写入主文件的页面，页号到页面的内容
+// 发布之后不再修改，提交和 checkpoint 复制一份再整体替换，读者的快照持有其中一份。
+type walPages map[uint64][]byte
+
+// walLoad 返回当前日志中的页面，不使用 WAL 时为空
+func walLoad(db *KV) walPages {
+	if pages := db.wal.pages.Load(); pages != nil {
+		return *pages
+	}
+	return nil
+}
+
+// pageReadRaw 读取已提交的页面，不验证校验和
+func pageReadRaw(db *KV, ptr uint64) []byte {
+	if page, ok := walLoad(db)[ptr]; ok {
+		return page
+	}
+	return db.Store.Read(int64(ptr)*int64(db.PageSize), db.PageSize)
+}
+
+// walRecord 构造一次提交的日志记录，同时计算页面的校验和
+func walRecord(db *KV, meta []byte) []byte {
+	ptrs := slices.Sorted(maps.Keys(db.page.updates))
+	rec := make([]byte, walHeaderSize, walHeaderSize+len(ptrs)*(8+db.PageSize))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(ptrs)))
+	binary.LittleEndian.PutUint64(rec[8:], db.wal.base)
+	copy(rec[16:], meta)
+	for _, ptr := range ptrs {
+		page := db.page.updates[ptr]
+		binary.LittleEndian.PutUint32(page[4:], pageChecksum(page))
+		rec = binary.LittleEndian.AppendUint64(rec, ptr)
+		rec = append(rec, page...)
+	}
+	binary.LittleEndian.PutUint32(rec, crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// walCommit 将一次提交追加到日志中，fsync 日志之后提交完成，不写入主文件
+// 写入失败时 offset 处可能留下了记录，在下一次提交之前由 walRevert 使它失效。
+func walCommit(db *KV, n uint64) error {
+	// 提前写入的追加页面（见 flushAppended）不在日志中，先持久化
+	for ptr := db.page.flushed; ptr < db.page.flushed+db.page.nAppend; ptr++ {
+		if db.page.updates[ptr] == nil {
+			if err := fsync(db); err != nil {
+				return syncFailed(db, err)
+			}
+			break
+		}
+	}
+	meta := saveMeta(db)
+	binary.LittleEndian.PutUint64(meta[8:], db.page.flushed+db.page.nAppend)
+
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	start := time.Now()
+	rec := walRecord(db, meta)
+	db.wal.dirty = true
+	if err := db.Log.Write(db.wal.offset, rec); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	observe(db, phaseWritePages, start)
+	if err := syncStorage(db, db.Log); err != nil {
+		return err
+	}
+	db.wal.dirty = false
+	db.wal.offset += int64(len(rec))
+	db.wal.meta = meta
+
+	// 页面交给读者之后不再修改，之后的 pageWrite 会复制一份
+	pages := maps.Clone(walLoad(db))
+	if pages == nil {
+		pages = walPages{}
+	}
+	maps.Copy(pages, db.page.updates)
+	db.wal.pages.Store(&pages)
+	db.page.flushed += db.page.nAppend
+	db.page.nAppend = 0
+	db.page.updates = make(map[uint64][]byte)
+	resetFresh(db)
+
+	markDurable(db, meta, n)
+	db.durable.stats.commits.Store(n)
+	publish(db)
+	if walFullLocked(db) {
+		select {
+		case db.wal.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// walRevert 使失败的提交可能已经写入的记录失效
+func walRevert(db *KV) error {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	if err := db.Log.Write(db.wal.offset, make([]byte, walHeaderSize)); err != nil {
+		return fmt.Errorf("rewrite log: %w", err)
+	}
+	if err := syncStorage(db, db.Log); err != nil {
+		return err
+	}
+	db.wal.dirty = false
+	return nil
+}
+
+// walLimit 返回 checkpoint 的阈值，小于 0 时不在后台 checkpoint
+func walLimit(db *KV) int64 {
+	if db.CheckpointSize == 0 {
+		return WALCheckpointSize
+	}
+	return db.CheckpointSize
+}
+
+// walFullLocked 日志是否超过阈值需要后台 checkpoint，持有 wal.mu
+// 失败的提交留下的记录在下一次提交时才失效，在此之前日志不能从头开始。
+func walFullLocked(db *KV) bool {
+	limit := walLimit(db)
+	return db.wal.wake != nil && limit >= 0 && db.wal.offset >= limit &&
+		!db.wal.dirty && db.wal.err == nil
+}
+
+// walCut checkpoint 开始时日志的状态
+type walCut struct {
+	pages walPages
+	meta  []byte // 最后一条记录的 meta
+	end   int64  // 日志中记录的结束位置
+}
+
+// walCheckpoint 将日志中的页面和最后的 meta 写入主文件，之后从内存中删除这些页面
+// 可以与提交并发，期间没有新的提交时日志从头开始。任何一步失败之后主文件的 meta 都不确定，
+// 之后的写事务都失败，重新打开时从日志恢复。
+func walCheckpoint(db *KV) error {
+	db.wal.ckpt.Lock()
+	defer db.wal.ckpt.Unlock()
+	cut, err := walCutLog(db)
+	if err != nil || cut.end == 0 {
+		return err
+	}
+	if err = walCopy(db, &cut); err != nil {
+		return walFailed(db, err)
+	}
+	walFinish(db, &cut)
+	return nil
+}
+
+// walCutLog 读取 checkpoint 开始时日志的状态
+func walCutLog(db *KV) (walCut, error) {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	return walCut{pages: walLoad(db), meta: db.wal.meta, end: db.wal.offset}, db.wal.err
+}
+
+// walCopy 将 cut 中的页面写入主文件，持久化之后写入 cut 的 meta 再持久化
+// 页面在内存中不再修改，读者可能正在读取，直接写入而不重新计算校验和。
+// 主文件的 meta 引用的页面可能被覆盖，崩溃之后由日志恢复。
+func walCopy(db *KV, cut *walCut) error {
+	npages := binary.LittleEndian.Uint64(cut.meta[8:])
+	if err := db.Store.Extend(int64(npages) * int64(db.PageSize)); err != nil {
+		return err
+	}
+	db.checked.grow(npages)
+	start := time.Now()
+	for _, ptr := range slices.Sorted(maps.Keys(cut.pages)) {
+		if ptr >= npages {
+			continue // 已经被截断，见 KV.truncate
+		}
+		db.checked.clear(ptr)
+		db.stats.pages.Add(1)
+		if err := db.Store.Write(int64(ptr)*int64(db.PageSize), cut.pages[ptr]); err != nil {
+			return err
+		}
+	}
+	observe(db, phaseWritePages, start)
+	if err := fsyncPhase(db, phaseSyncPages); err != nil {
+		return err
+	}
+	start = time.Now()
+	if err := writeMeta(db, cut.meta); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	observe(db, phaseUpdateRoot, start)
+	return fsyncPhase(db, phaseSyncMeta)
+}
+
+// walFinish 从内存中删除已经写入主文件的页面，之后的提交再次修改的页面保留
+// 期间没有新的提交时日志从头开始，base 使之前的记录失效。
+func walFinish(db *KV, cut *walCut) {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	pages := walPages{}
+	for ptr, page := range walLoad(db) {
+		if old, ok := cut.pages[ptr]; !ok || &old[0] != &page[0] {
+			pages[ptr] = page
+		}
+	}
+	db.wal.pages.Store(&pages)
+	db.snap.mu.Lock()
+	db.snap.wal = pages
+	db.snap.mu.Unlock()
+	if db.wal.offset == cut.end && !db.wal.dirty {
+		db.wal.base, db.wal.offset = db.version, 0
+		// 不需要 sync：崩溃之后留下的记录属于之前的日志，重新写入不改变结果，见 walReplay
+		_ = db.Log.Write(0, make([]byte, walHeaderSize))
+		db.wal.cond.Broadcast()
+	}
+}
+
+// walFailed 记录 checkpoint 的错误，之后的写事务都返回这个错误
+func walFailed(db *KV, err error) error {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	db.wal.err = fmt.Errorf("checkpoint: %w", err)
+	db.wal.cond.Broadcast()
+	return db.wal.err
+}
+
+// walErr 返回 checkpoint 的错误
+func walErr(db *KV) error {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	return db.wal.err
+}
+
+// walStart 启动后台 checkpoint
+func walStart(db *KV) {
+	db.wal.wake = make(chan struct{}, 1)
+	db.wal.stop = make(chan struct{})
+	db.wal.done = make(chan struct{})
+	go walLoop(db)
+}
+
+// walLoop 提交使日志超过阈值时唤醒，checkpoint 直到日志低于阈值
+// 持续的提交使日志不能从头开始时连续地 checkpoint，每次只写入上一次之后修改的页面。
+func walLoop(db *KV) {
+	defer close(db.wal.done)
+	for {
+		select {
+		case <-db.wal.stop:
+			return
+		case <-db.wal.wake:
+		}
+		for walFull(db) {
+			select {
+			case <-db.wal.stop:
+				return
+			default:
+			}
+			if walCheckpoint(db) != nil {
+				break // 由之后的写事务返回
+			}
+		}
+	}
+}
+
+// walFull 见 walFullLocked
+func walFull(db *KV) bool {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	return walFullLocked(db)
+}
+
+// walWait 日志超过阈值的 walStall 倍时，新的写事务等待后台 checkpoint 使日志从头开始
+// 否则持续的提交使日志无限增长。
+func walWait(db *KV) {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	for walFullLocked(db) && db.wal.offset >= walStall*walLimit(db) {
+		db.wal.cond.Wait()
+	}
+}
+
+// walStop 停止后台 checkpoint，唤醒等待的写事务
+func walStop(db *KV) {
+	if db.wal.stop == nil {
+		return
+	}
+	close(db.wal.stop)
+	<-db.wal.done
+	db.wal.mu.Lock()
+	db.wal.wake, db.wal.stop, db.wal.done = nil, nil, nil
+	db.wal.cond.Broadcast()
+	db.wal.mu.Unlock()
+}
+
+// walReplay 打开时读取日志中有效的记录，页面放入内存，最后一条记录的 meta 生效
+// 记录按顺序生效，遇到不完整、校验和错误或者 base 与第一条记录不同的记录时停止。
+// 只读时日志留在内存中，否则立即做一次 checkpoint。
+func walReplay(db *KV) error {
+	size, err := db.Log.Size()
+	if err != nil {
+		return err
+	}
+	if err = db.Log.Extend(size); err != nil {
+		return err
+	}
+	db.wal.base, db.wal.offset = db.version, 0
+	pages := walPages{}
+	var meta []byte
+	for db.wal.offset+walHeaderSize <= size {
+		hdr := db.Log.Read(db.wal.offset, walHeaderSize)
+		n := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		recSize := walHeaderSize + n*int64(8+db.PageSize)
+		// 上一次 checkpoint 之后日志没有从头开始时，第一条记录的 base 小于主文件的版本号，
+		// 重新写入这些页面和 meta 不改变结果。
+		base := binary.LittleEndian.Uint64(hdr[8:])
+		if meta == nil && base < db.version {
+			db.wal.base = base
+		}
+		if base != db.wal.base || db.wal.offset+recSize > size {
+			break
+		}
+		rec := db.Log.Read(db.wal.offset, int(recSize))
+		if crc32.ChecksumIEEE(rec[4:]) != binary.LittleEndian.Uint32(rec) {
+			break
+		}
+		for body := rec[walHeaderSize:]; len(body) > 0; body = body[8+db.PageSize:] {
+			pages[binary.LittleEndian.Uint64(body)] = bytes.Clone(body[8 : 8+db.PageSize])
+		}
+		meta = bytes.Clone(rec[16:walHeaderSize])
+		db.wal.offset += recSize
+	}
+	if meta == nil {
+		db.wal.base, db.wal.offset = db.version, 0
+		return nil
+	}
+
+	loadMeta(db, meta)
+	db.free.SetMaxSeq()
+	for ptr := range pages {
+		if ptr >= db.page.flushed {
+			delete(pages, ptr) // 之后被截断
+		}
+	}
+	db.wal.pages.Store(&pages)
+	db.wal.meta = meta
+	db.checked.grow(db.page.flushed)
+	markDurable(db, meta, 0)
+	if db.ReadOnly {
+		return nil
+	}
+	return walCheckpoint(db)
+}
+
+// walOpen 检查选项并打开日志
+func walOpen(db *KV) error {
+	if db.Durability != DurabilityFull {
+		return errors.New("WAL requires DurabilityFull")
+	}
+	if db.Log == nil {
+		if db.Path == "" {
+			return errors.New("WAL requires Log or Path")
+		}
+		db.Log = &FileStorage{Path: db.Path + "-wal", ReadOnly: db.ReadOnly}
+	}
+	if err := db.Log.Open(); err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	db.wal.opened = true
+	db.wal.pages.Store(nil)
+	db.wal.cond = sync.NewCond(&db.wal.mu)
+	db.wal.meta, db.wal.dirty, db.wal.err = nil, false, nil
+	return nil
+}
+
+// walClose 停止后台 checkpoint，做最后一次 checkpoint 并关闭日志
+func walClose(db *KV) {
+	if !db.wal.opened {
+		return
+	}
+	walStop(db)
+	if db.durable.err == nil && !db.ReadOnly {
+		_ = walCheckpoint(db)
+	}
+	_ = db.Log.Close()
+	db.wal.opened = false
+}
+
+// Checkpoint 将日志中的提交写入主文件之后从头开始写入日志，不使用 WAL 时什么也不做
+func (db *KV) Checkpoint() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if !db.WAL {
+		return nil
+	}
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.durable.err != nil {
+		return db.durable.err
+	}
+	return walCheckpoint(db)
+}
@@ -0,0 +1,357 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// newWALD 创建使用 WAL 的测试 DB
+func newWALD(t *testing.T, checkpoint int64) (*D, *FaultStorage) {
+	c := &D{ref: map[string]string{}, store: &FaultStorage{Storage: &MemStorage{}}}
+	log := &FaultStorage{Storage: &MemStorage{}}
+	c.db = KV{Store: c.store, WAL: true, Log: log, CheckpointSize: checkpoint}
+	is.NoError(t, c.db.Open())
+	return c, log
+}
+
+// walCrash 不关闭 DB，直接在同样的存储上重新打开，模拟进程崩溃
+func walCrash(t *testing.T, c *D, log Storage) {
+	walStop(&c.db)
+	c.db = KV{Store: c.store, WAL: true, Log: log}
+	is.NoError(t, c.db.Open())
+}
+
+// walOffset 返回日志的长度
+func walOffset(db *KV) int64 {
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	return db.wal.offset
+}
+
+func TestWAL(t *testing.T) {
+	c, log := newWALD(t, -1)
+	defer c.dispose()
+
+	// 每次提交只 fsync 日志一次，不写入主文件，读取日志中的页面
+	main := storageImage(c.store)
+	fsyncs := c.db.SyncStats().Fsyncs
+	c.add("k", "v")
+	is.Equal(t, fsyncs+1, c.db.SyncStats().Fsyncs)
+	is.True(t, bytes.Equal(main, storageImage(c.store)))
+	is.NotEmpty(t, walLoad(&c.db))
+	c.verify(t)
+
+	// checkpoint 之后页面从主文件读取，日志从头开始
+	version := c.db.version
+	is.NoError(t, c.db.Checkpoint())
+	is.Equal(t, version+1, c.db.version)
+	is.Empty(t, walLoad(&c.db))
+	is.Zero(t, walOffset(&c.db))
+	c.verify(t)
+	c.db.Close()
+
+	// 日志超过阈值之后在后台 checkpoint
+	c.db = KV{Store: c.store, WAL: true, Log: log, CheckpointSize: 64 << 10}
+	is.NoError(t, c.db.Open())
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i))%500)
+		if i%3 == 0 {
+			c.del(key)
+		} else {
+			c.add(key, bigVal(fmt.Sprint(i), int(fmix32(uint32(i))%300)))
+		}
+		if i%100 == 0 {
+			c.verify(t)
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); c.db.Meta().Version == version+1; {
+		is.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+	c.verify(t)
+
+	// 崩溃之后从日志恢复
+	c.add("last", "v")
+	is.True(t, walOffset(&c.db) > 0)
+	walCrash(t, c, log)
+	is.Zero(t, walOffset(&c.db))
+	c.verify(t)
+	c.db.Close()
+	c.db = KV{Store: c.store}
+	is.NoError(t, c.db.Open())
+	c.verify(t)
+	c.db.Close()
+
+	// 日志超过阈值的 walStall 倍时，写事务等待日志从头开始
+	c.db = KV{Store: c.store, WAL: true, Log: log, CheckpointSize: 1}
+	is.NoError(t, c.db.Open())
+	for i := 0; i < 50; i++ {
+		tx := c.db.Begin()
+		is.Zero(t, walOffset(&c.db))
+		key := fmt.Sprintf("key%d", i)
+		tx.Set([]byte(key), []byte("v"))
+		is.NoError(t, tx.Commit())
+		c.ref[key] = "v"
+	}
+	c.verify(t)
+
+	db := KV{Store: &MemStorage{}, WAL: true}
+	is.Error(t, db.Open())
+	db = KV{Store: &MemStorage{}, WAL: true, Log: &MemStorage{}, Durability: DurabilitySingle}
+	is.Error(t, db.Open())
+}
+
+func TestWALErr(t *testing.T) {
+	c, log := newWALD(t, -1)
+	defer c.dispose()
+	c.add("a", "1")
+
+	// 日志写入或 sync 失败时提交失败
+	writeErr := errors.New("write error")
+	log.WriteErr = func(int64, []byte) error { return writeErr }
+	_, err := c.db.Set([]byte("b"), []byte("2"))
+	is.True(t, errors.Is(err, writeErr))
+	log.WriteErr = nil
+	syncErr := errors.New("sync error")
+	log.SyncErr = func() error { return syncErr }
+	_, err = c.db.Set([]byte("c"), []byte("3"))
+	is.True(t, errors.Is(err, syncErr))
+	log.SyncErr = nil
+	c.verify(t)
+
+	// 之后的提交使失败的记录失效
+	c.add("d", "4")
+	walCrash(t, c, log)
+	c.verify(t)
+
+	// checkpoint 写入或 sync 主文件失败之后写事务都失败，重新打开时从日志恢复
+	for i, fault := range []func(){
+		func() { c.store.WriteErr = func(int64, []byte) error { return writeErr } },
+		func() { c.store.SyncErr = func() error { return syncErr } },
+	} {
+		c.db.Close()
+		c.db = KV{Store: c.store, WAL: true, Log: log, CheckpointSize: -1}
+		is.NoError(t, c.db.Open())
+		c.add(fmt.Sprintf("e%d", i), "5")
+		fault()
+		err = c.db.Checkpoint()
+		is.True(t, errors.Is(err, writeErr) || errors.Is(err, syncErr))
+		c.store.WriteErr, c.store.SyncErr = nil, nil
+		_, err = c.db.Set([]byte("f"), []byte("6"))
+		is.True(t, errors.Is(err, writeErr) || errors.Is(err, syncErr))
+		c.verify(t)
+		c.db.Close()
+		walCrash(t, c, log)
+		c.verify(t)
+	}
+
+	// 后台 checkpoint 失败时之后的写事务返回错误
+	c.db.Close()
+	c.db = KV{Store: c.store, WAL: true, Log: log, CheckpointSize: 1}
+	c.store.SyncErr = func() error { return syncErr }
+	is.NoError(t, c.db.Open())
+	_, err = c.db.Set([]byte("g"), []byte("7"))
+	is.NoError(t, err)
+	c.ref["g"] = "7"
+	_, err = c.db.Set([]byte("h"), []byte("8"))
+	is.True(t, errors.Is(err, syncErr))
+	c.db.Close()
+	c.store.SyncErr = nil
+	walCrash(t, c, log)
+	c.verify(t)
+}
+
+// TestWALReadOnly 只读打开时日志中的提交只读入内存，不写入任何文件
+func TestWALReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.db")
+	c := &D{ref: map[string]string{}}
+	c.db = KV{Path: path, WAL: true, CheckpointSize: -1}
+	is.NoError(t, c.db.Open())
+	for i := 0; i < 500; i++ {
+		c.add(fmt.Sprintf("key%d", i), bigVal(fmt.Sprint(i), i))
+	}
+	walStop(&c.db) // 模拟崩溃，日志中的提交没有写入主文件
+	before, err := os.ReadFile(path)
+	is.NoError(t, err)
+	beforeLog, err := os.ReadFile(path + "-wal")
+	is.NoError(t, err)
+
+	c.db = KV{Path: path, WAL: true, ReadOnly: true}
+	is.NoError(t, c.db.Open())
+	c.verify(t)
+	_, err = c.db.Check()
+	is.NoError(t, err)
+	is.True(t, errors.Is(c.db.Checkpoint(), ErrReadOnly))
+	_, err = c.db.Set([]byte("k"), []byte("v"))
+	is.True(t, errors.Is(err, ErrReadOnly))
+	c.db.Close()
+	after, err := os.ReadFile(path)
+	is.NoError(t, err)
+	afterLog, err := os.ReadFile(path + "-wal")
+	is.NoError(t, err)
+	is.True(t, bytes.Equal(before, after))
+	is.True(t, bytes.Equal(beforeLog, afterLog))
+
+	c.db = KV{Path: path, WAL: true}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	c.verify(t)
+}
+
+// TestWALConcurrent 读者与提交和后台 checkpoint 并发
+func TestWALConcurrent(t *testing.T) {
+	c, _ := newWALD(t, 16<<10)
+	defer c.dispose()
+	version := c.db.Meta().Version
+	readerConcurrent(t, c)
+	is.True(t, c.db.Meta().Version > version)
+	_, err := c.db.Check()
+	is.NoError(t, err)
+}
+
+// walEvent 主文件或日志的一次写入或 sync
+type walEvent struct {
+	log bool
+	crashEvent
+}
+
+// walCrashStorage 将写入和 sync 记录到两个文件共享的事件列表
+type walCrashStorage struct {
+	MemStorage
+	log    bool
+	events *[]walEvent
+}
+
+func (s *walCrashStorage) Write(offset int64, data []byte) error {
+	*s.events = append(*s.events, walEvent{s.log, crashEvent{offset: offset, data: bytes.Clone(data)}})
+	return s.MemStorage.Write(offset, data)
+}
+
+func (s *walCrashStorage) Sync() error {
+	*s.events = append(*s.events, walEvent{log: s.log})
+	return nil
+}
+
+// walCrashImages 枚举每个时刻断电后两个文件可能的内容：
+// 每个文件已经 sync 的写入全部生效，之后的写入生效任意前缀。
+// 只需要在每次 sync 之前和最后枚举，其他时刻的内容都包含在其中。
+func walCrashImages(base [2][]byte, events []walEvent, fn func(img [2][]byte, desc string)) {
+	durable := base
+	var pending [2][]crashEvent
+	crash := func(k int) {
+		for i := 0; i <= len(pending[0]); i++ {
+			for j := 0; j <= len(pending[1]); j++ {
+				img := [2][]byte{applyWrites(durable[0], pending[0][:i]...), applyWrites(durable[1], pending[1][:j]...)}
+				fn(img, fmt.Sprintf("event %d, %d main writes, %d log writes", k, i, j))
+			}
+		}
+	}
+	for k, ev := range events {
+		f := 0
+		if ev.log {
+			f = 1
+		}
+		if ev.data != nil {
+			pending[f] = append(pending[f], ev.crashEvent)
+			continue
+		}
+		crash(k)
+		durable[f] = applyWrites(durable[f], pending[f]...)
+		pending[f] = nil
+	}
+	crash(len(events))
+}
+
+func TestWALCrash(t *testing.T) {
+	var events []walEvent
+	store := &walCrashStorage{events: &events}
+	log := &walCrashStorage{log: true, events: &events}
+	c := &D{ref: map[string]string{}}
+	c.db = KV{Store: store, WAL: true, Log: log, CheckpointSize: -1}
+	is.NoError(t, c.db.Open())
+	defer c.dispose()
+	c.add("k", "v")
+	base := [2][]byte{storageImage(store), storageImage(log)}
+	events = nil
+
+	// 每 6 轮一次完整的 checkpoint 和一次与提交交错的 checkpoint
+	var cut walCut
+	history := []map[string]string{maps.Clone(c.ref)}
+	for round := 0; round < 20; round++ {
+		if round%6 == 2 {
+			var err error
+			cut, err = walCutLog(&c.db)
+			is.NoError(t, err)
+		}
+		tx := c.db.Begin()
+		for i := 0; i < 1+int(fmix32(uint32(round))%5); i++ {
+			r := fmix32(uint32(round*100 + i))
+			key := fmt.Sprintf("key%d", r%50)
+			if r%4 == 0 {
+				tx.Del([]byte(key))
+				delete(c.ref, key)
+			} else {
+				val := fmt.Sprintf("%0*d", 1+int(r%500), round)
+				tx.Set([]byte(key), []byte(val))
+				c.ref[key] = val
+			}
+		}
+		is.NoError(t, tx.Commit())
+		history = append(history, maps.Clone(c.ref))
+		switch round % 6 {
+		case 2:
+			is.NoError(t, walCopy(&c.db, &cut))
+		case 3:
+			walFinish(&c.db, &cut)
+			is.True(t, walOffset(&c.db) > cut.end) // 之后有提交，日志不能从头开始
+		case 5:
+			is.NoError(t, c.db.Checkpoint())
+			is.Zero(t, walOffset(&c.db))
+		}
+	}
+	is.True(t, c.db.version > 4)
+
+	check := func(img [2][]byte, desc string, refs ...map[string]string) {
+		d := &D{store: &FaultStorage{Storage: &MemStorage{}}}
+		logStore := &MemStorage{}
+		is.NoError(t, d.store.Open())
+		is.NoError(t, d.store.Write(0, img[0]))
+		is.NoError(t, logStore.Open())
+		is.NoError(t, logStore.Write(0, img[1]))
+		d.db = KV{Store: d.store, WAL: true, Log: logStore}
+		is.NoError(t, d.db.Open(), desc)
+		defer d.dispose()
+		crashMatch(t, d, desc, refs...)
+	}
+	nImages := 0
+	walCrashImages(base, events, func(img [2][]byte, desc string) {
+		check(img, desc, history...)
+		nImages++
+	})
+	t.Logf("%d crash images checked", nImages)
+
+	// 提交在日志 sync 之后返回，只包含已经 sync 的写入时也不会丢失
+	synced := base
+	var pending [2][]crashEvent
+	for _, ev := range events {
+		f := 0
+		if ev.log {
+			f = 1
+		}
+		if ev.data != nil {
+			pending[f] = append(pending[f], ev.crashEvent)
+		} else {
+			synced[f] = applyWrites(synced[f], pending[f]...)
+			pending[f] = nil
+		}
+	}
+	check(synced, "synced", c.ref)
+}
@@ -1,3 +1,5 @@
+//go:build darwin
+
 package util
 
 import (
@@ -5,9 +7,11 @@ import (
 	"unsafe"
 )
 
-// SysOpenatArm64 macOS 系统调用号（ARM64 架构）
-const SysOpenatArm64 = 463
+// sysOpenat macOS openat 系统调用号（amd64 和 arm64 相同）
+// syscall 包在 darwin 上没有导出 Openat
+const sysOpenat = 463
 
+// Openat 打开相对于目录 dirFd 的文件
 func Openat(dirFd int, path string, flags int, perm uint32) (int, error) {
 	// 将路径转换为 C 风格字符串
 	pathPtr, err := syscall.BytePtrFromString(path)
@@ -17,10 +21,10 @@ func Openat(dirFd int, path string, flags int, perm uint32) (int, error) {
 
 	// 调用系统调用
 	r1, _, e := syscall.Syscall6(
-		SysOpenatArm64,
+		sysOpenat,
 		uintptr(dirFd),
 		uintptr(unsafe.Pointer(pathPtr)),
-		uintptr(flags),
+		uintptr(flags|syscall.O_CLOEXEC),
 		uintptr(perm),
 		0, // 未使用
 		0, // 未使用
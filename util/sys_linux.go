@@ -0,0 +1,12 @@
+//go:build linux
+
+package util
+
+import (
+	"syscall"
+)
+
+// Openat 打开相对于目录 dirFd 的文件
+func Openat(dirFd int, path string, flags int, perm uint32) (int, error) {
+	return syscall.Openat(dirFd, path, flags|syscall.O_CLOEXEC, perm)
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOpenat(t *testing.T) {
+	dir := t.TempDir()
+	dirFd, err := syscall.Open(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirFd)
+
+	fd, err := Openat(dirFd, "a.db", os.O_RDWR|os.O_CREATE, 0o664)
+	if err != nil {
+		t.Fatalf("Openat: %v", err)
+	}
+	if _, err = syscall.Write(fd, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = syscall.Close(fd)
+
+	data, err := os.ReadFile(filepath.Join(dir, "a.db"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected content %q, %v", data, err)
+	}
+
+	if _, err = Openat(dirFd, "missing.db", os.O_RDWR, 0); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}